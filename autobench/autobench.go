@@ -3,8 +3,13 @@ package main
 import (
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jessevdk/go-flags"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/iolog"
 	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
 )
 
@@ -17,15 +22,36 @@ type Options struct {
 	CheckSumm          string `short:"c" long:"check" description:"Data integrity check. Can be one of the following values: (md5, crc64, crc32c, ..., sha256)"`
 	Jobs               string `short:"j" long:"jobs" description:"Jobs for fio config" default:"1,8"`
 	Direct			   string `short:"i" long:"direct" description:"Direct properties for fio config" default:"1"`
-	TargetFIODevice    string `short:"D" long:"targetdev" description:"[Optional] To specify block device as a target for FIO. Needs superuser rights (-u=root)."`
+	TargetFIODevice    string `short:"D" long:"targetdev" description:"[Optional] To specify block device as a target for FIO. Needs superuser rights (-u=root). The qemu target finds the attached test volume by itself"`
 	LocalFolderResults string `short:"f" long:"folder" description:"[Optional] A name of folder with tests results" default:"FIOTestsResults"`
 	LocalDirResults    string `short:"l" long:"localpath" description:"[Optional] Path to directory with test results"`
+	Rate               string `long:"rate" description:"[Optional] Bandwidth caps per job (e.g. 50m,100m,200m), every cap is a point of the latency-vs-throughput curve"`
+	RateIOPS           string `long:"rate-iops" description:"[Optional] IOPS caps per job (e.g. 1000,5000,20000), every cap is a point of the latency-vs-throughput curve"`
+	RateProcess        string `long:"rate-process" description:"Arrival process of rate limited IOs" choice:"linear" choice:"poisson" default:"linear"`
+	LatencyTarget      string `long:"latency-target" description:"[Optional] Latency goal (e.g. 2ms), fio searches the highest queue depth up to --iodepth that meets it"`
+	LatencyWindow      string `long:"latency-window" description:"Window of the --latency-target search at every queue depth" default:"5s"`
+	LatencyPercentile  string `long:"latency-percentile" description:"Percentile of the IOs that must meet --latency-target" default:"99"`
+	Profile            string `long:"profile" description:"[Optional] Application-like workload profiles to run instead of the -o/-b/-d/-j matrix, e.g. oltp,log-append (see autobench profiles)"`
+	ProfileFile        string `long:"profile-file" description:"[Optional] JSON file, or directory of them, with more profiles for --profile"`
+	Replay             string `long:"replay" description:"[Optional] blktrace capture or fio iolog to replay against the test device instead of the -o/-b/-d/-j matrix (see autobench capture)"`
+	ReplayNoStall      bool   `long:"replay-no-stall" description:"Replay the IOs of --replay as fast as possible, ignoring the recorded timing"`
+	ReplayScale        int    `long:"replay-scale" description:"Speed of --replay in percent of the recorded one, 200 replays twice as fast" default:"100"`
+	Filesystem         string `long:"fs" description:"[Optional] Format the test device with these filesystems (ext4, xfs, btrfs, f2fs, none for the raw device) and run the jobs on files. The qemu target sweeps them, the others take one"`
+	MkfsOpts           []string `long:"mkfs-opts" description:"[Optional] mkfs options, type:options for one filesystem (e.g. xfs:-m reflink=1) or plain options for all. Can be repeated"`
+	MountOpts          []string `long:"mount-opts" description:"[Optional] Mount options, type:options for one filesystem (e.g. ext4:noatime,data=writeback) or plain options for all. Can be repeated"`
+	NrFiles            int    `long:"nrfiles" description:"[Optional] Files per job on --fs, the job size is spread over them"`
+	OpenFiles          int    `long:"openfiles" description:"[Optional] Files a job on --fs keeps open at once"`
+	Fsync              int    `long:"fsync" description:"[Optional] fsync after this many writes"`
+	Fdatasync          int    `long:"fdatasync" description:"[Optional] fdatasync after this many writes"`
 }
 
 var opts Options
 var parser = flags.NewParser(&opts, flags.Default)
 var FioOptions = mkconfig.FioOptions{}
 
+// latencyRe matches fio time values of the latency target options
+var latencyRe = regexp.MustCompile(`^[0-9]+(us|ms|s)?$`)
+
 func argparse() {
 	if _, err := parser.Parse(); err != nil {
 		switch flagsErr := err.(type) {
@@ -54,6 +80,107 @@ func InitFioOptions() error {
 		return fmt.Errorf("fio tests failed: %v", err)
 	}
 
+	if err := FioOptions.Rates.Set(opts.Rate); err != nil {
+		return fmt.Errorf("fio tests failed: %v", err)
+	}
+	if err := FioOptions.RatesIOPS.Set(opts.RateIOPS); err != nil {
+		return fmt.Errorf("fio tests failed: %v", err)
+	}
+	if len(FioOptions.Rates) != 0 || len(FioOptions.RatesIOPS) != 0 {
+		FioOptions.RateProcess = opts.RateProcess
+	}
+	if opts.LatencyTarget != "" {
+		if len(FioOptions.Rates) != 0 || len(FioOptions.RatesIOPS) != 0 {
+			return fmt.Errorf("--latency-target searches the queue depth at full speed, it does not go with --rate or --rate-iops")
+		}
+		if !latencyRe.MatchString(opts.LatencyTarget) || !latencyRe.MatchString(opts.LatencyWindow) {
+			return fmt.Errorf("invalid latency target %s or window %s, use a number with us, ms or s", opts.LatencyTarget, opts.LatencyWindow)
+		}
+		if p, err := strconv.ParseFloat(opts.LatencyPercentile, 64); err != nil || p <= 0 || p > 100 {
+			return fmt.Errorf("invalid latency percentile %s", opts.LatencyPercentile)
+		}
+		FioOptions.Latency = &mkconfig.LatencyTarget{
+			Target:     opts.LatencyTarget,
+			Window:     opts.LatencyWindow,
+			Percentile: opts.LatencyPercentile,
+		}
+	}
+
+	if opts.Profile != "" {
+		var extra []mkconfig.Profile
+		if opts.ProfileFile != "" {
+			var err error
+			if extra, err = mkconfig.LoadProfiles(opts.ProfileFile); err != nil {
+				return fmt.Errorf("could not load profiles: %w", err)
+			}
+		}
+		profiles, err := mkconfig.FindProfiles(strings.Split(opts.Profile, ","), extra)
+		if err != nil {
+			return fmt.Errorf("fio tests failed: %v", err)
+		}
+		FioOptions.Profiles = profiles
+		if len(FioOptions.Rates) != 0 || len(FioOptions.RatesIOPS) != 0 || FioOptions.Latency != nil {
+			return fmt.Errorf("profiles set their own rates, --profile does not go with --rate, --rate-iops or --latency-target")
+		}
+	}
+
+	if opts.Replay != "" {
+		if len(FioOptions.Profiles) != 0 || len(FioOptions.Rates) != 0 || len(FioOptions.RatesIOPS) != 0 || FioOptions.Latency != nil {
+			return fmt.Errorf("--replay keeps the recorded IOs, it does not go with --profile, --rate, --rate-iops or --latency-target")
+		}
+		if opts.ReplayScale <= 0 {
+			return fmt.Errorf("--replay-scale must be a positive percentage")
+		}
+		info, err := iolog.Inspect(opts.Replay)
+		if err != nil {
+			return fmt.Errorf("could not read the trace to replay: %w", err)
+		}
+		fmt.Printf("Replaying %s: %s, %d IOs (%d reads, %d writes), %d MiB over %v\n", opts.Replay,
+			info.Format, info.IOs, info.Reads, info.Writes, info.Bytes>>20, info.Duration.Round(time.Millisecond))
+		// The runtime caps the replay, give it the recorded time and a margin
+		if !opts.ReplayNoStall {
+			need := info.Duration*100/time.Duration(opts.ReplayScale) + 30*time.Second
+			if need > time.Duration(opts.TimeOneTest)*time.Second {
+				opts.TimeOneTest = int(need.Round(time.Second).Seconds())
+				fmt.Printf("Raised --time to %ds to fit the replay\n", opts.TimeOneTest)
+			}
+		}
+		FioOptions.Replay = &mkconfig.Replay{
+			Source:    opts.Replay,
+			NoStall:   opts.ReplayNoStall,
+			TimeScale: opts.ReplayScale,
+		}
+	}
+
+	if opts.Filesystem != "" {
+		if _, _, err := parseFilesystems(); err != nil {
+			return err
+		}
+		if FioOptions.Replay != nil {
+			return fmt.Errorf("--replay redirects the trace to the raw device, it does not go with --fs")
+		}
+	} else {
+		if opts.NrFiles != 0 || opts.OpenFiles != 0 {
+			return fmt.Errorf("--nrfiles and --openfiles need a filesystem, use --fs")
+		}
+		for _, p := range FioOptions.Profiles {
+			if p.Files {
+				return fmt.Errorf("profile %s works on many files and needs a filesystem, use --fs", p.Name)
+			}
+		}
+	}
+	if opts.NrFiles < 0 || opts.OpenFiles < 0 || opts.Fsync < 0 || opts.Fdatasync < 0 {
+		return fmt.Errorf("--nrfiles, --openfiles, --fsync and --fdatasync can not be negative")
+	}
+	if opts.NrFiles != 0 || opts.OpenFiles != 0 || opts.Fsync != 0 || opts.Fdatasync != 0 {
+		FioOptions.Files = &mkconfig.FileJobs{
+			NrFiles:   opts.NrFiles,
+			OpenFiles: opts.OpenFiles,
+			Fsync:     opts.Fsync,
+			Fdatasync: opts.Fdatasync,
+		}
+	}
+
 	FioOptions.SizeGb = opts.SizeDiskGb
 	FioOptions.Direct = opts.Direct
 
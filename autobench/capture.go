@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/iolog"
+)
+
+type CaptureCommand struct {
+	Device   string `long:"dev" description:"Block device of the host to record, e.g. /dev/nvme0n1" required:"true"`
+	Duration int    `long:"duration" description:"How long to record in sec" default:"60"`
+	Out      string `long:"out" description:"Trace file to write, replay it with --replay" default:"capture.bin"`
+}
+
+var captureCmd CaptureCommand
+
+func (x *CaptureCommand) Execute(args []string) error {
+	if captureCmd.Duration < 1 {
+		return fmt.Errorf("--duration must be at least 1 sec")
+	}
+	fmt.Printf("Recording the IOs of %s for %ds ...\n", captureCmd.Device, captureCmd.Duration)
+	if err := iolog.Capture(captureCmd.Device, time.Duration(captureCmd.Duration)*time.Second, captureCmd.Out); err != nil {
+		return err
+	}
+	info, err := iolog.Inspect(captureCmd.Out)
+	if err != nil {
+		return fmt.Errorf("could not read the capture: %w", err)
+	}
+	fmt.Printf("%s: %d IOs (%d reads, %d writes), %d MiB over %v\n", captureCmd.Out,
+		info.IOs, info.Reads, info.Writes, info.Bytes>>20, info.Duration.Round(time.Millisecond))
+	return nil
+}
+
+func init() {
+	parser.AddCommand(
+		"capture",
+		"Record the IOs of a host device for replay",
+		"This command records the IOs of a running workload on a host block device with blktrace (needs root). The trace replays with --replay on any target",
+		&captureCmd,
+	)
+}
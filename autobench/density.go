@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/procfs"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/backend"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/fioconv"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
+)
+
+// densityStepBuffer covers booting the VMs of a step and collecting results
+const densityStepBuffer = 5 * time.Minute
+
+// densityStep is the outcome of one VM count of a density run
+type densityStep struct {
+	VMs          int                `json:"vms"`
+	MBps         float64            `json:"mbps"`
+	IOPS         float64            `json:"iops"`
+	P99MaxMs     float64            `json:"p99_max_ms"`
+	P99MedianMs  float64            `json:"p99_median_ms"`
+	PerVMP99Ms   map[string]float64 `json:"per_vm_p99_ms"`
+	CPUBusy      float64            `json:"host_cpu_busy"` // 0..1 over the fio run
+	MemAvailMB   uint64             `json:"host_mem_available_mb"`
+	FailedVMs    []string           `json:"failed_vms,omitempty"`
+	SLOViolation bool               `json:"slo_violation"`
+}
+
+// densityRecord is the density result of a test case
+type densityRecord struct {
+	Workload    string         `json:"workload"`
+	SLOP99Ms    float64        `json:"slo_p99_ms,omitempty"`
+	MaxCPUBusy  float64        `json:"max_cpu_busy"`
+	Steps       []*densityStep `json:"steps"`
+	StopReason  string         `json:"stop_reason"`
+	MaxVMsInSLO int            `json:"max_vms_in_slo"`
+	KneeVMs     int            `json:"knee_vms"`
+}
+
+// densityWorkload returns the fio options of the fixed background workload
+// every VM runs in density mode
+func densityWorkload() (mkconfig.FioOptions, error) {
+	w := mkconfig.FioOptions{
+		Direct:    FioOptions.Direct,
+		CheckSumm: FioOptions.CheckSumm,
+		SizeGb:    FioOptions.SizeGb,
+	}
+	if err := w.Operations.Set(qemuCmd.CDensityRW); err != nil {
+		return w, err
+	}
+	if err := w.BlockSize.Set(qemuCmd.CDensityBS); err != nil {
+		return w, err
+	}
+	if err := w.Iodepth.Set(strconv.Itoa(qemuCmd.CDensityDepth)); err != nil {
+		return w, err
+	}
+	if err := w.Jobs.Set("1"); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+// checkDensity validates the density flags
+func checkDensity() error {
+	if qemuCmd.CDensityStep < 1 {
+		return fmt.Errorf("--density-step must be at least 1")
+	}
+	if qemuCmd.CCountVM < qemuCmd.CDensityStep {
+		return fmt.Errorf("density mode needs --vmcount of at least --density-step (%d)", qemuCmd.CDensityStep)
+	}
+	if qemuCmd.CDensityMaxCPU <= 0 || qemuCmd.CDensityMaxCPU > 100 {
+		return fmt.Errorf("--density-max-cpu is a percentage, got %v", qemuCmd.CDensityMaxCPU)
+	}
+	if _, err := guestMemoryMB(qemuCmd.CMemory); err != nil {
+		return err
+	}
+	_, err := densityWorkload()
+	return err
+}
+
+// guestMemoryMB parses --memory the way QEMU takes -m: MiB without a
+// suffix, or a K, M, G or T suffix
+func guestMemoryMB(mem string) (uint64, error) {
+	num, unit := mem, "m"
+	if n := len(mem); n > 0 && strings.ContainsAny(mem[n-1:], "kKmMgGtT") {
+		num, unit = mem[:n-1], strings.ToLower(mem[n-1:])
+	}
+	v, err := strconv.ParseUint(num, 10, 64)
+	if err != nil || v == 0 {
+		return 0, fmt.Errorf("invalid --memory %q, use MiB or a K, M, G or T suffix", mem)
+	}
+	switch unit {
+	case "k":
+		return v >> 10, nil
+	case "g":
+		return v << 10, nil
+	case "t":
+		return v << 20, nil
+	}
+	return v, nil
+}
+
+// densityTotalTime bounds the lifetime of the VMs of a density case
+func densityTotalTime() time.Duration {
+	steps := (qemuCmd.CCountVM + qemuCmd.CDensityStep - 1) / qemuCmd.CDensityStep
+	return time.Duration(steps) * (time.Duration(opts.TimeOneTest)*time.Second + densityStepBuffer)
+}
+
+// hostCPU returns the busy and total jiffies of all host CPUs
+func hostCPU(fs procfs.FS) (busy, total float64, err error) {
+	st, err := fs.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	c := st.CPUTotal
+	total = c.User + c.Nice + c.System + c.Idle + c.Iowait + c.IRQ + c.SoftIRQ + c.Steal
+	return total - c.Idle - c.Iowait, total, nil
+}
+
+// hostMemAvailableMB returns MemAvailable of the host
+func hostMemAvailableMB(fs procfs.FS) (uint64, error) {
+	mi, err := fs.Meminfo()
+	if err != nil {
+		return 0, err
+	}
+	if mi.MemAvailable == nil {
+		return 0, fmt.Errorf("no MemAvailable in /proc/meminfo")
+	}
+	return *mi.MemAvailable / 1024, nil
+}
+
+// runDensityStep runs the workload on all VMs at once and sums up the results
+func runDensityStep(ctx context.Context, vms VMlist, fs procfs.FS, workload mkconfig.FioOptions) (*densityStep, error) {
+	step := &densityStep{VMs: len(vms), PerVMP99Ms: map[string]float64{}}
+	sub := fmt.Sprintf("density-%03d", len(vms))
+	fioTime := time.Duration(opts.TimeOneTest) * time.Second
+
+	busy0, total0, err := hostCPU(fs)
+	if err != nil {
+		return nil, err
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(vms))
+	for i, vm := range vms {
+		wg.Add(1)
+		go func(i int, vm *VirtM) {
+			defer wg.Done()
+			errs[i] = vm.runFIO(sub, opts.LocalFolderResults, vm.targetDevice, workload, fioTime)
+		}(i, vm)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if busy1, total1, err := hostCPU(fs); err == nil && total1 > total0 {
+		step.CPUBusy = (busy1 - busy0) / (total1 - total0)
+	}
+	if step.MemAvailMB, err = hostMemAvailableMB(fs); err != nil {
+		log.Printf("density: %v", err)
+	}
+
+	var p99s []float64
+	for i, vm := range vms {
+		name := filepath.Base(vm.resultPath)
+		if errs[i] != nil {
+			log.Printf("density: fio failed on VM localhost:%d: %v", vm.port, errs[i])
+			step.FailedVMs = append(step.FailedVMs, name)
+			continue
+		}
+		jobs, err := fioconv.Summarize(filepath.Join(vm.resultPath, sub, "result.json"))
+		if err != nil || len(jobs) == 0 {
+			log.Printf("density: no result of VM localhost:%d: %v", vm.port, err)
+			step.FailedVMs = append(step.FailedVMs, name)
+			continue
+		}
+		var p99 float64
+		for _, j := range jobs {
+			step.MBps += float64(j.BWKiBs) / 1024
+			step.IOPS += j.IOPS
+			if j.P99Ms > p99 {
+				p99 = j.P99Ms
+			}
+		}
+		step.PerVMP99Ms[name] = p99
+		p99s = append(p99s, p99)
+	}
+	if len(p99s) != 0 {
+		sort.Float64s(p99s)
+		step.P99MaxMs = p99s[len(p99s)-1]
+		step.P99MedianMs = p99s[len(p99s)/2]
+	}
+	return step, nil
+}
+
+// densityKnee returns the VM count where the throughput curve bends the
+// most: the step farthest above the line from the first to the last step,
+// both axes scaled to 0..1
+func densityKnee(steps []*densityStep) int {
+	if len(steps) < 3 {
+		if len(steps) == 0 {
+			return 0
+		}
+		return steps[len(steps)-1].VMs
+	}
+	first, last := steps[0], steps[len(steps)-1]
+	minY, maxY := first.MBps, first.MBps
+	for _, st := range steps {
+		if st.MBps < minY {
+			minY = st.MBps
+		}
+		if st.MBps > maxY {
+			maxY = st.MBps
+		}
+	}
+	if maxY == minY {
+		return first.VMs
+	}
+	knee, best := last.VMs, 0.0
+	for _, st := range steps {
+		x := float64(st.VMs-first.VMs) / float64(last.VMs-first.VMs)
+		y := (st.MBps - minY) / (maxY - minY)
+		if d := y - x; d > best {
+			knee, best = st.VMs, d
+		}
+	}
+	return knee
+}
+
+// runDensityCase adds VMs step by step, all of them running the same
+// background workload, until the p99 latency SLO, the host CPU or memory
+// limit or --vmcount is reached
+func runDensityCase(ctx context.Context, tc testCase, be backend.Backend, resultsDir string, totalTime time.Duration, mc *manifestCase) error {
+	var workload mkconfig.FioOptions
+	fs, err := procfs.NewFS("/proc")
+	if err != nil {
+		return fmt.Errorf("could not get procfs mounted point. err: %w", err)
+	}
+	rec := &densityRecord{
+		Workload:   fmt.Sprintf("%s bs=%s iodepth=%d", qemuCmd.CDensityRW, qemuCmd.CDensityBS, qemuCmd.CDensityDepth),
+		SLOP99Ms:   qemuCmd.CDensitySLO,
+		MaxCPUBusy: qemuCmd.CDensityMaxCPU / 100,
+		StopReason: "vmcount",
+	}
+	mc.Density = rec
+
+	var virtM = make(VMlist, 0)
+	ctxVMs, cancelVMS := context.WithTimeout(ctx, totalTime)
+	defer cancelVMS()
+	defer func() { virtM.FreeVM() }()
+	place, err := resolvePlacement(tc)
+	if err != nil {
+		return fmt.Errorf("placement %s failed: %w", tc.placement, err)
+	}
+
+	for len(virtM) < qemuCmd.CCountVM {
+		count := qemuCmd.CDensityStep
+		if len(virtM)+count > qemuCmd.CCountVM {
+			count = qemuCmd.CCountVM - len(virtM)
+		}
+		if avail, err := hostMemAvailableMB(fs); err == nil {
+			need, err := guestMemoryMB(qemuCmd.CMemory)
+			if err != nil {
+				return err
+			}
+			if need*uint64(count) > avail {
+				log.Printf("density: %d more VMs need %d MB, %d MB available", count, need*uint64(count), avail)
+				rec.StopReason = "memory"
+				break
+			}
+		}
+
+		first := len(virtM)
+		if err := virtM.AllocateVM(ctxVMs, totalTime, resultsDir, tc, be, place, count); err != nil {
+			return fmt.Errorf("vm create in QEMU failed err:%v", err)
+		}
+		virtM.recordBackstores(mc)
+		virtM.recordDrives(mc)
+		// The size of the test volume is known once the first VMs have it
+		if first == 0 {
+			if workload, err = densityWorkload(); err != nil {
+				return err
+			}
+		}
+		if err := virtM[first:].findTestDevices(tc); err != nil {
+			return err
+		}
+		if place != nil {
+			prec, err := applyPlacement(virtM, place)
+			if prec != nil {
+				mc.Placement = prec
+				defer prec.restore()
+			}
+			if err != nil {
+				return fmt.Errorf("placement %s failed: %w", tc.placement, err)
+			}
+		}
+
+		log.Printf("density: running %s on %d VMs", rec.Workload, len(virtM))
+		step, err := runDensityStep(ctx, virtM, fs, workload)
+		if err != nil {
+			return fmt.Errorf("density step of %d VMs failed: %w", len(virtM), err)
+		}
+		step.SLOViolation = rec.SLOP99Ms > 0 && step.P99MaxMs > rec.SLOP99Ms
+		rec.Steps = append(rec.Steps, step)
+		log.Printf("density: %d VMs: %.2f MB/s, %.0f IOPS, p99 max %.2f ms, median %.2f ms, host CPU %.0f%%",
+			step.VMs, step.MBps, step.IOPS, step.P99MaxMs, step.P99MedianMs, step.CPUBusy*100)
+		if err := writeDensityReport(resultsDir, rec); err != nil {
+			log.Printf("Attention! %v", err)
+		}
+
+		if len(step.FailedVMs) != 0 {
+			rec.StopReason = "fio failed"
+			break
+		}
+		if step.SLOViolation {
+			rec.StopReason = "slo"
+			break
+		}
+		rec.MaxVMsInSLO = step.VMs
+		if step.CPUBusy > rec.MaxCPUBusy {
+			rec.StopReason = "cpu"
+			break
+		}
+	}
+
+	rec.KneeVMs = densityKnee(rec.Steps)
+	if err := writeDensityReport(resultsDir, rec); err != nil {
+		return err
+	}
+	if err := createDensityCharts(resultsDir, tc.name, rec); err != nil {
+		log.Printf("Attention! Could not create density charts: %v", err)
+	}
+	log.Printf("density: stopped by %s, %d VMs within the SLO, knee at %d VMs", rec.StopReason, rec.MaxVMsInSLO, rec.KneeVMs)
+	return nil
+}
+
+// writeDensityReport writes density.csv and density.json of a case
+func writeDensityReport(resultsDir string, rec *densityRecord) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(resultsDir, "density.json"), data, 0644); err != nil {
+		return fmt.Errorf("could not write density.json: %w", err)
+	}
+
+	fd, err := os.Create(filepath.Join(resultsDir, "density.csv"))
+	if err != nil {
+		return fmt.Errorf("could not create density.csv: %w", err)
+	}
+	defer fd.Close()
+	w := csv.NewWriter(fd)
+	w.Write([]string{"VMs", "MB/s", "IOPS", "p99 max (ms)", "p99 median (ms)", "Host CPU busy (%)", "Host MemAvailable (MB)", "SLO violation"})
+	for _, st := range rec.Steps {
+		w.Write([]string{
+			strconv.Itoa(st.VMs),
+			fmt.Sprintf("%.2f", st.MBps),
+			fmt.Sprintf("%.0f", st.IOPS),
+			fmt.Sprintf("%.2f", st.P99MaxMs),
+			fmt.Sprintf("%.2f", st.P99MedianMs),
+			fmt.Sprintf("%.1f", st.CPUBusy*100),
+			strconv.FormatUint(st.MemAvailMB, 10),
+			strconv.FormatBool(st.SLOViolation),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// writeDensityComparison lists the density result of every case with its
+// matrix labels in density.csv of the run
+func writeDensityComparison(resultsDir string, cases []testCase, m *runManifest) error {
+	if len(cases) < 2 {
+		return nil
+	}
+	fd, err := os.Create(filepath.Join(resultsDir, "density.csv"))
+	if err != nil {
+		return fmt.Errorf("could not create density.csv: %w", err)
+	}
+	defer fd.Close()
+	w := csv.NewWriter(fd)
+
+	var header []string
+	for _, l := range cases[0].labels {
+		header = append(header, l.dim)
+	}
+	w.Write(append(header, "Max VMs in SLO", "Knee VMs", "Stop reason", "Peak MB/s"))
+	for i, tc := range cases {
+		if i >= len(m.Cases) || m.Cases[i].Density == nil {
+			continue
+		}
+		rec := m.Cases[i].Density
+		var row []string
+		for _, l := range tc.labels {
+			row = append(row, l.value)
+		}
+		var peak float64
+		for _, st := range rec.Steps {
+			if st.MBps > peak {
+				peak = st.MBps
+			}
+		}
+		w.Write(append(row, strconv.Itoa(rec.MaxVMsInSLO), strconv.Itoa(rec.KneeVMs), rec.StopReason, fmt.Sprintf("%.2f", peak)))
+	}
+	w.Flush()
+	return w.Error()
+}
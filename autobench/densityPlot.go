@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
+)
+
+// createDensityCharts draws the throughput and the p99 latency of a density
+// run over the VM count, the SLO and the knee are marked
+func createDensityCharts(dirPath, testName string, rec *densityRecord) error {
+	if len(rec.Steps) == 0 {
+		return nil
+	}
+	var mbps, p99Max, p99Median plotter.XYs
+	for _, st := range rec.Steps {
+		mbps = append(mbps, plotter.XY{X: float64(st.VMs), Y: st.MBps})
+		p99Max = append(p99Max, plotter.XY{X: float64(st.VMs), Y: st.P99MaxMs})
+		p99Median = append(p99Median, plotter.XY{X: float64(st.VMs), Y: st.P99MedianMs})
+	}
+	xMax := float64(rec.Steps[len(rec.Steps)-1].VMs)
+	description := fmt.Sprintf("VMs running %s, stopped by %s, knee at %d VMs", rec.Workload, rec.StopReason, rec.KneeVMs)
+
+	p := plot.New()
+	p.Title.Text = testName + " aggregate throughput"
+	p.X.Label.Text = description
+	p.Y.Label.Text = "MB/s"
+	p.Add(plotter.NewGrid())
+	if err := plotutil.AddLinePoints(p, "MB/s", mbps); err != nil {
+		return err
+	}
+	if err := addVerticalMark(p, float64(rec.KneeVMs), "knee"); err != nil {
+		return err
+	}
+	p.X.Min, p.X.Max = 0, xMax
+	if err := p.Save(10*vg.Inch, 7*vg.Inch, filepath.Join(dirPath, "density-throughput.svg")); err != nil {
+		return fmt.Errorf("error with save charts %w", err)
+	}
+
+	p = plot.New()
+	p.Title.Text = testName + " p99 latency"
+	p.X.Label.Text = description
+	p.Y.Label.Text = "ms"
+	p.Add(plotter.NewGrid())
+	if err := plotutil.AddLinePoints(p, "p99 max", p99Max, "p99 median", p99Median); err != nil {
+		return err
+	}
+	if rec.SLOP99Ms > 0 {
+		slo, err := plotter.NewLine(plotter.XYs{{X: 0, Y: rec.SLOP99Ms}, {X: xMax, Y: rec.SLOP99Ms}})
+		if err != nil {
+			return err
+		}
+		slo.Color = plotutil.Color(1)
+		slo.Dashes = plotutil.Dashes(2)
+		p.Add(slo)
+		p.Legend.Add("SLO", slo)
+	}
+	p.X.Min, p.X.Max = 0, xMax
+	if err := p.Save(10*vg.Inch, 7*vg.Inch, filepath.Join(dirPath, "density-latency.svg")); err != nil {
+		return fmt.Errorf("error with save charts %w", err)
+	}
+	return nil
+}
+
+// addVerticalMark draws a dashed vertical line at x over the data range
+func addVerticalMark(p *plot.Plot, x float64, name string) error {
+	l, err := plotter.NewLine(plotter.XYs{{X: x, Y: p.Y.Min}, {X: x, Y: p.Y.Max}})
+	if err != nil {
+		return err
+	}
+	l.Color = plotutil.Color(3)
+	l.Dashes = plotutil.Dashes(1)
+	p.Add(l)
+	p.Legend.Add(name, l)
+	return nil
+}
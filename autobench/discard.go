@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/backend"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/fioconv"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/sshwork"
+	"github.com/zededa-yuri/nextgen-storage/autobench/qemutmp"
+)
+
+// discardPhaseTime caps the fill and the trim runs, both stop once the
+// region is done
+const discardPhaseTime = 20 * time.Minute
+
+// discardSettle bounds the wait for the host to account freed space, zfs
+// frees in the next transaction groups
+const discardSettle = time.Minute
+
+// discardVM is what discard did on one VM in one round
+type discardVM struct {
+	VM              string            `json:"vm"`
+	DiscardMaxBytes int64             `json:"guest_discard_max_bytes"`
+	Granularity     int64             `json:"guest_discard_granularity"`
+	Baseline        int64             `json:"baseline_bytes"`
+	Filled          int64             `json:"filled_bytes"`
+	Trimmed         int64             `json:"trimmed_bytes"` // allocated after the trims
+	Raw             map[string]string `json:"backend_after_trim,omitempty"`
+	TrimKiB         int64             `json:"trim_kib"`
+	TrimIOPS        float64           `json:"trim_iops"`
+	TrimMBps        float64           `json:"trim_mbps"`
+	TrimP50Ms       float64           `json:"trim_p50_ms"`
+	TrimP99Ms       float64           `json:"trim_p99_ms"`
+	TrimMaxMs       float64           `json:"trim_max_ms"`
+	Efficiency      float64           `json:"efficiency"` // freed over what the fill allocated, 0..1
+	Error           string            `json:"error,omitempty"`
+}
+
+// discardRound is one trim size of a discard run
+type discardRound struct {
+	BS  string       `json:"bs"`
+	VMs []*discardVM `json:"vms"`
+}
+
+// discardRecord is the discard result of a test case
+type discardRecord struct {
+	SizeGb int             `json:"size_gb"`
+	RW     string          `json:"rw"`
+	Jobs   int             `json:"jobs"`
+	Rounds []*discardRound `json:"rounds"`
+}
+
+// checkDiscard validates the discard flags against the test matrix
+func checkDiscard(cases []testCase) error {
+	if qemuCmd.CDensity {
+		return fmt.Errorf("--discard and --density do not combine")
+	}
+	if qemuCmd.CDiscardSize < 1 || qemuCmd.CDiscardSize > qemuCmd.CSizeDiskGb-1 {
+		return fmt.Errorf("--discard-size must be between 1 and %d Gb, the volume size less 1", qemuCmd.CSizeDiskGb-1)
+	}
+	if qemuCmd.CDiscardJobs < 1 {
+		return fmt.Errorf("--discard-jobs must be at least 1")
+	}
+	if qemuCmd.CLuns > 1 {
+		return fmt.Errorf("discard mode takes one test volume per VM, drop --luns")
+	}
+	var bs mkconfig.BSType
+	if err := bs.Set(qemuCmd.CDiscardBS); err != nil {
+		return err
+	}
+	for _, tc := range cases {
+		if tc.frontend.frontend == "" {
+			return fmt.Errorf("discard mode needs a test volume, use --backend")
+		}
+		if tc.filesystem != nil {
+			return fmt.Errorf("discard mode trims the raw test volume, it does not go with --fs")
+		}
+		be, err := backend.New(tc.backend, backend.Config{}, nil)
+		if err != nil {
+			return err
+		}
+		if _, ok := be.(backend.SpaceReporter); !ok {
+			return fmt.Errorf("the %s backend can not report the space of its volumes, discard mode does not apply", tc.backend)
+		}
+		if tc.frontend.frontend == qemutmp.VhostSCSI && tc.lioAttribs["emulate_tpu"] == "" {
+			log.Printf("discard: %s leaves emulate_tpu of the backstores at its default, sweep it with --lio-attrib emulate_tpu=0,1", tc.name)
+		}
+	}
+	return nil
+}
+
+// discardTotalTime bounds the lifetime of the VMs of a discard case
+func discardTotalTime() time.Duration {
+	return time.Duration(len(splitList(qemuCmd.CDiscardBS)))*2*(discardPhaseTime+discardSettle) + 10*time.Minute
+}
+
+// discardWorkloads returns the fill and trim jobs of a round
+func discardWorkloads(bs string) (fill, trim mkconfig.FioOptions) {
+	jobs := qemuCmd.CDiscardJobs
+	perJobMiB := qemuCmd.CDiscardSize * 1024 / jobs
+	fill = mkconfig.FioOptions{Direct: "1", SizeGb: qemuCmd.CDiscardSize, Profiles: []mkconfig.Profile{{
+		Name: "discard-fill",
+		Jobs: []mkconfig.ProfileJob{{Name: "fill", Options: map[string]string{
+			"rw": "write", "bs": "1m", "iodepth": "16", "numjobs": "1",
+			"size": fmt.Sprintf("%dg", qemuCmd.CDiscardSize), "time_based": "0",
+		}}},
+	}}}
+	trim = mkconfig.FioOptions{Direct: "1", SizeGb: qemuCmd.CDiscardSize, Profiles: []mkconfig.Profile{{
+		Name: "discard-trim",
+		// libaio issues trims synchronously, the jobs keep several in flight
+		Jobs: []mkconfig.ProfileJob{{Name: "trim", Options: map[string]string{
+			"rw": qemuCmd.CDiscardRW, "bs": bs, "iodepth": "1", "numjobs": strconv.Itoa(jobs),
+			"size": fmt.Sprintf("%dm", perJobMiB), "offset_increment": fmt.Sprintf("%dm", perJobMiB),
+			"time_based": "0",
+		}}},
+	}}}
+	return fill, trim
+}
+
+// guestDiscardLimits reads the discard limits of the test device of the VM
+func (vm *VirtM) guestDiscardLimits() (maxBytes, granularity int64, err error) {
+	queue := filepath.Join("/sys/block", filepath.Base(vm.targetDevice), "queue")
+	out, err := sshwork.GetCommandOutputSSH(vm.sshClient,
+		fmt.Sprintf("cat %s/discard_max_bytes %s/discard_granularity", queue, queue))
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w output:[%s]", err, out)
+	}
+	f := strings.Fields(out)
+	if len(f) != 2 {
+		return 0, 0, fmt.Errorf("unexpected discard limits %q", out)
+	}
+	maxBytes, _ = strconv.ParseInt(f[0], 10, 64)
+	granularity, _ = strconv.ParseInt(f[1], 10, 64)
+	return maxBytes, granularity, nil
+}
+
+// settledAllocation waits until the host space of the volume of the VM
+// stops changing, or discardSettle passes
+func settledAllocation(ctx context.Context, sr backend.SpaceReporter, vm *VirtM) (int64, map[string]string, error) {
+	return settledSpace(ctx, func() (int64, map[string]string, error) { return sr.Allocated(vm.volumes[0]) })
+}
+
+// settledSpace polls space until it returns the same bytes twice in a row,
+// or discardSettle passes
+func settledSpace(ctx context.Context, space func() (int64, map[string]string, error)) (int64, map[string]string, error) {
+	last, raw, err := space()
+	if err != nil {
+		return 0, nil, err
+	}
+	deadline := time.Now().Add(discardSettle)
+	for stable := 0; stable < 2 && time.Now().Before(deadline); {
+		select {
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+		cur, curRaw, err := space()
+		if err != nil {
+			return 0, nil, err
+		}
+		if cur == last {
+			stable++
+		} else {
+			stable = 0
+		}
+		last, raw = cur, curRaw
+	}
+	return last, raw, nil
+}
+
+// runDiscardVM fills, measures, trims and measures the volume of one VM
+func runDiscardVM(ctx context.Context, vm *VirtM, sr backend.SpaceReporter, bs string) *discardVM {
+	r := &discardVM{VM: filepath.Base(vm.resultPath)}
+	fail := func(err error) *discardVM {
+		r.Error = err.Error()
+		log.Printf("discard: VM localhost:%d, bs %s: %v", vm.port, bs, err)
+		return r
+	}
+	var err error
+	if r.DiscardMaxBytes, r.Granularity, err = vm.guestDiscardLimits(); err != nil {
+		return fail(fmt.Errorf("could not read the guest discard limits: %w", err))
+	}
+	if r.DiscardMaxBytes == 0 {
+		return fail(fmt.Errorf("%s does not support discard in the guest", vm.targetDevice))
+	}
+	if r.Baseline, _, err = settledAllocation(ctx, sr, vm); err != nil {
+		return fail(err)
+	}
+
+	fill, trim := discardWorkloads(bs)
+	sub := "discard-" + bs
+	if err := vm.runFIO(filepath.Join(sub, "fill"), opts.LocalFolderResults, vm.targetDevice, fill, discardPhaseTime); err != nil {
+		return fail(fmt.Errorf("fill failed: %w", err))
+	}
+	if r.Filled, _, err = settledAllocation(ctx, sr, vm); err != nil {
+		return fail(err)
+	}
+	if err := vm.runFIO(filepath.Join(sub, "trim"), opts.LocalFolderResults, vm.targetDevice, trim, discardPhaseTime); err != nil {
+		return fail(fmt.Errorf("trim failed: %w", err))
+	}
+	if r.Trimmed, r.Raw, err = settledAllocation(ctx, sr, vm); err != nil {
+		return fail(err)
+	}
+
+	sum, err := fioconv.SummarizeTrim(filepath.Join(vm.resultPath, sub, "trim", "result.json"))
+	if err != nil {
+		return fail(err)
+	}
+	r.TrimKiB = sum.KiB
+	r.TrimIOPS = sum.IOPS
+	r.TrimMBps = float64(sum.BWKiBs) / 1024
+	r.TrimP50Ms, r.TrimP99Ms, r.TrimMaxMs = sum.P50Ms, sum.P99Ms, sum.MaxMs
+	// Thick volumes allocate nothing on fill and have nothing to give back
+	if written := r.Filled - r.Baseline; written > 0 {
+		r.Efficiency = float64(r.Filled-r.Trimmed) / float64(written)
+	}
+	return r
+}
+
+// runDiscardCase boots the VMs of a case and runs a fill and trim round
+// per --discard-bs on all of them at once
+func runDiscardCase(ctx context.Context, tc testCase, be backend.Backend, resultsDir string, totalTime time.Duration, mc *manifestCase) error {
+	sr, ok := be.(backend.SpaceReporter)
+	if !ok {
+		return fmt.Errorf("the %s backend can not report the space of its volumes", be.Name())
+	}
+	rec := &discardRecord{SizeGb: qemuCmd.CDiscardSize, RW: qemuCmd.CDiscardRW, Jobs: qemuCmd.CDiscardJobs}
+	mc.Discard = rec
+
+	var virtM = make(VMlist, 0)
+	ctxVMs, cancelVMS := context.WithTimeout(ctx, totalTime)
+	defer cancelVMS()
+	defer func() { virtM.FreeVM() }()
+	place, err := resolvePlacement(tc)
+	if err != nil {
+		return fmt.Errorf("placement %s failed: %w", tc.placement, err)
+	}
+	if err := virtM.AllocateVM(ctxVMs, totalTime, resultsDir, tc, be, place, qemuCmd.CCountVM); err != nil {
+		return fmt.Errorf("vm create in QEMU failed err:%v", err)
+	}
+	virtM.recordBackstores(mc)
+	virtM.recordDrives(mc)
+	if err := virtM.findTestDevices(tc); err != nil {
+		return err
+	}
+	if place != nil {
+		prec, err := applyPlacement(virtM, place)
+		if prec != nil {
+			mc.Placement = prec
+			defer prec.restore()
+		}
+		if err != nil {
+			return fmt.Errorf("placement %s failed: %w", tc.placement, err)
+		}
+	}
+
+	for _, bs := range splitList(qemuCmd.CDiscardBS) {
+		log.Printf("discard: filling and trimming %d Gb with %s %s on %d VMs", rec.SizeGb, bs, rec.RW, len(virtM))
+		round := &discardRound{BS: bs, VMs: make([]*discardVM, len(virtM))}
+		var wg sync.WaitGroup
+		for i, vm := range virtM {
+			wg.Add(1)
+			go func(i int, vm *VirtM) {
+				defer wg.Done()
+				round.VMs[i] = runDiscardVM(ctx, vm, sr, bs)
+			}(i, vm)
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			return fmt.Errorf("test case %s interrupted: %w", tc.name, ctx.Err())
+		}
+		rec.Rounds = append(rec.Rounds, round)
+		for _, r := range round.VMs {
+			if r.Error == "" {
+				log.Printf("discard: %s bs %s: %.0f%% of %d MiB given back, trim p99 %.2f ms",
+					r.VM, bs, r.Efficiency*100, (r.Filled-r.Baseline)>>20, r.TrimP99Ms)
+			}
+		}
+		if err := writeDiscardReport(resultsDir, rec); err != nil {
+			log.Printf("Attention! %v", err)
+		}
+	}
+	return nil
+}
+
+// writeDiscardReport writes discard.csv and discard.json of a case
+func writeDiscardReport(resultsDir string, rec *discardRecord) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(resultsDir, "discard.json"), data, 0644); err != nil {
+		return fmt.Errorf("could not write discard.json: %w", err)
+	}
+
+	fd, err := os.Create(filepath.Join(resultsDir, "discard.csv"))
+	if err != nil {
+		return fmt.Errorf("could not create discard.csv: %w", err)
+	}
+	defer fd.Close()
+	w := csv.NewWriter(fd)
+	w.Write([]string{
+		"Trim BS", "VM", "Guest discard max (bytes)", "Allocated by fill (MiB)", "Given back (MiB)", "Efficiency (%)",
+		"Trim MB/s", "Trim IOPS", "Trim p50 (ms)", "Trim p99 (ms)", "Trim max (ms)", "Error",
+	})
+	for _, round := range rec.Rounds {
+		for _, r := range round.VMs {
+			w.Write([]string{
+				round.BS,
+				r.VM,
+				strconv.FormatInt(r.DiscardMaxBytes, 10),
+				strconv.FormatInt((r.Filled-r.Baseline)>>20, 10),
+				strconv.FormatInt((r.Filled-r.Trimmed)>>20, 10),
+				fmt.Sprintf("%.1f", r.Efficiency*100),
+				fmt.Sprintf("%.2f", r.TrimMBps),
+				fmt.Sprintf("%.0f", r.TrimIOPS),
+				fmt.Sprintf("%.2f", r.TrimP50Ms),
+				fmt.Sprintf("%.2f", r.TrimP99Ms),
+				fmt.Sprintf("%.2f", r.TrimMaxMs),
+				r.Error,
+			})
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// writeDiscardComparison lists the mean reclaim efficiency and the worst
+// trim p99 of every round of every case in discard.csv of the run
+func writeDiscardComparison(resultsDir string, cases []testCase, m *runManifest) error {
+	if len(cases) < 2 {
+		return nil
+	}
+	fd, err := os.Create(filepath.Join(resultsDir, "discard.csv"))
+	if err != nil {
+		return fmt.Errorf("could not create discard.csv: %w", err)
+	}
+	defer fd.Close()
+	w := csv.NewWriter(fd)
+
+	var header []string
+	for _, l := range cases[0].labels {
+		header = append(header, l.dim)
+	}
+	w.Write(append(header, "Trim BS", "VMs", "Efficiency (%)", "Trim MB/s", "Trim p99 max (ms)", "Failed VMs"))
+	for i, tc := range cases {
+		if i >= len(m.Cases) || m.Cases[i].Discard == nil {
+			continue
+		}
+		var labels []string
+		for _, l := range tc.labels {
+			labels = append(labels, l.value)
+		}
+		for _, round := range m.Cases[i].Discard.Rounds {
+			var eff, mbps, p99 float64
+			var ok, failed int
+			for _, r := range round.VMs {
+				if r.Error != "" {
+					failed++
+					continue
+				}
+				ok++
+				eff += r.Efficiency
+				mbps += r.TrimMBps
+				if r.TrimP99Ms > p99 {
+					p99 = r.TrimP99Ms
+				}
+			}
+			if ok != 0 {
+				eff /= float64(ok)
+			}
+			w.Write(append(append([]string{}, labels...),
+				round.BS,
+				strconv.Itoa(ok),
+				fmt.Sprintf("%.1f", eff*100),
+				fmt.Sprintf("%.2f", mbps),
+				fmt.Sprintf("%.2f", p99),
+				strconv.Itoa(failed),
+			))
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
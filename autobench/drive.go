@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/qmp"
+	"github.com/zededa-yuri/nextgen-storage/autobench/qemutmp"
+)
+
+// driveOptValues are the block layer options of the test drive swept with
+// --drive-opt and their values
+var driveOptValues = map[string][]string{
+	"cache":         {"none", "writeback", "writethrough", "directsync", "unsafe"},
+	"aio":           {"threads", "native", "io_uring"},
+	"discard":       {"ignore", "unmap"},
+	"detect-zeroes": {"off", "on", "unmap"},
+}
+
+// cacheModes are the writeback, direct and no-flush flags of a cache mode
+var cacheModes = map[string][3]bool{
+	"none":         {true, true, false},
+	"writeback":    {true, false, false},
+	"writethrough": {false, false, false},
+	"directsync":   {false, true, false},
+	"unsafe":       {true, false, true},
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// driveRecord is the test drive of a VM as requested and as QEMU reports it
+type driveRecord struct {
+	Requested    map[string]string `json:"requested"`
+	Node         string            `json:"node"`
+	Driver       string            `json:"driver"`
+	File         string            `json:"file"`
+	Writeback    bool              `json:"cache_writeback"`
+	Direct       bool              `json:"cache_direct"`
+	NoFlush      bool              `json:"cache_no_flush"`
+	DetectZeroes string            `json:"detect_zeroes"`
+	Source       string            `json:"source"` // query-block of QEMU or query-named-block-nodes of qemu-storage-daemon
+}
+
+// blockDeviceInfo is the part of BlockDeviceInfo of QMP autobench checks
+type blockDeviceInfo struct {
+	NodeName     string `json:"node-name"`
+	File         string `json:"file"`
+	Drv          string `json:"drv"`
+	DetectZeroes string `json:"detect_zeroes"`
+	Cache        struct {
+		Writeback bool `json:"writeback"`
+		Direct    bool `json:"direct"`
+		NoFlush   bool `json:"no-flush"`
+	} `json:"cache"`
+}
+
+// parseDriveOpts parses the --drive-opt sweeps of the test drive
+func parseDriveOpts(list []string) ([]dimension, error) {
+	dims, err := parseSweeps("drive option", list)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range driveOptValues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, d := range dims {
+		values, ok := driveOptValues[d.name]
+		if !ok {
+			return nil, fmt.Errorf("invalid drive option %s, use one of %v", d.name, names)
+		}
+		for _, v := range d.values {
+			if !mkconfig.Contains(values, v) {
+				return nil, fmt.Errorf("invalid %s %s, use one of %v", d.name, v, values)
+			}
+		}
+	}
+	return dims, nil
+}
+
+// driveFrontend reports whether the test volume of a frontend goes through
+// the QEMU block layer, of QEMU or of qemu-storage-daemon
+func driveFrontend(f qemutmp.Frontend) bool {
+	switch f {
+	case qemutmp.VirtioBlk, qemutmp.VirtioSCSI, qemutmp.NVMe, qemutmp.VhostUserBlk:
+		return true
+	}
+	return false
+}
+
+// driveDiscard returns the discard option of the test drive, discard mode
+// passes trims on unless the drive options say otherwise
+func driveDiscard(opts map[string]string) string {
+	if d := opts["discard"]; d != "" {
+		return d
+	}
+	if qemuCmd.CDiscard {
+		return "unmap"
+	}
+	return ""
+}
+
+// daemonDrive returns the cache and aio modes of the test volume in
+// qemu-storage-daemon: cache=none by default, with aio=native when the
+// cache mode allows it
+func daemonDrive(opts map[string]string) (string, string) {
+	cache, aio := opts["cache"], opts["aio"]
+	if cache == "" {
+		cache = "none"
+	}
+	if aio == "" {
+		aio = "threads"
+		if cache == "none" || cache == "directsync" {
+			aio = "native"
+		}
+	}
+	return cache, aio
+}
+
+// driveConflict returns why QEMU would refuse the drive options of a case,
+// empty when it takes them
+func driveConflict(tc testCase) string {
+	cache, aio := tc.driveOpts["cache"], tc.driveOpts["aio"]
+	if tc.frontend.frontend == qemutmp.VhostUserBlk {
+		cache, aio = daemonDrive(tc.driveOpts)
+	}
+	if aio == "native" && cache != "none" && cache != "directsync" {
+		return "aio=native needs cache=none or directsync"
+	}
+	if tc.driveOpts["detect-zeroes"] == "unmap" && driveDiscard(tc.driveOpts) != "unmap" {
+		return "detect-zeroes=unmap needs discard=unmap"
+	}
+	return ""
+}
+
+// checkDrive reads the test drive back over QMP, writes drive.json and
+// fails when QEMU runs it with other cache or detect-zeroes settings than
+// requested. query-block does not report aio and discard, QEMU refuses to
+// start with values it does not take.
+func (vm *VirtM) checkDrive(tc testCase) error {
+	if !driveFrontend(tc.frontend.frontend) {
+		return nil
+	}
+	rec := &driveRecord{Requested: map[string]string{}}
+	for k, v := range tc.driveOpts {
+		rec.Requested[k] = v
+	}
+	if d := driveDiscard(tc.driveOpts); d != "" {
+		rec.Requested["discard"] = d
+	}
+
+	daemon := tc.frontend.frontend == qemutmp.VhostUserBlk
+	socket := vm.qmpSocket
+	if daemon {
+		socket = vm.daemonQMP
+	}
+	mon, err := qmp.Dial(socket)
+	if err != nil {
+		return err
+	}
+	defer mon.Close()
+
+	var info *blockDeviceInfo
+	if daemon {
+		rec.Source = "query-named-block-nodes"
+		var nodes []blockDeviceInfo
+		if err := mon.Execute("query-named-block-nodes", nil, &nodes); err != nil {
+			return err
+		}
+		for i := range nodes {
+			if nodes[i].NodeName == "test" {
+				info = &nodes[i]
+			}
+		}
+	} else {
+		rec.Source = "query-block"
+		var blocks []struct {
+			Device   string           `json:"device"`
+			Inserted *blockDeviceInfo `json:"inserted"`
+		}
+		if err := mon.Execute("query-block", nil, &blocks); err != nil {
+			return err
+		}
+		for _, b := range blocks {
+			if b.Device == "test" {
+				info = b.Inserted
+			}
+		}
+	}
+	if info == nil {
+		return fmt.Errorf("%s does not list the test drive", rec.Source)
+	}
+	rec.Node = info.NodeName
+	rec.Driver = info.Drv
+	rec.File = info.File
+	rec.Writeback, rec.Direct, rec.NoFlush = info.Cache.Writeback, info.Cache.Direct, info.Cache.NoFlush
+	rec.DetectZeroes = info.DetectZeroes
+	vm.drive = rec
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(vm.resultPath, "drive.json"), data, 0644); err != nil {
+		return fmt.Errorf("could not write drive.json: %w", err)
+	}
+
+	if cache := rec.Requested["cache"]; cache != "" {
+		want := cacheModes[cache]
+		got := [3]bool{rec.Writeback, rec.Direct, rec.NoFlush}
+		// A node without a guest device always reports writeback, the
+		// export sets the write cache the guest sees
+		if daemon {
+			want[0] = got[0]
+		}
+		if want != got {
+			return fmt.Errorf("test drive runs with writeback=%v direct=%v no-flush=%v, not cache=%s",
+				got[0], got[1], got[2], cache)
+		}
+	}
+	if dz := rec.Requested["detect-zeroes"]; dz != "" && dz != rec.DetectZeroes {
+		return fmt.Errorf("test drive runs with detect-zeroes=%s, not %s", rec.DetectZeroes, dz)
+	}
+	log.Printf("VM localhost:%d: test drive %s on %s, writeback=%v direct=%v no-flush=%v detect-zeroes=%s",
+		vm.port, rec.Driver, rec.File, rec.Writeback, rec.Direct, rec.NoFlush, rec.DetectZeroes)
+	return nil
+}
+
+// recordDrives adds the test drives of the VMs to the manifest
+func (t VMlist) recordDrives(mc *manifestCase) {
+	for _, vm := range t {
+		if vm.drive != nil {
+			mc.Drives[fmt.Sprintf("localhost:%d", vm.port)] = vm.drive
+		}
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 
 	"github.com/lf-edge/eden/pkg/utils"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/catalog"
 	evehelper "github.com/zededa-yuri/nextgen-storage/autobench/pkg/eve"
 )
 
@@ -16,6 +18,8 @@ type EveCommand struct {
 	RegistryDist string `short:"r" long:"registry-dist" description:"Registry dist path to store (required)"`
 	VmName       string `short:"v" long:"vmname" description:"vbox vmname required to create vm"`
 	TapInterface string `short:"t" long:"with-tap" description:"use tap interface in qemu as the third"`
+	EveImage     string `long:"eve-image" description:"EVE image from the image catalog, used instead of downloading or building one"`
+	CacheDir     string `long:"cache-dir" description:"Image cache dir of --eve-image (default: ~/.cache/autobench)"`
 }
 
 var eveCmd EveCommand
@@ -43,6 +47,26 @@ func (x *EveCommand) Execute(args []string) error {
 
 	eveCfg.ConfigDir = filepath.Join(currentPath, "eve-config-dir")
 
+	// SetupEden keeps an existing image file, eden writes its netboot files
+	// next to it, so the image is copied out of the cache
+	if eveCmd.EveImage != "" {
+		c, err := openCatalog(eveCmd.CacheDir)
+		if err != nil {
+			return err
+		}
+		e, _, err := c.Lookup(eveCmd.EveImage)
+		if err != nil {
+			return err
+		}
+		if e.Kind != catalog.KindEve {
+			return fmt.Errorf("image %s is a %s image", e.Name, e.Kind)
+		}
+		if err := c.Checkout(e.Name, eveCfg.Eve.ImageFile); err != nil {
+			return fmt.Errorf("error checkout eve image %s", err)
+		}
+		log.Printf("EVE image %s %s copied to %s", e.Name, e.Digest, eveCfg.Eve.ImageFile)
+	}
+
 	if err = evehelper.SetupEden(*eveCfg); err != nil {
 		return fmt.Errorf("error setup eden %s", err)
 	}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/fsprep"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
+)
+
+// fsMountPoint is where the test filesystem is mounted
+const fsMountPoint = "/mnt/autobench-fs"
+
+// fsNone is the --fs value of runs on the raw test device
+const fsNone = "none"
+
+// parseFsOpts parses repeated type:options values, options without a known
+// type in front go to every filesystem
+func parseFsOpts(list []string) map[string]string {
+	res := map[string]string{}
+	for _, v := range list {
+		fs := ""
+		if i := strings.Index(v, ":"); i > 0 && mkconfig.Contains(fsprep.Types, v[:i]) {
+			fs, v = v[:i], v[i+1:]
+		}
+		res[fs] = strings.TrimSpace(v)
+	}
+	return res
+}
+
+// parseFilesystems returns the --fs list and the config of every
+// filesystem in it, fsNone has none
+func parseFilesystems() ([]string, map[string]*fsprep.Config, error) {
+	names := splitList(opts.Filesystem)
+	mkfs := parseFsOpts(opts.MkfsOpts)
+	mount := parseFsOpts(opts.MountOpts)
+	byName := map[string]*fsprep.Config{}
+	for _, n := range names {
+		if n == fsNone {
+			continue
+		}
+		c := &fsprep.Config{Type: n, MkfsOpts: mkfs[""], MountOpts: mount[""]}
+		if o, ok := mkfs[n]; ok {
+			c.MkfsOpts = o
+		}
+		if o, ok := mount[n]; ok {
+			c.MountOpts = o
+		}
+		if err := c.Check(); err != nil {
+			return nil, nil, fmt.Errorf("%w or %s", err, fsNone)
+		}
+		byName[n] = c
+	}
+	return names, byName, nil
+}
+
+// singleFilesystem returns the filesystem of the ssh and local targets,
+// only the qemu target sweeps several
+func singleFilesystem() (*fsprep.Config, error) {
+	names, byName, err := parseFilesystems()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 1 {
+		return nil, fmt.Errorf("--fs takes one filesystem here, the qemu target sweeps several")
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	return byName[names[0]], nil
+}
+
+// guestPackages returns --packages with the mkfs tools of --fs added
+func guestPackages() []string {
+	pkgs := splitList(qemuCmd.CPackages)
+	for _, n := range splitList(opts.Filesystem) {
+		if p, ok := fsprep.Packages[n]; ok && !mkconfig.Contains(pkgs, p) {
+			pkgs = append(pkgs, p)
+		}
+	}
+	return pkgs
+}
+
+// fsJobSizeMb splits 90% of the free space of the filesystem between the
+// jobs of the largest numjobs, at most the raw device size each. Metadata and the
+// journal need the rest.
+func fsJobSizeMb(avail int64, fioOptions mkconfig.FioOptions) int {
+	jobs := 8 // the default numjobs of GenerateFIOConfig is 1,8
+	if len(fioOptions.Jobs) != 0 {
+		jobs = 1
+		for _, j := range fioOptions.Jobs {
+			if j > jobs {
+				jobs = j
+			}
+		}
+	}
+	size := int((avail / 10 * 9 / int64(jobs)) >> 20)
+	if fioOptions.SizeGb != 0 && size > fioOptions.SizeGb<<10 {
+		size = fioOptions.SizeGb << 10
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// prepareFilesystem formats dev with fs and mounts it, records it in
+// filesystem.json of dir and returns fioOptions with the jobs on its files
+func prepareFilesystem(run fsprep.Runner, fs *fsprep.Config, dev, dir string, fioOptions mkconfig.FioOptions) (mkconfig.FioOptions, error) {
+	if dev == "" {
+		return fioOptions, fmt.Errorf("filesystem %s needs a test device", fs.Type)
+	}
+	if strings.Contains(dev, ":") {
+		return fioOptions, fmt.Errorf("filesystem %s takes one test device, got %s", fs.Type, dev)
+	}
+	rec, err := fsprep.Prepare(run, *fs, dev, fsMountPoint)
+	if err != nil {
+		return fioOptions, fmt.Errorf("could not set up %s on %s: %w", fs.Type, dev, err)
+	}
+	log.Printf("%s: %s mounted at %s (%s)", dev, rec.Mkfs, rec.MountPoint, rec.Mounted)
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fioOptions, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "filesystem.json"), data, 0644); err != nil {
+		return fioOptions, err
+	}
+	files := mkconfig.FileJobs{}
+	if fioOptions.Files != nil {
+		files = *fioOptions.Files
+	}
+	files.Directory = fsMountPoint
+	files.JobSizeMb = fsJobSizeMb(rec.AvailBytes, fioOptions)
+	log.Printf("%s: %d Mb of files per fio job", dev, files.JobSizeMb)
+	fioOptions.Files = &files
+	return fioOptions, nil
+}
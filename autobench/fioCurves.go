@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
+)
+
+// curvePoint is one job of a FIOresult.csv on the latency-vs-throughput plane
+type curvePoint struct {
+	mbps, p99 float64
+}
+
+// readCurvePoints groups the jobs of a CSV file into curves. Rate limited
+// jobs of the same pattern and depth make a curve over their rates, the
+// other jobs of a pattern a curve over their queue depths.
+func readCurvePoints(path string) (map[string][]curvePoint, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	rows, err := csv.NewReader(fd).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	curves := map[string][]curvePoint{}
+	for i, line := range rows {
+		if i == 0 || len(line) < 14 {
+			continue
+		}
+		mbps, _ := strconv.ParseFloat(line[5], 64)
+		p99, _ := strconv.ParseFloat(line[13], 64)
+		key := fmt.Sprintf("%s-%s j=%s", line[1], line[2], line[4])
+		if len(line) > 15 && line[15] != "" {
+			key = fmt.Sprintf("%s-%s d=%s j=%s", line[1], line[2], line[3], line[4])
+		}
+		curves[key] = append(curves[key], curvePoint{mbps: mbps, p99: p99})
+	}
+	for _, pts := range curves {
+		sort.Slice(pts, func(i, j int) bool { return pts[i].mbps < pts[j].mbps })
+	}
+	return curves, nil
+}
+
+// createLatencyCurvesIn draws, for every pattern, the p99 latency over the
+// throughput of all CSV files of dirWithCSV, one line per file
+func createLatencyCurvesIn(dirWithCSV, resultsDir, description string) error {
+	files, err := readDirWithResults(dirWithCSV)
+	if err != nil {
+		return fmt.Errorf("could not read dir with CSV files: %w", err)
+	}
+	lines := map[string]string{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".csv") {
+			continue
+		}
+		lines[strings.TrimSuffix(f.Name(), ".csv")] = filepath.Join(dirWithCSV, f.Name())
+	}
+	return createLatencyCurves(lines, resultsDir, description)
+}
+
+// createLatencyCurves draws the curves of CSV files keyed by the name of
+// their line
+func createLatencyCurves(lines map[string]string, resultsDir, description string) error {
+	if err := os.Mkdir(resultsDir, 0755); err != nil {
+		return fmt.Errorf("could not create local dir for result: %w", err)
+	}
+	var names []string
+	for name := range lines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	byPattern := map[string][]interface{}{}
+	var patterns []string
+	for _, testName := range names {
+		curves, err := readCurvePoints(lines[testName])
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		for key, pts := range curves {
+			var xys plotter.XYs
+			for _, pt := range pts {
+				xys = append(xys, plotter.XY{X: pt.mbps, Y: pt.p99})
+			}
+			if _, ok := byPattern[key]; !ok {
+				patterns = append(patterns, key)
+			}
+			byPattern[key] = append(byPattern[key], testName, xys)
+		}
+	}
+	sort.Strings(patterns)
+
+	for _, key := range patterns {
+		p := plot.New()
+		p.Title.Text = key
+		p.X.Label.Text = "MB/s\n" + description
+		p.Y.Label.Text = "cLatency p99 (ms)"
+		p.Legend.Top = true
+		p.Add(plotter.NewGrid())
+		if err := plotutil.AddLinePoints(p, byPattern[key]...); err != nil {
+			return fmt.Errorf("error with get values for %s: %w", key, err)
+		}
+		name := strings.NewReplacer(" ", "_", "=", "").Replace(key)
+		if err := p.Save(10*vg.Inch, 7*vg.Inch, filepath.Join(resultsDir, name+".svg")); err != nil {
+			return fmt.Errorf("error with save charts %w", err)
+		}
+	}
+	return nil
+}
@@ -27,6 +27,7 @@ type PlotCommand struct {
 	CLogCharts		bool 	`short:"l" long:"logcharts" description:"Generate charts from log files"`
 	CDescription	string	`short:"d" long:"dsc" description:"Description for PNG image results" default:"https://zededa.com"`
 	CXcelCharts		bool	`short:"e" long:"excel" description:"Save results to a shared excel table"`
+	CCurves			bool	`short:"k" long:"curves" description:"Generate latency-vs-throughput curves from CSV files of rate or latency target runs"`
 }
 
 var plotCmd PlotCommand
@@ -212,6 +213,10 @@ func (t *AllRes) parsingCSVfile(dir, fileName string) error {
 				resultOneGroup.depth,
 				resultOneGroup.jobsCount),
 		}
+		// Rate limited jobs repeat the pattern once per rate
+		if len(line) > 15 && line[15] != "" {
+			group.pattern += " r=" + line[15]
+		}
 		groupFile = append(groupFile, &group)
 	}
 	testN := strings.Split(fileName, ".")
@@ -489,15 +494,19 @@ func (t *patternsTable) createExcelTables(table patternsTable, description, file
 }
 
 func initBarCharts(dirWithCSV, descriptionForGraphs string) error {
-	var testResults = make(AllRes, 0)
-
 	ex, err := os.Executable()
 	if err != nil {
 		return fmt.Errorf("could not get executable path: %w", err)
 	}
 
-	mainResultsAbsDir := filepath.Join(filepath.Dir(ex), "BarCharts")
-	err = os.Mkdir(mainResultsAbsDir, 0755)
+	return createBarChartsIn(dirWithCSV, filepath.Join(filepath.Dir(ex), "BarCharts"), descriptionForGraphs)
+}
+
+// createBarChartsIn - generate bar charts comparing all CSV files of dirWithCSV into resultsDir
+func createBarChartsIn(dirWithCSV, resultsDir, descriptionForGraphs string) error {
+	var testResults = make(AllRes, 0)
+
+	err := os.Mkdir(resultsDir, 0755)
 	if err != nil {
 		return fmt.Errorf("could not create local dir for result: %w", err)
 	}
@@ -521,8 +530,8 @@ func initBarCharts(dirWithCSV, descriptionForGraphs string) error {
 	for _, valRes := range []uint16{Performance, minIOPS, maxIOPS, minBW, maxBW, minLat, maxLat, stdLat, p99Lat} {
 		var pTable = make(patternsTable, 0)
 		pTable.getPatternTable(identicalPatterns, testResults, valRes)
-		pTable.createBarChart(pTable, descriptionForGraphs, mainResultsAbsDir)
-		pTable.createBarCharts(pTable, descriptionForGraphs, mainResultsAbsDir)
+		pTable.createBarChart(pTable, descriptionForGraphs, resultsDir)
+		pTable.createBarCharts(pTable, descriptionForGraphs, resultsDir)
 	}
 
 	return nil
@@ -950,6 +959,14 @@ func (x *PlotCommand) Execute(args []string) error {
 		if err := initLogCharts(plotCmd.CCatalog, plotCmd.CDescription); err != nil {
 			return fmt.Errorf("error with create log charts: %w", err)
 		}
+	} else if plotCmd.CCurves {
+		ex, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("could not get executable path: %w", err)
+		}
+		if err := createLatencyCurvesIn(plotCmd.CCatalog, filepath.Join(filepath.Dir(ex), "LatencyCurves"), plotCmd.CDescription); err != nil {
+			return fmt.Errorf("error with create latency curves: %w", err)
+		}
 	} else if plotCmd.CXcelCharts {
 		if err := initExcelCharts(plotCmd.CCatalog, plotCmd.CDescription); err != nil {
 			return fmt.Errorf("error with create excel charts: %w", err)
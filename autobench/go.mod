@@ -17,6 +17,7 @@ require (
 	github.com/spf13/viper v1.10.0
 	github.com/xuri/excelize/v2 v2.5.0
 	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	golang.org/x/sys v0.0.0-20211205182925-97ca703d548d
 	golang.org/x/term v0.0.0-20201210144234-2321bbc49cbf
 	gonum.org/v1/plot v0.10.0
 	oras.land/oras-go v0.4.0 // indirect
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/qemutmp"
+)
+
+// consoleTail is the number of console lines reported on boot failures
+const consoleTail = 30
+
+// maxSocketPath is the limit of a unix socket path, less the trailing NUL
+const maxSocketPath = 107
+
+// bootStage is a point of the guest boot recognised on the serial console
+type bootStage struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// bootStages are checked independently, the order is the usual one of a
+// cloud image boot
+var bootStages = []bootStage{
+	{"kernel", regexp.MustCompile(`Linux version \d`)},
+	{"root mounted", regexp.MustCompile(`EXT4-fs \(\w+\): mounted filesystem|VFS: Mounted root`)},
+	{"sshd listening", regexp.MustCompile(`Started (OpenBSD Secure Shell server|ssh\.service|sshd\.service)|sshd\[\d+\]: Server listening`)},
+	{"cloud-init done", regexp.MustCompile(`Cloud-init v\. \S+ finished`)},
+	{"login prompt", regexp.MustCompile(`login: *$`)},
+}
+
+// bootFailures point at the reason of a boot that went wrong
+var bootFailures = regexp.MustCompile(`Kernel panic|VFS: Unable to mount root|Failed to start|emergency mode|BUG: |Call Trace:`)
+
+// console returns the per-VM socket and log paths of the VM. Sockets whose
+// path in the result dir is too long for a unix socket go to the temp dir.
+func (vm *VirtM) console() qemutmp.Console {
+	sock := func(name string) string {
+		p := filepath.Join(vm.resultPath, name)
+		if len(p) > maxSocketPath {
+			p = filepath.Join(os.TempDir(), fmt.Sprintf("autobench-%d-%s", vm.port, name))
+			os.Remove(p)
+		}
+		return p
+	}
+	return qemutmp.Console{
+		SerialSocket:  sock("serial.sock"),
+		MonitorSocket: sock("monitor.sock"),
+		QMPSocket:     sock("qmp.sock"),
+		Log:           filepath.Join(vm.resultPath, "console.log"),
+	}
+}
+
+// readConsole returns the boot stages reached, the lines that look like
+// failures and the last lines of the console log of the VM
+func (vm *VirtM) readConsole() (reached []string, failures []string, tail []string, err error) {
+	f, err := os.Open(filepath.Join(vm.resultPath, "console.log"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer f.Close()
+
+	seen := make([]bool, len(bootStages))
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		for i, st := range bootStages {
+			if !seen[i] && st.re.MatchString(line) {
+				seen[i] = true
+			}
+		}
+		if bootFailures.MatchString(line) {
+			failures = append(failures, line)
+		}
+		tail = append(tail, line)
+		if len(tail) > consoleTail {
+			tail = tail[1:]
+		}
+	}
+	for i, st := range bootStages {
+		if seen[i] {
+			reached = append(reached, st.name)
+		}
+	}
+	return reached, failures, tail, scanner.Err()
+}
+
+// logBootStages logs the boot stages reached since the last call
+func (vm *VirtM) logBootStages() {
+	reached, _, _, err := vm.readConsole()
+	if err != nil {
+		return
+	}
+	if vm.bootStages == nil {
+		vm.bootStages = map[string]bool{}
+	}
+	for _, st := range reached {
+		if !vm.bootStages[st] {
+			log.Printf("VM localhost:%d: %s", vm.port, st)
+			vm.bootStages[st] = true
+		}
+	}
+}
+
+// bootError adds what the console shows about the boot to err
+func (vm *VirtM) bootError(err error) error {
+	reached, failures, tail, cerr := vm.readConsole()
+	if cerr != nil {
+		return fmt.Errorf("%w\n\tno console log: %v", err, cerr)
+	}
+	stages := "none"
+	if len(reached) != 0 {
+		stages = strings.Join(reached, ", ")
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n\tboot stages reached: %s", stages)
+	if n := len(failures); n > 0 {
+		if n > 5 {
+			failures = failures[n-5:]
+		}
+		fmt.Fprintf(&b, "\n\tconsole errors:\n\t\t%s", strings.Join(failures, "\n\t\t"))
+	}
+	fmt.Fprintf(&b, "\n\tlast console lines of %s:\n\t\t%s",
+		filepath.Join(vm.resultPath, "console.log"), strings.Join(tail, "\n\t\t"))
+	return fmt.Errorf("%w%s", err, b.String())
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/sshwork"
+	"github.com/zededa-yuri/nextgen-storage/autobench/qemutmp"
+	"golang.org/x/crypto/ssh"
+)
+
+// byIDLink is one entry of /dev/disk/by-id in the guest
+type byIDLink struct {
+	name   string // e.g. virtio-fiotest7890
+	device string // e.g. /dev/vdb
+}
+
+// listGuestDisks returns the whole-disk entries of /dev/disk/by-id
+func listGuestDisks(client *ssh.Client) ([]byIDLink, error) {
+	out, err := sshwork.GetCommandOutputSSH(client, "ls -l /dev/disk/by-id/")
+	if err != nil {
+		return nil, fmt.Errorf("could not list /dev/disk/by-id: %w output:[%s]", err, out)
+	}
+
+	var links []byIDLink
+	for _, line := range strings.Split(out, "\n") {
+		// lrwxrwxrwx 1 root root 9 Jan  1 00:00 virtio-fiotest7890 -> ../../vdb
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[len(fields)-2] != "->" {
+			continue
+		}
+		name := fields[len(fields)-3]
+		if strings.Contains(name, "-part") {
+			continue
+		}
+		links = append(links, byIDLink{
+			name:   name,
+			device: filepath.Join("/dev", filepath.Base(fields[len(fields)-1])),
+		})
+	}
+	return links, nil
+}
+
+// naaWWN returns the NAA 6h identifier LIO derives from the unit serial of
+// a backstore: the company id 001405 followed by the hex digits of the
+// serial, zero padded to 16 bytes
+func naaWWN(serial string) string {
+	id := "6001405"
+	for _, c := range strings.ToLower(serial) {
+		if len(id) == 32 {
+			break
+		}
+		if strings.ContainsRune("0123456789abcdef", c) {
+			id += string(c)
+		}
+	}
+	return id + strings.Repeat("0", 32-len(id))
+}
+
+// guestDiskIDs returns the /dev/disk/by-id names udev creates in the guest
+// for a disk with the given serial
+func guestDiskIDs(frontend qemutmp.Frontend, serial string) []string {
+	switch frontend {
+	case qemutmp.VhostSCSI:
+		wwn := naaWWN(serial)
+		return []string{"wwn-0x" + wwn, "scsi-3" + wwn}
+	case qemutmp.VirtioSCSI:
+		return []string{"scsi-0QEMU_QEMU_HARDDISK_" + serial}
+	case qemutmp.NVMe:
+		return []string{"nvme-QEMU_NVMe_Ctrl_" + serial}
+	default:
+		// virtio-blk serials are limited to 20 bytes
+		if len(serial) > 20 {
+			serial = serial[:20]
+		}
+		return []string{"virtio-" + serial}
+	}
+}
+
+// findGuestDevice looks for the guest block device that backs the test
+// volume: an exact by-id name is preferred, otherwise the only entry that
+// carries the serial. udev may need a moment after boot, so the lookup is
+// retried.
+func findGuestDevice(client *ssh.Client, frontend qemutmp.Frontend, serial string) (string, error) {
+	ids := guestDiskIDs(frontend, serial)
+	const tryTimes = 10
+	for i := 0; i < tryTimes; i++ {
+		links, err := listGuestDisks(client)
+		if err != nil {
+			return "", err
+		}
+		var candidates []string
+		for _, l := range links {
+			for _, id := range ids {
+				if l.name == id {
+					return l.device, nil
+				}
+			}
+			if strings.Contains(l.name, serial) && !mkconfig.Contains(candidates, l.device) {
+				candidates = append(candidates, l.device)
+			}
+		}
+		if len(candidates) == 1 {
+			return candidates[0], nil
+		}
+		if len(candidates) > 1 {
+			return "", fmt.Errorf("serial %s matches several guest devices: %v", serial, candidates)
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return "", fmt.Errorf("no device with serial %s (%v) found in guest /dev/disk/by-id", serial, ids)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/qemutmp"
+)
+
+func TestNaaWWN(t *testing.T) {
+	for _, tc := range []struct {
+		serial string
+		want   string
+	}{
+		{"5001405043a8fbf4", "60014055001405043a8fbf4000000000"},
+		{"5001405043A8FBF4", "60014055001405043a8fbf4000000000"},
+		{"c4e6d1a8-5c0e-4d3a-9b7f-0123456789ab", "6001405c4e6d1a85c0e4d3a9b7f01234"},
+		{"", "60014050000000000000000000000000"},
+	} {
+		if got := naaWWN(tc.serial); got != tc.want {
+			t.Errorf("naaWWN(%q) = %s, want %s", tc.serial, got, tc.want)
+		}
+	}
+}
+
+func TestGuestDiskIDs(t *testing.T) {
+	for _, tc := range []struct {
+		frontend qemutmp.Frontend
+		serial   string
+		want     []string
+	}{
+		{qemutmp.VhostSCSI, "5001405043a8fbf4",
+			[]string{"wwn-0x60014055001405043a8fbf4000000000", "scsi-360014055001405043a8fbf4000000000"}},
+		{qemutmp.VirtioSCSI, "fiotest7890", []string{"scsi-0QEMU_QEMU_HARDDISK_fiotest7890"}},
+		{qemutmp.NVMe, "fiotest7890", []string{"nvme-QEMU_NVMe_Ctrl_fiotest7890"}},
+		{qemutmp.VirtioBlk, "fiotest7890", []string{"virtio-fiotest7890"}},
+		{qemutmp.VirtioBlk, "fiotest7890-0123456789", []string{"virtio-fiotest7890-01234567"}},
+	} {
+		if got := guestDiskIDs(tc.frontend, tc.serial); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("guestDiskIDs(%s, %q) = %v, want %v", tc.frontend, tc.serial, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/catalog"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/sshwork"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/vmimage"
+	"github.com/zededa-yuri/nextgen-storage/autobench/qemutmp"
+)
+
+// cloudInitTimeout bounds the first boot of a guest, packages are
+// installed from the network then
+const cloudInitTimeout = 900
+
+// baseImage returns the shared base image of the guests and its format
+func baseImage() (string, string, error) {
+	if qemuCmd.CImageName != "" {
+		c, err := openCatalog(qemuCmd.CCacheDir)
+		if err != nil {
+			return "", "", err
+		}
+		e, path, err := c.Lookup(qemuCmd.CImageName)
+		if err != nil {
+			return "", "", err
+		}
+		if e.Kind != catalog.KindGuest {
+			return "", "", fmt.Errorf("image %s is an %s image", e.Name, e.Kind)
+		}
+		if e.Format != "" {
+			return path, e.Format, nil
+		}
+		info, err := vmimage.Info(path)
+		return path, info.Format, err
+	}
+
+	path := qemuCmd.CFileLocation
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(getSelfPath(), path)
+	}
+	if qemuCmd.CFormat != "" {
+		if _, err := os.Stat(path); err != nil {
+			return "", "", err
+		}
+		return path, qemuCmd.CFormat, nil
+	}
+	info, err := vmimage.Info(path)
+	if err != nil {
+		return "", "", err
+	}
+	return path, info.Format, nil
+}
+
+// imageRecord is the base image and seed settings of a run, enough to
+// boot an identical guest again
+type imageRecord struct {
+	Name     string   `json:"name,omitempty"` // catalog name
+	Path     string   `json:"path"`
+	Format   string   `json:"format"`
+	Digest   string   `json:"digest"`
+	Packages []string `json:"packages,omitempty"`
+	Seed     string   `json:"seed,omitempty"` // prebuilt seed instead of the generated one
+}
+
+// describeBaseImage verifies a catalog image, or hashes the base image
+// file, for the run manifest
+func describeBaseImage() (*imageRecord, error) {
+	path, format, err := baseImage()
+	if err != nil {
+		return nil, fmt.Errorf("base image: %w", err)
+	}
+	rec := &imageRecord{Name: qemuCmd.CImageName, Path: path, Format: format, Packages: guestPackages()}
+	if qemuCmd.CSeed != "" {
+		rec.Seed = qemuCmd.CSeed
+		rec.Packages = nil
+	}
+	if rec.Name != "" {
+		c, err := openCatalog(qemuCmd.CCacheDir)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Verify(rec.Name); err != nil {
+			return nil, err
+		}
+		e, _, _ := c.Lookup(rec.Name)
+		rec.Digest = e.Digest
+		return rec, nil
+	}
+	if rec.Digest, err = catalog.FileDigest(path); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// guestUserData returns the cloud-init settings of the VM on port
+func guestUserData(port int) (qemutmp.UserData, error) {
+	ud := qemutmp.UserData{
+		Hostname: fmt.Sprintf("%s-vm%d", namePrefix, port),
+		Password: qemuCmd.CPassword,
+		Packages: guestPackages(),
+		VsockSSH: qemuCmd.CNet == netVsock,
+	}
+	if qemuCmd.CSSHKey != "" {
+		key, err := ioutil.ReadFile(qemuCmd.CSSHKey)
+		if err != nil {
+			return ud, fmt.Errorf("could not read ssh key: %w", err)
+		}
+		ud.SSHKeys = []string{strings.TrimSpace(string(key))}
+	}
+	return ud, nil
+}
+
+// guestImages are the overlays and seeds made by this run. Files left by
+// an earlier run may come from another base image or password, they are
+// made again.
+var guestImages = map[string]bool{}
+
+// prepareGuestImages returns the qcow2 overlay and the cloud-init seed of
+// the VM on port. They are made on first use and reused by the following
+// cases, so cloud-init only installs packages once per VM and run.
+func prepareGuestImages(port int) (string, string, error) {
+	dir := qemuCmd.CImageDir
+	if dir == "" {
+		dir = getSelfPath()
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", fmt.Errorf("could not create image dir: %w", err)
+	}
+
+	overlay := filepath.Join(dir, fmt.Sprintf("%s-vm%d.qcow2", namePrefix, port))
+	if !guestImages[overlay] {
+		base, format, err := baseImage()
+		if err != nil {
+			return "", "", fmt.Errorf("base image: %w", err)
+		}
+		if err := newGuestImage(overlay); err != nil {
+			return "", "", err
+		}
+		if err := vmimage.CreateOverlay(base, format, overlay); err != nil {
+			return "", "", err
+		}
+	}
+
+	if qemuCmd.CSeed != "" {
+		return overlay, qemuCmd.CSeed, nil
+	}
+	seed := filepath.Join(dir, fmt.Sprintf("%s-vm%d-seed.img", namePrefix, port))
+	if !guestImages[seed] {
+		ud, err := guestUserData(port)
+		if err != nil {
+			return "", "", err
+		}
+		if err := newGuestImage(seed); err != nil {
+			return "", "", err
+		}
+		if err := vmimage.BuildSeed(seed, ud); err != nil {
+			return "", "", fmt.Errorf("cloud-init seed: %w", err)
+		}
+	}
+	return overlay, seed, nil
+}
+
+// newGuestImage removes what an earlier run left at path and records the
+// file for cleanup before it is made
+func newGuestImage(path string) error {
+	if err := os.Remove(path); err == nil {
+		log.Printf("Removed %s of an earlier run", path)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove %s: %w", path, err)
+	}
+	if err := res.Add(vmimage.KindImage, path); err != nil {
+		return err
+	}
+	guestImages[path] = true
+	return nil
+}
+
+// waitGuestReady waits for cloud-init to finish its first boot and checks
+// that fio is installed, a VM without it does not count as ready
+func (vm *VirtM) waitGuestReady() error {
+	output, err := sshwork.GetCommandOutputSSH(vm.sshClient, fmt.Sprintf(
+		"if command -v cloud-init >/dev/null; then timeout %d cloud-init status --wait; fi", cloudInitTimeout))
+	if err != nil {
+		log.Printf("VM localhost:%d: cloud-init did not finish cleanly: %v %s", vm.port, err, strings.TrimSpace(output))
+	}
+	output, err = sshwork.GetCommandOutputSSH(vm.sshClient, "fio --version")
+	if err != nil {
+		return fmt.Errorf("fio is not installed in the guest, add it to --packages or the image: %s", strings.TrimSpace(output))
+	}
+	log.Printf("VM localhost:%d is ready with %s", vm.port, strings.TrimSpace(output))
+	return nil
+}
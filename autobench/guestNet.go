@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/netdev"
+	"golang.org/x/crypto/ssh"
+)
+
+// Networking modes of the guests
+const (
+	netUser   = "user"   // user-mode network, SSH through a forwarded host port
+	netBridge = "bridge" // tap device on a host bridge, SSH to the guest address
+	netVsock  = "vsock"  // user-mode network for the guest only, SSH over vsock
+)
+
+var netModes = []string{netUser, netBridge, netVsock}
+
+// checkNet validates --net and what the mode needs on the host
+func checkNet() error {
+	switch qemuCmd.CNet {
+	case netUser:
+		return nil
+	case netBridge:
+		if !netdev.BridgeExists(qemuCmd.CBridge) {
+			return fmt.Errorf("bridge %s not found, create it or pass --bridge", qemuCmd.CBridge)
+		}
+		return nil
+	case netVsock:
+		if _, err := os.Stat("/dev/vhost-vsock"); err != nil {
+			return fmt.Errorf("vsock needs /dev/vhost-vsock, load the vhost_vsock module: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid network: %s\n\tUse something from this list: %v", qemuCmd.CNet, netModes)
+}
+
+// runTaps are the taps made by this run
+var runTaps = map[string]bool{}
+
+// setupNet prepares the host side of the guest network. User-mode VMs get
+// a free host port for SSH, vm.port when it is free, ports in taken
+// belong to VMs of the same case.
+func (vm *VirtM) setupNet(taken map[int]bool) error {
+	switch qemuCmd.CNet {
+	case netUser:
+		port, err := netdev.FreePort("", vm.port, taken)
+		if err != nil {
+			return err
+		}
+		if port != vm.port {
+			log.Printf("VM localhost:%d: port %d is busy, SSH is forwarded from %d", vm.port, vm.port, port)
+		}
+		vm.sshPort = port
+	case netBridge:
+		// Taps are kept for the following cases, like the guest images. A
+		// tap left by an earlier run may be on another bridge, it is made
+		// again.
+		vm.tap = fmt.Sprintf("%s%d", namePrefix, vm.port)
+		if runTaps[vm.tap] {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join("/sys/class/net", vm.tap)); err == nil {
+			log.Printf("Removing tap %s of an earlier run", vm.tap)
+			if err := netdev.DeleteTap(vm.tap); err != nil {
+				return err
+			}
+		}
+		if err := res.Add(netdev.KindTap, vm.tap); err != nil {
+			return err
+		}
+		runTaps[vm.tap] = true
+		if err := netdev.CreateTap(vm.tap, qemuCmd.CBridge); err != nil {
+			return err
+		}
+	case netVsock:
+		vm.cid = uint32(vm.port)
+	}
+	return nil
+}
+
+// netArgs returns the QEMU network options of the VM
+func (vm *VirtM) netArgs() []string {
+	switch qemuCmd.CNet {
+	case netBridge:
+		return []string{
+			"-device", "virtio-net-pci,netdev=net0,mac=" + netdev.MAC(vm.port),
+			"-netdev", fmt.Sprintf("tap,id=net0,ifname=%s,script=no,downscript=no,vhost=on", vm.tap),
+		}
+	case netVsock:
+		return []string{
+			"-device", "e1000,netdev=net0", "-netdev", "user,id=net0",
+			"-device", fmt.Sprintf("vhost-vsock-pci,guest-cid=%d", vm.cid),
+		}
+	}
+	return []string{"-device", "e1000,netdev=net0", "-netdev", fmt.Sprintf("user,id=net0,hostfwd=tcp::%d-:22", vm.sshPort)}
+}
+
+// dialSSH connects to the SSH server of the guest
+func (vm *VirtM) dialSSH(config *ssh.ClientConfig) (*ssh.Client, error) {
+	switch qemuCmd.CNet {
+	case netBridge:
+		ip, err := netdev.NeighborIP(qemuCmd.CBridge, netdev.MAC(vm.port))
+		if err != nil {
+			return nil, err
+		}
+		if ip == "" {
+			return nil, fmt.Errorf("no address of %s on %s yet", netdev.MAC(vm.port), qemuCmd.CBridge)
+		}
+		return ssh.Dial("tcp", net.JoinHostPort(ip, "22"), config)
+	case netVsock:
+		conn, err := netdev.DialVsock(vm.cid, 22, 3*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		c, chans, reqs, err := ssh.NewClientConn(conn, "vsock:"+strconv.Itoa(int(vm.cid)), config)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return ssh.NewClient(c, chans, reqs), nil
+	}
+	return ssh.Dial("tcp", fmt.Sprintf("localhost:%d", vm.sshPort), config)
+}
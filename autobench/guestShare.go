@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/sshwork"
+	"github.com/zededa-yuri/nextgen-storage/autobench/qemutmp"
+)
+
+// The result dir of every VM is shared under guestShareTag and mounted at
+// guestShareDir in the guest
+const (
+	guestShareTag = "autobench"
+	guestShareDir = "/mnt/autobench"
+)
+
+// virtiofsdPaths are the usual places of the Rust virtiofsd
+var virtiofsdPaths = []string{"virtiofsd", "/usr/libexec/virtiofsd", "/usr/lib/qemu/virtiofsd"}
+
+// checkShare validates --share and finds the tools it needs
+func checkShare() error {
+	switch qemutmp.ShareType(qemuCmd.CShare) {
+	case "", "none", qemutmp.Share9p:
+		return nil
+	case qemutmp.ShareVirtiofs:
+		_, err := findVirtiofsd()
+		return err
+	}
+	return fmt.Errorf("invalid share: %s\n\tUse something from this list: none, %v", qemuCmd.CShare, qemutmp.ShareTypes)
+}
+
+func findVirtiofsd() (string, error) {
+	for _, p := range virtiofsdPaths {
+		if path, err := exec.LookPath(p); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("virtiofsd not found in %v", virtiofsdPaths)
+}
+
+// startShare exports the result dir of the VM. virtiofs is served by a
+// virtiofsd that lives as long as the VM.
+func (vm *VirtM) startShare() ([]qemutmp.Share, error) {
+	t := qemutmp.ShareType(qemuCmd.CShare)
+	if t == "" || t == "none" {
+		return nil, nil
+	}
+	vm.share = t
+	if t == qemutmp.Share9p {
+		return []qemutmp.Share{{Type: t, Tag: guestShareTag, Path: vm.resultPath}}, nil
+	}
+
+	virtiofsd, err := findVirtiofsd()
+	if err != nil {
+		return nil, err
+	}
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("autobench-fs-%d.sock", vm.port))
+	os.Remove(socket)
+	vm.shareDaemon = exec.CommandContext(vm.ctx, virtiofsd,
+		"--socket-path", socket, "--shared-dir", vm.resultPath, "--cache", "never")
+	if err := vm.shareDaemon.Start(); err != nil {
+		vm.shareDaemon = nil
+		return nil, fmt.Errorf("start virtiofsd failed: %w", err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			return []qemutmp.Share{{Type: t, Tag: guestShareTag, Socket: socket}}, nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("virtiofsd socket %s did not appear", socket)
+}
+
+// mountShare mounts the result share in the guest
+func (vm *VirtM) mountShare() error {
+	opts := "-t virtiofs"
+	if vm.share == qemutmp.Share9p {
+		opts = "-t 9p -o trans=virtio,version=9p2000.L,msize=104857600,cache=none"
+	}
+	cmd := fmt.Sprintf("sudo mkdir -p %s && sudo mount %s %s %s", guestShareDir, opts, guestShareTag, guestShareDir)
+	if output, err := sshwork.GetCommandOutputSSH(vm.sshClient, cmd); err != nil {
+		return fmt.Errorf("could not mount the %s share: %w %s", vm.share, err, output)
+	}
+	log.Printf("VM localhost:%d: %s is shared over %s at %s", vm.port, vm.resultPath, vm.share, guestShareDir)
+	return nil
+}
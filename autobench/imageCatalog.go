@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/catalog"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/vmimage"
+)
+
+type ImageCommand struct {
+	CacheDir string `long:"cache-dir" description:"Image cache dir (default: ~/.cache/autobench)"`
+}
+
+type ImageImportCommand struct {
+	Name   string `short:"n" long:"name" description:"Name of the image in the catalog (required)" required:"true"`
+	Kind   string `short:"k" long:"kind" description:"Kind of image: guest or eve" default:"guest"`
+	OS     string `long:"os" description:"Guest OS, e.g. ubuntu-18.04"`
+	Arch   string `long:"arch" description:"Guest architecture, e.g. amd64"`
+	Kernel string `long:"kernel" description:"Guest kernel version"`
+	Fio    string `long:"fio" description:"fio version installed in the image"`
+}
+
+type ImageListCommand struct{}
+
+type ImageVerifyCommand struct{}
+
+type ImageRemoveCommand struct{}
+
+var imageCmd ImageCommand
+var imageImportCmd ImageImportCommand
+
+// openCatalog opens the catalog of the --cache-dir option
+func openCatalog(dir string) (*catalog.Catalog, error) {
+	if dir == "" {
+		dir = catalog.DefaultDir()
+	}
+	return catalog.Open(dir)
+}
+
+func (x *ImageImportCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("give one image file to import")
+	}
+	if !mkconfig.Contains(catalog.Kinds, x.Kind) {
+		return fmt.Errorf("invalid image kind: %s\n\tUse something from this list: %v", x.Kind, catalog.Kinds)
+	}
+	c, err := openCatalog(imageCmd.CacheDir)
+	if err != nil {
+		return err
+	}
+	e := catalog.Entry{Name: x.Name, Kind: x.Kind, OS: x.OS, Arch: x.Arch, Kernel: x.Kernel, Fio: x.Fio}
+	if info, err := vmimage.Info(args[0]); err == nil {
+		e.Format = info.Format
+	} else if x.Kind == catalog.KindGuest {
+		return err
+	}
+	e, err = c.Import(args[0], e)
+	if err != nil {
+		return fmt.Errorf("import %s failed: %w", args[0], err)
+	}
+	fmt.Printf("Imported %s as %s %s\n", args[0], e.Name, e.Digest)
+	return nil
+}
+
+func (x *ImageListCommand) Execute(args []string) error {
+	c, err := openCatalog(imageCmd.CacheDir)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tKIND\tFORMAT\tSIZE\tOS\tARCH\tKERNEL\tFIO\tDIGEST")
+	for _, e := range c.Entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%.19s\n", e.Name, e.Kind, e.Format,
+			humanize.IBytes(uint64(e.Size)), e.OS, e.Arch, e.Kernel, e.Fio, e.Digest)
+	}
+	return w.Flush()
+}
+
+func (x *ImageVerifyCommand) Execute(args []string) error {
+	c, err := openCatalog(imageCmd.CacheDir)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		for _, e := range c.Entries {
+			args = append(args, e.Name)
+		}
+	}
+	failed := 0
+	for _, name := range args {
+		if err := c.Verify(name); err != nil {
+			fmt.Println(err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: OK\n", name)
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d images failed verification", failed)
+	}
+	return nil
+}
+
+func (x *ImageRemoveCommand) Execute(args []string) error {
+	c, err := openCatalog(imageCmd.CacheDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range args {
+		if err := c.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	cmd, err := parser.AddCommand(
+		"image",
+		"Manage the offline image catalog",
+		"This command imports, lists, verifies and removes guest and EVE images of the local cache",
+		&imageCmd,
+	)
+	if err != nil {
+		panic(err)
+	}
+	cmd.AddCommand("import", "Import an image file", "Copy an image file into the cache and record it under a name", &imageImportCmd)
+	cmd.AddCommand("list", "List the images", "List the images of the catalog", &ImageListCommand{})
+	cmd.AddCommand("verify", "Verify image checksums", "Rehash the given images, or all of them, and compare with the catalog", &ImageVerifyCommand{})
+	cmd.AddCommand("remove", "Remove images", "Remove the given images from the catalog", &ImageRemoveCommand{})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/kernel"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/sshwork"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/vmimage"
+)
+
+// defaultCmdline boots the root fs of a cloud image on the virtio-scsi
+// boot disk, the kernel needs virtio-scsi and ext4 built in without initrd.
+// The root partition is named by PARTUUID, a SCSI test volume may come up
+// as sda before the boot disk.
+func defaultCmdline() (string, error) {
+	base, format, err := baseImage()
+	if err != nil {
+		return "", fmt.Errorf("base image: %w", err)
+	}
+	uuid, err := vmimage.PartUUID(base, format, 1)
+	if err != nil {
+		return "", fmt.Errorf("root partition of %s: %w, pass --append", base, err)
+	}
+	return fmt.Sprintf("root=PARTUUID=%s rw console=ttyS0", uuid), nil
+}
+
+// kernelCase is one value of the kernel dimension, a guest kernel that is
+// booted directly instead of the one of the boot image
+type kernelCase struct {
+	Name    string `json:"name"`
+	Path    string `json:"image"` // bzImage or a linux build tree
+	Initrd  string `json:"initrd,omitempty"`
+	Cmdline string `json:"cmdline,omitempty"`
+	info    kernel.Info
+}
+
+// kernelRecord is a booted kernel in the run manifest
+type kernelRecord struct {
+	Name    string `json:"name"`
+	Initrd  string `json:"initrd,omitempty"`
+	Cmdline string `json:"cmdline"`
+	kernel.Info
+}
+
+func (k *kernelCase) record() *kernelRecord {
+	return &kernelRecord{Name: k.Name, Initrd: k.Initrd, Cmdline: k.Cmdline, Info: k.info}
+}
+
+// planKernels are the kernels of the plan file, used without --kernel
+var planKernels []*kernelCase
+
+// parseKernels returns the --kernel list, each one is [name=]path
+func parseKernels() ([]*kernelCase, error) {
+	kernels := planKernels
+	if len(qemuCmd.CKernel) != 0 {
+		kernels = nil
+		for _, k := range qemuCmd.CKernel {
+			kc := &kernelCase{Path: k, Initrd: qemuCmd.CInitrd, Cmdline: qemuCmd.CAppend}
+			if i := strings.Index(k, "="); i > 0 {
+				kc.Name, kc.Path = k[:i], k[i+1:]
+			}
+			kernels = append(kernels, kc)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, k := range kernels {
+		info, err := kernel.Inspect(k.Path)
+		if err != nil {
+			return nil, fmt.Errorf("kernel %s: %w", k.Path, err)
+		}
+		k.info = info
+		if k.Name == "" {
+			k.Name = info.Release
+		}
+		if k.Cmdline == "" {
+			if k.Cmdline, err = defaultCmdline(); err != nil {
+				return nil, fmt.Errorf("kernel %s: %w", k.Name, err)
+			}
+		}
+		if seen[k.Name] {
+			return nil, fmt.Errorf("kernel %s is given twice, name them as name=path", k.Name)
+		}
+		seen[k.Name] = true
+	}
+	return kernels, nil
+}
+
+// withKernelBuildID adds the build ID of the kernel after its label, so
+// every row of comparison.csv names the exact build
+func (tc testCase) withKernelBuildID() testCase {
+	if tc.kernel == nil {
+		return tc
+	}
+	var labels []caseLabel
+	for _, l := range tc.labels {
+		labels = append(labels, l)
+		if l.dim == "Kernel" {
+			labels = append(labels, caseLabel{dim: "KernelBuildID", value: tc.kernel.info.BuildID})
+		}
+	}
+	tc.labels = labels
+	return tc
+}
+
+// checkGuestKernel makes sure the VM runs the kernel of the case
+func (vm *VirtM) checkGuestKernel(k *kernelCase) error {
+	output, err := sshwork.GetCommandOutputSSH(vm.sshClient, "uname -r")
+	if err != nil {
+		return err
+	}
+	if release := strings.TrimSpace(output); release != k.info.Release {
+		return fmt.Errorf("guest runs kernel %s instead of %s (%s)", release, k.Name, k.info.Release)
+	}
+	log.Printf("VM localhost:%d runs kernel %s, build %s", vm.port, k.info.Release, k.info.BuildID)
+	return nil
+}
@@ -2,13 +2,21 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/fiotests"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/fsprep"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/lio"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/tracker"
 )
 
 type LocalCommand struct {
-	User string `short:"u" long:"user" description:"A user name for save results in home directory"`
+	User      string `short:"u" long:"user" description:"A user name for save results in home directory"`
+	Lio       string `long:"lio" description:"Benchmark a LIO backstore of this type (iblock, fileio, rd_mcp) through the loopback fabric instead of --targetdev"`
+	LioDev    string `long:"lio-dev" description:"Block device or file behind the iblock or fileio backstore"`
+	LioSizeGb int    `long:"lio-size" description:"Size of fileio and rd_mcp backstores in Gb" default:"1"`
 }
 
 var localCmd LocalCommand
@@ -22,13 +30,86 @@ func init() {
 	)
 }
 
+// setupLoopback exports a backstore through the loopback fabric and
+// returns the host block device of the LUN
+func setupLoopback() (string, error) {
+	b := lio.Backstore{Plugin: lio.Plugin(localCmd.Lio), Name: namePrefix + "_local"}
+	valid := []string{string(lio.IBlock), string(lio.FileIO), string(lio.RamDisk)}
+	if !mkconfig.Contains(valid, localCmd.Lio) {
+		return "", fmt.Errorf("invalid backstore: %s\n\tUse something from this list: %v", localCmd.Lio, valid)
+	}
+	if b.Plugin != lio.RamDisk && localCmd.LioDev == "" {
+		return "", fmt.Errorf("%s backstore needs --lio-dev", b.Plugin)
+	}
+	if err := lio.CheckFabric(lio.Loopback); err != nil {
+		return "", err
+	}
+
+	if err := res.Add(lio.KindBackstore, b.String()); err != nil {
+		return "", err
+	}
+	serial, err := lio.CreateBackstore(b, lio.BackstoreConfig{
+		Dev:       localCmd.LioDev,
+		SizeBytes: int64(localCmd.LioSizeGb) << 30,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	wwn := "naa." + lio.GenerateNaaSerial()
+	if err := res.Add(lio.KindTarget, string(lio.Loopback), wwn); err != nil {
+		return "", err
+	}
+	if err := lio.CreateTPG(lio.Loopback, wwn, 1); err != nil {
+		return "", err
+	}
+	if err := lio.AddLUN(lio.Loopback, wwn, 1, 0, b); err != nil {
+		return "", err
+	}
+	return lio.HostDevice(serial)
+}
+
 func (x LocalCommand) Execute(args []string) error {
 	err := InitFioOptions()
 	if err != nil {
 		return fmt.Errorf("error get fio params: %w", err)
 	}
 
-	err = fiotests.RunFIOTestLocal(localCmd.User, opts.LocalFolderResults, opts.LocalDirResults, opts.TargetFIODevice, FioOptions, time.Duration(opts.TimeOneTest) * time.Second)
+	if localCmd.Lio != "" {
+		res, err = tracker.New(defaultStatePath())
+		if err != nil {
+			return fmt.Errorf("could not start state file: %w", err)
+		}
+		defer func() {
+			if err := res.Rollback(); err != nil {
+				fmt.Println("Attention! Cleanup failed, run `autobench cleanup`:", err)
+			}
+		}()
+		dev, err := setupLoopback()
+		if err != nil {
+			return fmt.Errorf("loopback target failed: %w", err)
+		}
+		log.Printf("%s backstore is exported as %s", localCmd.Lio, dev)
+		opts.TargetFIODevice = dev
+	}
+
+	fs, err := singleFilesystem()
+	if err != nil {
+		return err
+	}
+	fioOptions, targetDevice, resultsDir := FioOptions, opts.TargetFIODevice, opts.LocalDirResults
+	if fs != nil {
+		if resultsDir, err = fiotests.ResultsDir(opts.LocalFolderResults, resultsDir); err != nil {
+			return err
+		}
+		if fioOptions, err = prepareFilesystem(fsprep.Local, fs, targetDevice, resultsDir, fioOptions); err != nil {
+			return err
+		}
+		defer fsprep.Release(fsprep.Local, fsMountPoint)
+		targetDevice = ""
+	}
+
+	err = fiotests.RunFIOTestLocal(localCmd.User, opts.LocalFolderResults, resultsDir, targetDevice, fioOptions, time.Duration(opts.TimeOneTest) * time.Second)
 	if err != nil {
 		return fmt.Errorf("fio tests failed error: %v", err)
 	}
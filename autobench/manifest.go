@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/fsprep"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/kernel"
+)
+
+// runManifest records what a qemu target run has set up, as opposed to
+// what was asked for. It is rewritten after every case, so a failed run
+// keeps the cases that did run.
+type runManifest struct {
+	Started string          `json:"started"`
+	Args    []string        `json:"args"`
+	Image   *imageRecord    `json:"image,omitempty"`
+	Host    *kernel.Info    `json:"host_kernel,omitempty"`
+	Network string          `json:"network,omitempty"`
+	Cases   []*manifestCase `json:"cases"`
+	path    string
+}
+
+// manifestCase holds the matrix labels of a case and the effective
+// settings read back from the host
+type manifestCase struct {
+	Name       string                       `json:"name"`
+	Labels     map[string]string            `json:"labels"`
+	Backend    string                       `json:"backend,omitempty"`
+	Frontend   string                       `json:"frontend,omitempty"`
+	Backstores map[string]map[string]string `json:"backstores,omitempty"` // VM port and backstore to its attributes
+	Drives     map[string]*driveRecord      `json:"drives,omitempty"`     // VM port to its test drive, see drive.json
+	Placement  *placementRecord             `json:"placement,omitempty"`
+	Kernel     *kernelRecord                `json:"kernel,omitempty"`
+	Density    *densityRecord               `json:"density,omitempty"`
+	Discard    *discardRecord               `json:"discard,omitempty"`
+	Snapshot   *snapshotRecord              `json:"snapshot,omitempty"`
+	Filesystem *fsprep.Config               `json:"filesystem,omitempty"` // as made on every VM, see filesystem.json
+}
+
+func newRunManifest(resultsDir string) *runManifest {
+	m := &runManifest{
+		Started: time.Now().Format(time.RFC3339),
+		Args:    os.Args[1:],
+		path:    filepath.Join(resultsDir, "manifest.json"),
+	}
+	// Host kernels can only be compared across runs
+	if host, err := kernel.Host(); err == nil {
+		m.Host = &host
+	}
+	return m
+}
+
+// addCase starts the manifest entry of a test case
+func (m *runManifest) addCase(tc testCase) *manifestCase {
+	mc := &manifestCase{
+		Name:       tc.name,
+		Labels:     map[string]string{},
+		Backend:    tc.backend,
+		Frontend:   tc.frontend.name,
+		Backstores: map[string]map[string]string{},
+		Drives:     map[string]*driveRecord{},
+	}
+	for _, l := range tc.labels {
+		mc.Labels[l.dim] = l.value
+	}
+	if tc.kernel != nil {
+		mc.Kernel = tc.kernel.record()
+	}
+	mc.Filesystem = tc.filesystem
+	m.Cases = append(m.Cases, mc)
+	return mc
+}
+
+func (m *runManifest) write() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(m.path, data, 0644); err != nil {
+		return fmt.Errorf("could not write %s: %w", m.path, err)
+	}
+	return nil
+}
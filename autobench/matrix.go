@@ -0,0 +1,777 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/backend"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/fsprep"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/lio"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
+	"github.com/zededa-yuri/nextgen-storage/autobench/qemutmp"
+)
+
+// caseLabel is the value of one matrix dimension for a test case
+type caseLabel struct {
+	dim   string
+	value string
+}
+
+// dimension is one axis of the test matrix
+type dimension struct {
+	name   string
+	values []string
+}
+
+// crossProduct returns every combination of the dimension values, the
+// first dimension changes slowest
+func crossProduct(dims []dimension) [][]caseLabel {
+	combos := [][]caseLabel{nil}
+	for _, d := range dims {
+		var next [][]caseLabel
+		for _, c := range combos {
+			for _, v := range d.values {
+				labels := append(append([]caseLabel(nil), c...), caseLabel{dim: d.name, value: v})
+				next = append(next, labels)
+			}
+		}
+		combos = next
+	}
+	return combos
+}
+
+// testCase is one cell of the qemu target matrix. Every cell boots its own
+// set of VMs and runs the identical fio matrix.
+type testCase struct {
+	name       string
+	labels     []caseLabel
+	backend    string
+	topology   *backend.Topology
+	zfsProps   map[string]string
+	lioAttribs map[string]string
+	imageOpts  map[string]string // options of file and qcow2 images
+	driveOpts  map[string]string // QEMU block layer options of the test drive
+	placement  string
+	kernel     *kernelCase
+	frontend   frontendCase
+	filesystem *fsprep.Config // nil runs on the raw test volume
+}
+
+// backendKey identifies the backend setup of a case, the backend is
+// recreated whenever it changes
+func (tc testCase) backendKey() string {
+	key := tc.backend
+	if tc.topology != nil {
+		key += "," + tc.topology.String()
+	}
+	for _, l := range tc.labels {
+		if _, ok := tc.zfsProps[l.dim]; ok {
+			key += fmt.Sprintf(",%s=%s", l.dim, l.value)
+		}
+		if _, ok := tc.imageOpts[l.dim]; ok {
+			key += fmt.Sprintf(",%s=%s", l.dim, l.value)
+		}
+	}
+	return key
+}
+
+// frontendCase is one value of the frontend dimension
+type frontendCase struct {
+	name     string
+	frontend qemutmp.Frontend
+	iothread bool
+}
+
+// splitList splits a comma separated option value
+func splitList(list string) []string {
+	var res []string
+	for _, s := range strings.Split(list, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s != "" && !mkconfig.Contains(res, s) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// parseFrontends parses a comma separated list of frontends.
+// "virtio-blk-iothread" is virtio-blk running in a dedicated iothread.
+func parseFrontends(list string) ([]frontendCase, error) {
+	var res []frontendCase
+	for _, s := range splitList(list) {
+		fc := frontendCase{name: s, frontend: qemutmp.Frontend(s)}
+		if s == "virtio-blk-iothread" {
+			fc.frontend = qemutmp.VirtioBlk
+			fc.iothread = true
+		}
+		valid := false
+		for _, f := range qemutmp.Frontends {
+			if f == fc.frontend {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid frontend: %s\n\tUse something from this list: %v, virtio-blk-iothread", s, qemutmp.Frontends)
+		}
+		res = append(res, fc)
+	}
+	return res, nil
+}
+
+// parseSweeps parses repeated name=value1,value2,... options, each one is
+// a matrix dimension named after the property
+func parseSweeps(kind string, list []string) ([]dimension, error) {
+	var dims []dimension
+	for _, p := range list {
+		i := strings.Index(p, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid %s %q, use name=value1,value2", kind, p)
+		}
+		name := strings.TrimSpace(p[:i])
+		var values []string
+		for _, v := range strings.Split(p[i+1:], ",") {
+			if v = strings.TrimSpace(v); v != "" && !mkconfig.Contains(values, v) {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("%s %s has no values", kind, name)
+		}
+		for _, d := range dims {
+			if d.name == name {
+				return nil, fmt.Errorf("%s %s is given twice", kind, name)
+			}
+		}
+		dims = append(dims, dimension{name: name, values: values})
+	}
+	return dims, nil
+}
+
+// parseZfsProps parses the --zfs-prop sweeps
+func parseZfsProps(list []string) ([]dimension, error) {
+	dims, err := parseSweeps("zfs property", list)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dims {
+		switch backend.ZfsPropScope(d.name) {
+		case backend.ScopePool, backend.ScopeVdev:
+			if qemuCmd.CTargetDisk == "" && qemuCmd.CTopology == "" {
+				return nil, fmt.Errorf("zfs property %s needs --disktarget or --topology, the pool is recreated for it", d.name)
+			}
+		}
+		if backend.ZfsPropScope(d.name) == backend.ScopeVdev {
+			for _, v := range d.values {
+				if _, err := os.Stat(v); v != "none" && err != nil {
+					return nil, fmt.Errorf("%s device %s: %w", d.name, v, err)
+				}
+			}
+		}
+	}
+	return dims, nil
+}
+
+// parseLioAttribs parses the --lio-attrib sweeps of vhost-scsi backstores
+func parseLioAttribs(list []string) ([]dimension, error) {
+	dims, err := parseSweeps("backstore attribute", list)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dims {
+		if strings.ContainsAny(d.name, "/.") {
+			return nil, fmt.Errorf("invalid backstore attribute %q, use one of %v", d.name, lio.TunedAttribs)
+		}
+	}
+	return dims, nil
+}
+
+// parseImageOpts parses the --image-opt sweeps of file and qcow2 images
+func parseImageOpts(list []string) ([]dimension, error) {
+	dims, err := parseSweeps("image option", list)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dims {
+		if strings.ContainsAny(d.name, "/.") {
+			return nil, fmt.Errorf("invalid image option %q", d.name)
+		}
+		if d.name != "compression" {
+			continue
+		}
+		for _, v := range d.values {
+			if !mkconfig.Contains(backend.ImageCompressions, v) {
+				return nil, fmt.Errorf("invalid compression %s, use one of %v", v, backend.ImageCompressions)
+			}
+		}
+	}
+	return dims, nil
+}
+
+// parseTopologies parses the ";" separated --topology list
+func parseTopologies(list string) (map[string]*backend.Topology, []string, error) {
+	byName := map[string]*backend.Topology{}
+	var names []string
+	for _, spec := range strings.Split(list, ";") {
+		if spec = strings.TrimSpace(spec); spec == "" || byName[spec] != nil {
+			continue
+		}
+		t, err := backend.ParseTopology(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		byName[spec] = t
+		names = append(names, spec)
+	}
+	return byName, names, nil
+}
+
+// parseBackends returns the --backend list, --zfs and --lvm add zvol and lvm
+func parseBackends() ([]string, error) {
+	backends := splitList(qemuCmd.CBackend)
+	if qemuCmd.CZfs && !mkconfig.Contains(backends, "zvol") {
+		backends = append(backends, "zvol")
+	}
+	if qemuCmd.CLvm && !mkconfig.Contains(backends, "lvm") {
+		backends = append(backends, "lvm")
+	}
+	if len(qemuCmd.CZfsProp) != 0 && !mkconfig.Contains(backends, "zvol") {
+		backends = append(backends, "zvol")
+	}
+	if len(qemuCmd.CImageOpt) != 0 && !mkconfig.Contains(backends, "file") && !mkconfig.Contains(backends, "qcow2") {
+		backends = append(backends, "qcow2")
+	}
+	for _, b := range backends {
+		if !mkconfig.Contains(backend.Names, b) {
+			return nil, fmt.Errorf("invalid backend: %s\n\tUse something from this list: %v", b, backend.Names)
+		}
+	}
+	return backends, nil
+}
+
+// isBlockBackend reports whether the volumes of a backend are block devices
+func isBlockBackend(name string) bool {
+	b, err := backend.New(name, backend.Config{}, nil)
+	return err == nil && b.BlockDevice()
+}
+
+// caseNameReplacer keeps label values usable as directory names
+var caseNameReplacer = strings.NewReplacer("/", "", ":", "-", ",", "-", "+", "-")
+
+// buildTestCases returns the cross product of all matrix dimensions
+func buildTestCases() ([]testCase, error) {
+	frontends, err := parseFrontends(qemuCmd.CFrontend)
+	if err != nil {
+		return nil, err
+	}
+	backends, err := parseBackends()
+	if err != nil {
+		return nil, err
+	}
+
+	if qemuCmd.CLuns < 1 {
+		return nil, fmt.Errorf("--luns must be at least 1")
+	}
+
+	// Placement and kernel only change the VMs
+	var vmDims []dimension
+	placements, err := parsePlacements()
+	if err != nil {
+		return nil, err
+	}
+	if len(placements) != 0 {
+		vmDims = append(vmDims, dimension{name: "Placement", values: placements})
+	}
+	kernels, err := parseKernels()
+	if err != nil {
+		return nil, err
+	}
+	kernelByName := map[string]*kernelCase{}
+	if len(kernels) != 0 {
+		d := dimension{name: "Kernel"}
+		for _, k := range kernels {
+			kernelByName[k.Name] = k
+			d.values = append(d.values, k.Name)
+		}
+		vmDims = append(vmDims, d)
+	}
+	// Filesystems only change what the guest does with the test volume
+	filesystems, fsByName, err := parseFilesystems()
+	if err != nil {
+		return nil, err
+	}
+	if len(filesystems) != 0 {
+		if qemuCmd.CLuns > 1 && len(fsByName) != 0 {
+			return nil, fmt.Errorf("a filesystem takes one test volume per VM, drop --luns")
+		}
+		vmDims = append(vmDims, dimension{name: "Filesystem", values: filesystems})
+	}
+
+	// Without a test volume fio runs on the boot disk
+	if len(frontends) == 0 && len(backends) == 0 && len(qemuCmd.CLioAttrib) == 0 && len(qemuCmd.CImageOpt) == 0 &&
+		len(qemuCmd.CDriveOpt) == 0 {
+		if len(vmDims) == 0 {
+			return []testCase{{name: "default"}}, nil
+		}
+		var cases []testCase
+		for _, labels := range crossProduct(vmDims) {
+			tc := testCase{labels: labels}
+			var names []string
+			for _, l := range labels {
+				switch l.dim {
+				case "Placement":
+					tc.placement = l.value
+				case "Kernel":
+					tc.kernel = kernelByName[l.value]
+				case "Filesystem":
+					tc.filesystem = fsByName[l.value]
+				}
+				names = append(names, caseNameReplacer.Replace(l.value))
+			}
+			tc.name = strings.Join(names, "_")
+			cases = append(cases, tc.withKernelBuildID())
+		}
+		return cases, nil
+	}
+
+	var dims []dimension
+	if len(backends) != 0 {
+		dims = append(dims, dimension{name: "Backend", values: backends})
+	}
+	byName := map[string]frontendCase{}
+	topologies, topologyNames, err := parseTopologies(qemuCmd.CTopology)
+	if err != nil {
+		return nil, err
+	}
+	if len(topologyNames) != 0 {
+		dims = append(dims, dimension{name: "Topology", values: topologyNames})
+	}
+	zfsDims, err := parseZfsProps(qemuCmd.CZfsProp)
+	if err != nil {
+		return nil, err
+	}
+	dims = append(dims, zfsDims...)
+	zfsDim := map[string]bool{}
+	for _, d := range zfsDims {
+		zfsDim[d.name] = true
+	}
+	lioDims, err := parseLioAttribs(qemuCmd.CLioAttrib)
+	if err != nil {
+		return nil, err
+	}
+	lioDim := map[string]bool{}
+	for _, d := range lioDims {
+		if zfsDim[d.name] {
+			return nil, fmt.Errorf("%s is given as zfs property and backstore attribute", d.name)
+		}
+		lioDim[d.name] = true
+	}
+	dims = append(dims, lioDims...)
+	imageDims, err := parseImageOpts(qemuCmd.CImageOpt)
+	if err != nil {
+		return nil, err
+	}
+	imageDim := map[string]bool{}
+	for _, d := range imageDims {
+		if zfsDim[d.name] || lioDim[d.name] {
+			return nil, fmt.Errorf("%s is given as image option and as zfs property or backstore attribute", d.name)
+		}
+		imageDim[d.name] = true
+	}
+	dims = append(dims, imageDims...)
+	driveDims, err := parseDriveOpts(qemuCmd.CDriveOpt)
+	if err != nil {
+		return nil, err
+	}
+	driveDim := map[string]bool{}
+	for _, d := range driveDims {
+		if zfsDim[d.name] || lioDim[d.name] || imageDim[d.name] {
+			return nil, fmt.Errorf("%s is given as drive option and as zfs property, backstore attribute or image option", d.name)
+		}
+		driveDim[d.name] = true
+	}
+	dims = append(dims, driveDims...)
+	dims = append(dims, vmDims...)
+	if len(frontends) != 0 {
+		d := dimension{name: "Frontend"}
+		for _, fc := range frontends {
+			byName[fc.name] = fc
+			d.values = append(d.values, fc.name)
+		}
+		dims = append(dims, d)
+	}
+
+	var cases []testCase
+	seen := map[string]bool{}
+	usedTopology := map[string]bool{}
+	usedLio := false
+	usedImage := false
+	usedDrive := false
+	for _, labels := range crossProduct(dims) {
+		tc := testCase{labels: labels, backend: "file", zfsProps: map[string]string{}, lioAttribs: map[string]string{},
+			imageOpts: map[string]string{}, driveOpts: map[string]string{}}
+		for _, l := range labels {
+			switch l.dim {
+			case "Backend":
+				tc.backend = l.value
+			case "Frontend":
+				tc.frontend = byName[l.value]
+			case "Placement":
+				tc.placement = l.value
+			case "Kernel":
+				tc.kernel = kernelByName[l.value]
+			case "Filesystem":
+				tc.filesystem = fsByName[l.value]
+			}
+		}
+		// Block volumes keep the historical vhost-scsi attachment
+		if tc.frontend.frontend == "" {
+			tc.frontend = frontendCase{name: string(qemutmp.VirtioBlk), frontend: qemutmp.VirtioBlk}
+			if isBlockBackend(tc.backend) {
+				tc.frontend = frontendCase{name: string(qemutmp.VhostSCSI), frontend: qemutmp.VhostSCSI}
+			}
+		}
+		var names []string
+		for i, l := range labels {
+			switch {
+			case l.dim == "Topology" && !mkconfig.Contains([]string{"zvol", "lvm", "lvm-thin"}, tc.backend):
+				// file, loop and dm-linear use --disktarget only
+				tc.labels[i].value = "-"
+				continue
+			case l.dim == "Topology":
+				tc.topology = topologies[l.value]
+			case zfsDim[l.dim] && tc.backend != "zvol":
+				// zfs sweeps do not apply to other backends
+				tc.labels[i].value = "-"
+				continue
+			case zfsDim[l.dim]:
+				tc.zfsProps[l.dim] = l.value
+				l.value = fmt.Sprintf("%s=%s", l.dim, l.value)
+			case lioDim[l.dim] && tc.frontend.frontend != qemutmp.VhostSCSI:
+				// only vhost-scsi goes through a LIO backstore
+				tc.labels[i].value = "-"
+				continue
+			case lioDim[l.dim]:
+				tc.lioAttribs[l.dim] = l.value
+				l.value = fmt.Sprintf("%s=%s", l.dim, l.value)
+			case imageDim[l.dim] && !backend.ImageOptFits(l.dim, tc.backend):
+				// raw images only take preallocation, block backends none
+				tc.labels[i].value = "-"
+				continue
+			case imageDim[l.dim]:
+				tc.imageOpts[l.dim] = l.value
+				l.value = fmt.Sprintf("%s=%s", l.dim, l.value)
+			case driveDim[l.dim] && !driveFrontend(tc.frontend.frontend):
+				// vhost-scsi and vhost-kernel-nvme bypass the QEMU block layer
+				tc.labels[i].value = "-"
+				continue
+			case driveDim[l.dim]:
+				tc.driveOpts[l.dim] = l.value
+				l.value = fmt.Sprintf("%s=%s", l.dim, l.value)
+			}
+			names = append(names, caseNameReplacer.Replace(l.value))
+		}
+		tc.name = strings.Join(names, "_")
+		if seen[tc.name] {
+			continue
+		}
+		if why := driveConflict(tc); why != "" {
+			seen[tc.name] = true
+			log.Printf("Skipping case %s: %s", tc.name, why)
+			continue
+		}
+		// A plan may list zfs and lvm layouts side by side, each one only
+		// goes with the backends it fits
+		if tc.topology != nil && !tc.topology.Fits(tc.backend) {
+			continue
+		}
+		if tc.topology != nil {
+			if err := tc.topology.Validate(tc.backend); err != nil {
+				return nil, err
+			}
+			usedTopology[tc.topology.String()] = true
+		}
+		seen[tc.name] = true
+		usedLio = usedLio || len(tc.lioAttribs) != 0
+		usedImage = usedImage || len(tc.imageOpts) != 0
+		usedDrive = usedDrive || len(tc.driveOpts) != 0
+
+		if qemuCmd.CLuns > 1 && (tc.frontend.frontend == qemutmp.VhostUserBlk || tc.frontend.frontend == qemutmp.VhostKernelNVMe) {
+			return nil, fmt.Errorf("frontend %s takes one test volume per VM, drop --luns", tc.frontend.name)
+		}
+		if tc.frontend.frontend == qemutmp.VhostSCSI && !isBlockBackend(tc.backend) {
+			return nil, fmt.Errorf("frontend %s needs a block volume, the %s backend provides files", tc.frontend.name, tc.backend)
+		}
+		if tc.frontend.frontend == qemutmp.VhostKernelNVMe && tc.backend == "qcow2" {
+			return nil, fmt.Errorf("frontend %s exports the image file as it is, it does not go with the qcow2 backend", tc.frontend.name)
+		}
+		cases = append(cases, tc.withKernelBuildID())
+	}
+	for _, name := range topologyNames {
+		if !usedTopology[name] {
+			return nil, fmt.Errorf("topology %s does not fit any of the backends %v", name, backends)
+		}
+	}
+	if len(lioDims) != 0 && !usedLio {
+		return nil, fmt.Errorf("backstore attributes need the vhost-scsi frontend")
+	}
+	if len(imageDims) != 0 && !usedImage {
+		return nil, fmt.Errorf("image options need the file or qcow2 backend")
+	}
+	if len(driveDims) != 0 && !usedDrive {
+		return nil, fmt.Errorf("drive options need the virtio-blk, virtio-scsi, nvme or vhost-user-blk frontend")
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("no test case is left, QEMU takes none of the drive option combinations")
+	}
+	return cases, nil
+}
+
+// writeComparisonReport gathers FIOresult.csv of every VM of every case into
+// one comparison.csv, prefixed by the matrix labels. A copy of each table goes
+// to the comparison dir, so `autobench plot -b` can chart the cases side by side.
+func writeComparisonReport(resultsDir string, cases []testCase) error {
+	if curveRun() {
+		for _, tc := range cases {
+			if err := writeCaseCurves(resultsDir, tc); err != nil {
+				return fmt.Errorf("could not create curves of %s: %w", tc.name, err)
+			}
+		}
+	}
+	if len(cases) < 2 {
+		return nil
+	}
+	if len(FioOptions.Profiles) != 0 {
+		return writeProfileComparison(resultsDir, cases)
+	}
+	if FioOptions.Replay != nil {
+		return writeReplayComparison(resultsDir, cases)
+	}
+
+	cmpDir := filepath.Join(resultsDir, "comparison")
+	if err := os.Mkdir(cmpDir, 0755); err != nil {
+		return fmt.Errorf("could not create dir for comparison: %w", err)
+	}
+
+	fd, err := os.Create(filepath.Join(resultsDir, "comparison.csv"))
+	if err != nil {
+		return fmt.Errorf("could not create comparison.csv: %w", err)
+	}
+	defer fd.Close()
+	w := csv.NewWriter(fd)
+
+	headerDone := false
+	for _, tc := range cases {
+		vmDirs, err := filepath.Glob(filepath.Join(resultsDir, tc.name, "vm-port-*"))
+		if err != nil {
+			return err
+		}
+		for _, vmDir := range vmDirs {
+			csvPath := filepath.Join(vmDir, "FIOresult.csv")
+			data, err := ioutil.ReadFile(csvPath)
+			if err != nil {
+				log.Printf("comparison: skip %s: %v", csvPath, err)
+				continue
+			}
+			rows, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+			if err != nil || len(rows) == 0 {
+				log.Printf("comparison: skip %s: %v", csvPath, err)
+				continue
+			}
+
+			copyName := tc.name + ".csv"
+			if len(vmDirs) > 1 {
+				copyName = fmt.Sprintf("%s-%s.csv", tc.name, filepath.Base(vmDir))
+			}
+			if err := ioutil.WriteFile(filepath.Join(cmpDir, copyName), data, 0644); err != nil {
+				return fmt.Errorf("could not copy %s: %w", csvPath, err)
+			}
+
+			if !headerDone {
+				var header []string
+				for _, l := range tc.labels {
+					header = append(header, l.dim)
+				}
+				header = append(header, "VM")
+				if err := w.Write(append(header, rows[0]...)); err != nil {
+					return err
+				}
+				headerDone = true
+			}
+			for _, row := range rows[1:] {
+				var prefix []string
+				for _, l := range tc.labels {
+					prefix = append(prefix, l.value)
+				}
+				prefix = append(prefix, filepath.Base(vmDir))
+				if err := w.Write(append(prefix, row...)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	// Rate and latency target runs are curves, a bar per point says little
+	if curveRun() {
+		if err := createLatencyCurvesIn(cmpDir, filepath.Join(resultsDir, "LatencyCurves"),
+			fmt.Sprintf("Comparison of %d test cases", len(cases))); err != nil {
+			return fmt.Errorf("could not create comparison charts: %w", err)
+		}
+		return nil
+	}
+	if err := createBarChartsIn(cmpDir, filepath.Join(resultsDir, "BarCharts"),
+		fmt.Sprintf("Comparison of %d test cases", len(cases))); err != nil {
+		return fmt.Errorf("could not create comparison charts: %w", err)
+	}
+	return nil
+}
+
+// curveRun reports whether the jobs run at fixed rates or search a latency
+// target, their results are latency curves
+func curveRun() bool {
+	return FioOptions.Rates != nil || FioOptions.RatesIOPS != nil || FioOptions.Latency != nil
+}
+
+// writeCaseCurves draws the latency curves of a case into its own
+// LatencyCurves folder, a line per VM
+func writeCaseCurves(resultsDir string, tc testCase) error {
+	caseDir := filepath.Join(resultsDir, tc.name)
+	vmDirs, err := filepath.Glob(filepath.Join(caseDir, "vm-port-*"))
+	if err != nil {
+		return err
+	}
+	lines := map[string]string{}
+	for _, vmDir := range vmDirs {
+		csvPath := filepath.Join(vmDir, "FIOresult.csv")
+		if _, err := os.Stat(csvPath); err != nil {
+			log.Printf("curves: skip %s: %v", csvPath, err)
+			continue
+		}
+		lines[filepath.Base(vmDir)] = csvPath
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return createLatencyCurves(lines, filepath.Join(caseDir, "LatencyCurves"), "Test case "+tc.name)
+}
+
+// writeProfileComparison collects FIOprofiles.csv of every VM of every case
+// into comparison-profiles.csv, ordered by profile so the cases of a
+// profile are next to each other
+func writeProfileComparison(resultsDir string, cases []testCase) error {
+	var header []string
+	byProfile := map[string][][]string{}
+	for _, tc := range cases {
+		vmDirs, err := filepath.Glob(filepath.Join(resultsDir, tc.name, "vm-port-*"))
+		if err != nil {
+			return err
+		}
+		for _, vmDir := range vmDirs {
+			csvPath := filepath.Join(vmDir, "FIOprofiles.csv")
+			data, err := ioutil.ReadFile(csvPath)
+			if err != nil {
+				log.Printf("comparison: skip %s: %v", csvPath, err)
+				continue
+			}
+			rows, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+			if err != nil || len(rows) == 0 {
+				log.Printf("comparison: skip %s: %v", csvPath, err)
+				continue
+			}
+			if header == nil {
+				header = []string{rows[0][0]}
+				for _, l := range tc.labels {
+					header = append(header, l.dim)
+				}
+				header = append(header, "VM")
+				header = append(header, rows[0][1:]...)
+			}
+			for _, row := range rows[1:] {
+				out := []string{row[0]}
+				for _, l := range tc.labels {
+					out = append(out, l.value)
+				}
+				out = append(out, filepath.Base(vmDir))
+				byProfile[row[0]] = append(byProfile[row[0]], append(out, row[1:]...))
+			}
+		}
+	}
+	if header == nil {
+		return fmt.Errorf("no profile results found")
+	}
+
+	fd, err := os.Create(filepath.Join(resultsDir, "comparison-profiles.csv"))
+	if err != nil {
+		return fmt.Errorf("could not create comparison-profiles.csv: %w", err)
+	}
+	defer fd.Close()
+	w := csv.NewWriter(fd)
+	w.Write(header)
+	for _, p := range FioOptions.Profiles {
+		w.WriteAll(byProfile[p.Name])
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// writeReplayComparison collects FIOreplay.csv of every VM of every case
+// into comparison-replay.csv, prefixed by the matrix labels
+func writeReplayComparison(resultsDir string, cases []testCase) error {
+	var header []string
+	var out [][]string
+	for _, tc := range cases {
+		vmDirs, err := filepath.Glob(filepath.Join(resultsDir, tc.name, "vm-port-*"))
+		if err != nil {
+			return err
+		}
+		for _, vmDir := range vmDirs {
+			csvPath := filepath.Join(vmDir, "FIOreplay.csv")
+			data, err := ioutil.ReadFile(csvPath)
+			if err != nil {
+				log.Printf("comparison: skip %s: %v", csvPath, err)
+				continue
+			}
+			rows, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+			if err != nil || len(rows) == 0 {
+				log.Printf("comparison: skip %s: %v", csvPath, err)
+				continue
+			}
+			if header == nil {
+				for _, l := range tc.labels {
+					header = append(header, l.dim)
+				}
+				header = append(header, "VM")
+				header = append(header, rows[0]...)
+			}
+			for _, row := range rows[1:] {
+				var labels []string
+				for _, l := range tc.labels {
+					labels = append(labels, l.value)
+				}
+				labels = append(labels, filepath.Base(vmDir))
+				out = append(out, append(labels, row...))
+			}
+		}
+	}
+	if header == nil {
+		return fmt.Errorf("no replay results found")
+	}
+
+	fd, err := os.Create(filepath.Join(resultsDir, "comparison-replay.csv"))
+	if err != nil {
+		return fmt.Errorf("could not create comparison-replay.csv: %w", err)
+	}
+	defer fd.Close()
+	w := csv.NewWriter(fd)
+	w.Write(header)
+	w.WriteAll(out)
+	return w.Error()
+}
@@ -0,0 +1,202 @@
+package backend
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/tracker"
+)
+
+// Recorder keeps track of created host objects, see tracker.Tracker
+type Recorder interface {
+	Add(kind string, args ...string) error
+	Undo(kind string, args ...string) error
+}
+
+// Config is shared by all backends
+type Config struct {
+	Pool  string            // zpool, volume group or directory name, default "fiotest"
+	Disk  string            // disk the pool is provisioned on
+	Dir   string            // where file based volumes live when Disk is empty
+	Props map[string]string // backend specific volume and pool properties
+
+	// Topology is a multi-disk layout used instead of Disk
+	Topology *Topology
+
+	// SnapshotGb is the COW space of thick lvm snapshots, 0 gives them
+	// the size of the origin
+	SnapshotGb int
+}
+
+// disks returns the disks the pool is provisioned on
+func (c Config) disks() []string {
+	if c.Topology != nil {
+		return c.Topology.Disks()
+	}
+	if c.Disk != "" {
+		return []string{c.Disk}
+	}
+	return nil
+}
+
+// Backend provides the host volumes that are attached to the VMs
+type Backend interface {
+	// Name returns the backend name as used on the command line
+	Name() string
+	// Check verifies that the tools of the backend are present
+	Check() error
+	// Provision creates the pool, volume group or filesystem on the disk
+	Provision() error
+	// Destroy removes everything Provision created
+	Destroy() error
+	// CreateVolume creates a volume of sizeGb gigabytes
+	CreateVolume(name string, sizeGb int) error
+	// DestroyVolume removes a volume
+	DestroyVolume(name string) error
+	// DevicePath returns the host path of a volume
+	DevicePath(name string) string
+	// BlockDevice reports whether volumes are block devices
+	BlockDevice() bool
+	// Describe returns the effective properties of a volume
+	Describe(name string) (map[string]string, error)
+}
+
+// StatsCollector is implemented by backends that can snapshot their
+// statistics next to the fio results
+type StatsCollector interface {
+	CollectStats(dir, suffix string) error
+}
+
+// SpaceReporter is implemented by backends that can tell how much host
+// space a volume takes, thin volumes give it back on discard
+type SpaceReporter interface {
+	// Allocated returns the bytes the volume takes on the host and the
+	// raw figures they are computed from
+	Allocated(name string) (int64, map[string]string, error)
+}
+
+// Snapshotter is implemented by backends that can snapshot a volume while
+// a VM uses it
+type Snapshotter interface {
+	// Snapshot takes the snapshot snap of the volume
+	Snapshot(name, snap string) error
+	// DestroySnapshot removes a snapshot
+	DestroySnapshot(name, snap string) error
+	// SnapshotSpace returns the bytes the volume and its snapshots take
+	// on the host and the raw figures they are computed from
+	SnapshotSpace(name string) (int64, map[string]string, error)
+}
+
+// ImageVolumes is implemented by backends whose volumes are images that
+// QEMU opens with a format driver other than raw
+type ImageVolumes interface {
+	// Format returns the image format of the volumes, e.g. qcow2
+	Format() string
+	// DriveOptions returns the runtime options of the format driver and
+	// whether writes go through the compress filter
+	DriveOptions() (map[string]string, bool)
+}
+
+// Names lists all backends
+var Names = []string{"zvol", "lvm", "lvm-thin", "file", "qcow2", "loop", "dm-linear"}
+
+// New returns the backend called name
+func New(name string, cfg Config, rec Recorder) (Backend, error) {
+	if cfg.Pool == "" {
+		cfg.Pool = "fiotest"
+	}
+	switch name {
+	case "zvol":
+		return &zvolBackend{cfg: cfg, rec: rec}, nil
+	case "lvm":
+		return &lvmBackend{cfg: cfg, rec: rec}, nil
+	case "lvm-thin":
+		return &lvmBackend{cfg: cfg, rec: rec, thin: true}, nil
+	case "file":
+		return &fileBackend{cfg: cfg, rec: rec}, nil
+	case "qcow2":
+		return &qcow2Backend{fileBackend: fileBackend{cfg: cfg, rec: rec, format: "qcow2"}}, nil
+	case "loop":
+		return &loopBackend{fileBackend: fileBackend{cfg: cfg, rec: rec}, devices: map[string]string{}}, nil
+	case "dm-linear":
+		return &dmLinearBackend{cfg: cfg, rec: rec}, nil
+	}
+	return nil, fmt.Errorf("unknown backend: %s\n\tUse something from this list: %v", name, Names)
+}
+
+// Scan finds pools, volume groups, mounts, loop and dm devices whose name
+// starts with prefix. The resources are returned in creation order.
+func Scan(prefix string) []tracker.Resource {
+	var found []tracker.Resource
+	found = append(found, scanZfs(prefix)...)
+	found = append(found, scanLvm(prefix)...)
+	found = append(found, scanDm(prefix)...)
+	found = append(found, scanFile(prefix)...)
+	return found
+}
+
+// isBlockDevice reports whether path is a block device
+func isBlockDevice(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode()&os.ModeDevice != 0
+}
+
+// wipeDisk removes the pool labels left on a disk, so the next backend
+// can take it. Nothing is done for backends without a disk.
+func wipeDisk(disk string) error {
+	if disk == "" {
+		return nil
+	}
+	output, err := exec.Command("wipefs", "--all", disk).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to wipefs: err:[%w] output:[%s]", err, output)
+	}
+	return nil
+}
+
+// sortedProps returns props as sorted key=value pairs
+func sortedProps(props map[string]string) []string {
+	var keys []string
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var res []string
+	for _, k := range keys {
+		res = append(res, fmt.Sprintf("%s=%s", k, props[k]))
+	}
+	return res
+}
+
+// splitProp splits key=value
+func splitProp(kv string) (string, string) {
+	i := strings.Index(kv, "=")
+	if i < 0 {
+		return kv, ""
+	}
+	return kv[:i], kv[i+1:]
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseColumns turns `key value` lines into a map
+func parseColumns(output string) map[string]string {
+	res := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			res[fields[0]] = strings.Join(fields[1:], " ")
+		}
+	}
+	return res
+}
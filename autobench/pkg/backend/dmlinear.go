@@ -0,0 +1,149 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/tracker"
+)
+
+// KindDm is a device-mapper device: dm name
+const KindDm = "dm"
+
+func init() {
+	tracker.Register(KindDm, func(a []string) error { return DmRemove(a[0]) })
+}
+
+// DmCreateLinear - map sectors of disk starting at offset to /dev/mapper/name
+func DmCreateLinear(name, disk string, offset, sectors int64) error {
+	table := fmt.Sprintf("0 %d linear %s %d", sectors, disk, offset)
+	output, err := exec.Command("dmsetup", "create", name, "--table", table).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to dmsetup create: err:[%w] output:[%s]", err, output)
+	}
+	return nil
+}
+
+// DmRemove - remove a device-mapper device
+func DmRemove(name string) error {
+	output, err := exec.Command("dmsetup", "remove", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to dmsetup remove: err:[%w] output:[%s]", err, output)
+	}
+	return nil
+}
+
+// diskSectors returns the size of a block device in 512 byte sectors
+func diskSectors(disk string) (int64, error) {
+	output, err := exec.Command("blockdev", "--getsz", disk).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("failed to blockdev: err:[%w] output:[%s]", err, output)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+}
+
+// dmLinearBackend carves consecutive linear segments of the raw disk, the
+// closest thing to a partition without a partition table
+type dmLinearBackend struct {
+	cfg     Config
+	rec     Recorder
+	size    int64            // disk size in sectors
+	next    int64            // first free sector
+	offsets map[string]int64 // volume name -> first sector
+}
+
+func (b *dmLinearBackend) Name() string      { return "dm-linear" }
+func (b *dmLinearBackend) BlockDevice() bool { return true }
+
+func (b *dmLinearBackend) Check() error {
+	if _, err := exec.LookPath("dmsetup"); err != nil {
+		return fmt.Errorf("dmsetup not found: %w", err)
+	}
+	if b.cfg.Disk == "" || !isBlockDevice(b.cfg.Disk) {
+		return fmt.Errorf("dm-linear needs a block device as disk target")
+	}
+	return nil
+}
+
+func (b *dmLinearBackend) Provision() error {
+	size, err := diskSectors(b.cfg.Disk)
+	if err != nil {
+		return err
+	}
+	b.size = size
+	b.next = 0
+	b.offsets = map[string]int64{}
+	return nil
+}
+
+func (b *dmLinearBackend) Destroy() error {
+	return nil
+}
+
+func (b *dmLinearBackend) dmName(name string) string {
+	return fmt.Sprintf("%s-%s", b.cfg.Pool, name)
+}
+
+func (b *dmLinearBackend) CreateVolume(name string, sizeGb int) error {
+	sectors := int64(sizeGb) << 21
+	if b.next+sectors > b.size {
+		return fmt.Errorf("disk %s has no room for %dG at sector %d", b.cfg.Disk, sizeGb, b.next)
+	}
+	if err := DmCreateLinear(b.dmName(name), b.cfg.Disk, b.next, sectors); err != nil {
+		return err
+	}
+	b.offsets[name] = b.next
+	b.next += sectors
+	return b.rec.Add(KindDm, b.dmName(name))
+}
+
+func (b *dmLinearBackend) DestroyVolume(name string) error {
+	if err := b.rec.Undo(KindDm, b.dmName(name)); err != nil {
+		return err
+	}
+	delete(b.offsets, name)
+	// Segments are handed out in order, the disk is reused once all are gone
+	if len(b.offsets) == 0 {
+		b.next = 0
+	}
+	return nil
+}
+
+func (b *dmLinearBackend) DevicePath(name string) string {
+	return filepath.Join("/dev/mapper", b.dmName(name))
+}
+
+func (b *dmLinearBackend) Describe(name string) (map[string]string, error) {
+	res := map[string]string{
+		"disk":         b.cfg.Disk,
+		"start_sector": fmt.Sprintf("%d", b.offsets[name]),
+	}
+	dev, err := filepath.EvalSymlinks(b.DevicePath(name))
+	if err != nil {
+		return nil, err
+	}
+	if size, err := ioutil.ReadFile(filepath.Join("/sys/block", filepath.Base(dev), "size")); err == nil {
+		res["sectors"] = strings.TrimSpace(string(size))
+	}
+	return res, nil
+}
+
+func scanDm(prefix string) []tracker.Resource {
+	var found []tracker.Resource
+	// fiotest-vm7890	(253:3)
+	output, err := exec.Command("dmsetup", "ls").Output()
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], prefix+"-") {
+			found = append(found, tracker.Resource{Kind: KindDm, Args: []string{fields[0]}})
+		}
+	}
+	return found
+}
@@ -0,0 +1,291 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/tracker"
+)
+
+// Tracked kinds of the file and loop backends
+const (
+	KindFile  = "file"  // path
+	KindMount = "mount" // mount point
+	KindLoop  = "loop"  // loop device
+)
+
+func init() {
+	tracker.Register(KindFile, func(a []string) error { return os.Remove(a[0]) })
+	tracker.Register(KindMount, func(a []string) error { return Unmount(a[0]) })
+	tracker.Register(KindLoop, func(a []string) error { return LoopDetach(a[0]) })
+}
+
+// MkfsMount - create an ext4 filesystem on the disk and mount it
+func MkfsMount(disk, mountPoint string) error {
+	output, err := exec.Command("mkfs.ext4", "-F", "-q", disk).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to mkfs.ext4: err:[%w] output:[%s]", err, output)
+	}
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+	output, err = exec.Command("mount", disk, mountPoint).CombinedOutput()
+	if err != nil {
+		os.Remove(mountPoint)
+		return fmt.Errorf("failed to mount: err:[%w] output:[%s]", err, output)
+	}
+	return nil
+}
+
+// Unmount - unmount and remove the mount point
+func Unmount(mountPoint string) error {
+	output, err := exec.Command("umount", mountPoint).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to umount: err:[%w] output:[%s]", err, output)
+	}
+	return os.Remove(mountPoint)
+}
+
+// LoopAttach - attach a file to a free loop device with direct I/O
+func LoopAttach(path string) (string, error) {
+	output, err := exec.Command("losetup", "--find", "--show", "--direct-io=on", path).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to losetup: err:[%w] output:[%s]", err, output)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// LoopDetach - detach a loop device
+func LoopDetach(device string) error {
+	output, err := exec.Command("losetup", "--detach", device).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to detach loop: err:[%w] output:[%s]", err, output)
+	}
+	return nil
+}
+
+// fileBackend keeps sparse image files in a directory. With a block device
+// as disk the directory is an ext4 filesystem on it.
+type fileBackend struct {
+	cfg    Config
+	rec    Recorder
+	dir    string
+	format string // image format, empty for raw
+}
+
+func (b *fileBackend) Name() string      { return "file" }
+func (b *fileBackend) BlockDevice() bool { return false }
+
+func (b *fileBackend) Check() error {
+	if b.cfg.Disk != "" && isBlockDevice(b.cfg.Disk) {
+		if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+			return fmt.Errorf("mkfs.ext4 not found: %w", err)
+		}
+	}
+	return nil
+}
+
+func (b *fileBackend) Provision() error {
+	switch {
+	case b.cfg.Disk == "":
+		b.dir = b.cfg.Dir
+	case isBlockDevice(b.cfg.Disk):
+		b.dir = filepath.Join(os.TempDir(), b.cfg.Pool)
+		if err := MkfsMount(b.cfg.Disk, b.dir); err != nil {
+			return err
+		}
+		return b.rec.Add(KindMount, b.dir)
+	default:
+		b.dir = b.cfg.Disk
+	}
+	if b.dir == "" {
+		return fmt.Errorf("no directory for volume files")
+	}
+	return nil
+}
+
+func (b *fileBackend) Destroy() error {
+	if err := b.rec.Undo(KindMount, b.dir); err != nil {
+		return err
+	}
+	if b.cfg.Disk != "" && isBlockDevice(b.cfg.Disk) {
+		return wipeDisk(b.cfg.Disk)
+	}
+	return nil
+}
+
+// createOpts returns the qemu-img create options of the images
+func (b *fileBackend) createOpts() map[string]string {
+	opts := map[string]string{}
+	for k, v := range b.cfg.Props {
+		switch ImageOptScope(k) {
+		case ScopeCreate:
+			opts[k] = v
+		case ScopeFilter:
+			if v != "off" {
+				opts["compression_type"] = v
+			}
+		}
+	}
+	return opts
+}
+
+// CreateVolume creates a sparse raw file, or an image with qemu-img for
+// other formats and create options
+func (b *fileBackend) CreateVolume(name string, sizeGb int) error {
+	path := b.DevicePath(name)
+	if opts := b.createOpts(); b.format != "" || len(opts) != 0 {
+		format := b.format
+		if format == "" {
+			format = "raw"
+		}
+		if err := QemuImgCreate(path, format, sizeGb, opts); err != nil {
+			return err
+		}
+		return b.rec.Add(KindFile, path)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create volume file failed: %w", err)
+	}
+	defer file.Close()
+	if err := b.rec.Add(KindFile, path); err != nil {
+		return err
+	}
+	if err := file.Truncate(int64(sizeGb) << 30); err != nil {
+		return fmt.Errorf("resize volume file failed: %w", err)
+	}
+	return nil
+}
+
+func (b *fileBackend) DestroyVolume(name string) error {
+	return b.rec.Undo(KindFile, b.DevicePath(name))
+}
+
+func (b *fileBackend) DevicePath(name string) string {
+	if b.format != "" {
+		return filepath.Join(b.dir, name+"."+b.format)
+	}
+	return filepath.Join(b.dir, name+".img")
+}
+
+func (b *fileBackend) Describe(name string) (map[string]string, error) {
+	fi, err := os.Stat(b.DevicePath(name))
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]string{
+		"path": b.DevicePath(name),
+		"size": fmt.Sprintf("%d", fi.Size()),
+	}
+	for k, v := range b.cfg.Props {
+		res[k] = v
+	}
+	if fstype, err := exec.Command("stat", "-f", "-c", "%T", b.dir).Output(); err == nil {
+		res["filesystem"] = strings.TrimSpace(string(fstype))
+	}
+	return res, nil
+}
+
+// Allocated returns the blocks of the sparse image file, discards punch
+// holes in it. Loop volumes report their backing file the same way.
+func (b *fileBackend) Allocated(name string) (int64, map[string]string, error) {
+	fi, err := os.Stat(b.DevicePath(name))
+	if err != nil {
+		return 0, nil, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, nil, fmt.Errorf("no block count of %s", b.DevicePath(name))
+	}
+	raw := map[string]string{
+		"size":   strconv.FormatInt(fi.Size(), 10),
+		"blocks": strconv.FormatInt(st.Blocks, 10),
+	}
+	return st.Blocks * 512, raw, nil
+}
+
+// loopBackend attaches the image files of the file backend to loop devices
+type loopBackend struct {
+	fileBackend
+	devices map[string]string // volume name -> loop device
+}
+
+func (b *loopBackend) Name() string      { return "loop" }
+func (b *loopBackend) BlockDevice() bool { return true }
+
+func (b *loopBackend) Check() error {
+	if _, err := exec.LookPath("losetup"); err != nil {
+		return fmt.Errorf("losetup not found: %w", err)
+	}
+	return b.fileBackend.Check()
+}
+
+func (b *loopBackend) CreateVolume(name string, sizeGb int) error {
+	if err := b.fileBackend.CreateVolume(name, sizeGb); err != nil {
+		return err
+	}
+	dev, err := LoopAttach(b.fileBackend.DevicePath(name))
+	if err != nil {
+		return err
+	}
+	b.devices[name] = dev
+	return b.rec.Add(KindLoop, dev)
+}
+
+func (b *loopBackend) DestroyVolume(name string) error {
+	if err := b.rec.Undo(KindLoop, b.devices[name]); err != nil {
+		return err
+	}
+	delete(b.devices, name)
+	return b.fileBackend.DestroyVolume(name)
+}
+
+func (b *loopBackend) DevicePath(name string) string {
+	return b.devices[name]
+}
+
+func (b *loopBackend) Describe(name string) (map[string]string, error) {
+	res, err := b.fileBackend.Describe(name)
+	if err != nil {
+		return nil, err
+	}
+	res["device"] = b.devices[name]
+	sysDir := filepath.Join("/sys/block", filepath.Base(b.devices[name]), "loop")
+	if dio, err := ioutil.ReadFile(filepath.Join(sysDir, "dio")); err == nil {
+		res["dio"] = strings.TrimSpace(string(dio))
+	}
+	return res, nil
+}
+
+// scanFile finds loop devices and mounts of the file backends
+func scanFile(prefix string) []tracker.Resource {
+	var found []tracker.Resource
+	base := filepath.Join(os.TempDir(), prefix)
+
+	if mounts, err := ioutil.ReadFile("/proc/mounts"); err == nil {
+		for _, line := range strings.Split(string(mounts), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 1 && strings.HasPrefix(fields[1], base) {
+				found = append(found, tracker.Resource{Kind: KindMount, Args: []string{fields[1]}})
+			}
+		}
+	}
+
+	// NAME BACK-FILE, e.g. /dev/loop3 /tmp/fiotest/vm7890.img
+	if output, err := exec.Command("losetup", "-n", "-O", "NAME,BACK-FILE").Output(); err == nil {
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && strings.HasPrefix(fields[1], base) {
+				found = append(found, tracker.Resource{Kind: KindLoop, Args: []string{fields[0]}})
+			}
+		}
+	}
+	return found
+}
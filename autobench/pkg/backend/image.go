@@ -0,0 +1,144 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Scopes of an image option, see ImageOptScope
+const (
+	ScopeCreate  = "create"  // qemu-img create -o, e.g. cluster_size
+	ScopeRuntime = "runtime" // option of the format driver of the drive, e.g. l2-cache-size
+	ScopeFilter  = "filter"  // compression: compression_type of the image and the compress filter
+)
+
+// ImageCompressions are the values of the compression image option
+var ImageCompressions = []string{"off", "zlib", "zstd"}
+
+// ImageOptScope tells where an option given to the file or qcow2 backend
+// goes. QEMU spells create options with underscores and runtime options
+// of the qcow2 driver with dashes.
+func ImageOptScope(name string) string {
+	switch {
+	case name == "compression":
+		return ScopeFilter
+	case strings.Contains(name, "-"):
+		return ScopeRuntime
+	}
+	return ScopeCreate
+}
+
+// ImageOptFits reports whether an image option applies to a backend, raw
+// images only know preallocation
+func ImageOptFits(name, backendName string) bool {
+	switch backendName {
+	case "qcow2":
+		return true
+	case "file":
+		return name == "preallocation"
+	}
+	return false
+}
+
+// QemuImgCreate - create a disk image with the given create options
+func QemuImgCreate(path, format string, sizeGb int, opts map[string]string) error {
+	//qemu-img create -f qcow2 -o cluster_size=64k disk.qcow2 60G
+	args := []string{"create", "-q", "-f", format}
+	if len(opts) != 0 {
+		args = append(args, "-o", strings.Join(sortedProps(opts), ","))
+	}
+	args = append(args, path, fmt.Sprintf("%dG", sizeGb))
+	output, err := exec.Command("qemu-img", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to qemu-img create: err:[%w] output:[%s]", err, output)
+	}
+	return nil
+}
+
+// QemuImgInfo - returns the image info of qemu-img, the format specific
+// data of qcow2 included. The image may be open by QEMU.
+func QemuImgInfo(path string) (map[string]string, error) {
+	output, err := exec.Command("qemu-img", "info", "--force-share", "--output=json", path).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to qemu-img info: err:[%w] output:[%s]", err, output)
+	}
+	var info map[string]interface{}
+	if err := json.Unmarshal(output, &info); err != nil {
+		return nil, fmt.Errorf("could not parse qemu-img info: %w", err)
+	}
+	res := map[string]string{}
+	for _, k := range []string{"format", "virtual-size", "actual-size", "cluster-size"} {
+		if v, ok := info[k]; ok {
+			res[k] = fmt.Sprint(v)
+		}
+	}
+	if spec, ok := info["format-specific"].(map[string]interface{}); ok {
+		if data, ok := spec["data"].(map[string]interface{}); ok {
+			for k, v := range data {
+				switch v.(type) {
+				case map[string]interface{}, []interface{}:
+				default:
+					res[k] = fmt.Sprint(v)
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// qcow2Backend keeps qcow2 images in the directory of the file backend.
+// The create options of Props shape the images, the runtime options and
+// compression go to the drives.
+type qcow2Backend struct {
+	fileBackend
+}
+
+func (b *qcow2Backend) Name() string { return "qcow2" }
+
+func (b *qcow2Backend) Check() error {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		return fmt.Errorf("qemu-img not found: %w", err)
+	}
+	return b.fileBackend.Check()
+}
+
+func (b *qcow2Backend) Format() string { return "qcow2" }
+
+func (b *qcow2Backend) DriveOptions() (map[string]string, bool) {
+	opts := map[string]string{}
+	for k, v := range b.cfg.Props {
+		if ImageOptScope(k) == ScopeRuntime {
+			opts[k] = v
+		}
+	}
+	compress := b.cfg.Props["compression"] != "" && b.cfg.Props["compression"] != "off"
+	return opts, compress
+}
+
+// Describe returns qemu-img info of the image and the options autobench
+// gives QEMU, preallocation is not recorded in the image
+func (b *qcow2Backend) Describe(name string) (map[string]string, error) {
+	res, err := QemuImgInfo(b.DevicePath(name))
+	if err != nil {
+		return nil, err
+	}
+	res["path"] = b.DevicePath(name)
+	for k, v := range b.cfg.Props {
+		switch ImageOptScope(k) {
+		case ScopeRuntime:
+			res["drive."+k] = v
+		case ScopeFilter:
+			res[k] = v
+		default:
+			if _, ok := res[k]; !ok {
+				res[k] = v
+			}
+		}
+	}
+	if fstype, err := exec.Command("stat", "-f", "-c", "%T", b.dir).Output(); err == nil {
+		res["filesystem"] = strings.TrimSpace(string(fstype))
+	}
+	return res, nil
+}
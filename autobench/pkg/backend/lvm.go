@@ -0,0 +1,433 @@
+package backend
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/tracker"
+)
+
+// Tracked kinds of the lvm backends
+const (
+	KindVG = "lvm" // comma separated disks, vg name
+	KindLV = "lv"  // lv name, vg name
+)
+
+// thinPoolName is the thin pool of the lvm-thin backend
+const thinPoolName = "thinpool"
+
+func init() {
+	tracker.Register(KindVG, func(a []string) error { return DestroyLvm(strings.Split(a[0], ","), a[1]) })
+	tracker.Register(KindLV, func(a []string) error { return LVremove(a[0], a[1]) })
+}
+
+func CheckLvmOnSystem() error {
+	output, err := exec.Command("lvm", "version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to collect tools data (lvm)! output:[%s] err:[%w]", output, err)
+	}
+	return nil
+}
+
+// PVcreate - Use PVcreate to mark disk as LVM physical volumes
+func PVcreate(diskPath string) error {
+	//pvcreate /dev/sdb1
+	output, err := exec.Command("pvcreate", diskPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to pvcreate: err:[%w] output:[%s]", err, output)
+	}
+
+	return nil
+}
+
+// VGcreate - Make LVM physical volumes into volume groups
+func VGcreate(diskPaths []string, vgName string) error {
+	// vgcreate testvg /dev/sdb1 /dev/sdc1
+	output, err := exec.Command("vgcreate", append([]string{vgName}, diskPaths...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to vgcreate: err:[%w] output:[%s]", err, output)
+	}
+
+	return nil
+}
+
+// LVcreate - Create a logical volume on the volume group, extra are
+// segment type arguments such as --type raid1 -m 1
+func LVcreate(lvName, vgName string, sizeDisk int, extra ...string) error {
+	// lvcreate -L 50G --name testlv testvg
+	args := append([]string{"-L", fmt.Sprintf("%dG", sizeDisk), "--name", lvName}, extra...)
+	output, err := exec.Command("lvcreate", append(args, vgName)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to LVcreate: err:[%w] output:[%s]", err, output)
+	}
+
+	return nil
+}
+
+// ThinPoolCreate - Create a thin pool on most of the volume group,
+// stripes > 1 stripes its data over the physical volumes
+func ThinPoolCreate(poolName, vgName string, stripes int) error {
+	// lvcreate --type thin-pool -l 90%FREE --name thinpool testvg
+	args := []string{"--type", "thin-pool", "-l", "90%FREE", "--name", poolName}
+	if stripes > 1 {
+		args = append(args, "-i", fmt.Sprint(stripes))
+	}
+	output, err := exec.Command("lvcreate", append(args, vgName)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to create thin pool: err:[%w] output:[%s]", err, output)
+	}
+	return nil
+}
+
+// ThinLVcreate - Create a thin logical volume in a thin pool
+func ThinLVcreate(lvName, poolName, vgName string, sizeDisk int) error {
+	// lvcreate -V 50G --thin --name testlv testvg/thinpool
+	output, err := exec.Command("lvcreate", "-V", fmt.Sprintf("%dG", sizeDisk),
+		"--thin", "--name", lvName,
+		fmt.Sprintf("%s/%s", vgName, poolName)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to create thin LV: err:[%w] output:[%s]", err, output)
+	}
+	return nil
+}
+
+// LVsnapshot - Create a snapshot of a logical volume, extra are the size
+// arguments of thick snapshots. Without them a thin volume gets a thin
+// snapshot.
+func LVsnapshot(snapName, lvName, vgName string, extra ...string) error {
+	// lvcreate -s -L 10G --name snap1 testvg/testlv
+	args := append([]string{"-s", "--name", snapName}, extra...)
+	output, err := exec.Command("lvcreate", append(args, fmt.Sprintf("%s/%s", vgName, lvName))...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot LV: err:[%w] output:[%s]", err, output)
+	}
+	return nil
+}
+
+// PVremove - Use LVremove to remove the disk from as LVM physical volumes
+func PVremove(targetDisk string) error {
+	//pvremove /dev/sdb1
+	output, err := exec.Command("pvremove", "-y", targetDisk).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to pvremove: err:[%w] output:[%s]", err, output)
+	}
+	return nil
+}
+
+// VGremove - Remove volume groups
+func VGremove(vgName string) error {
+	//vgremove testvg
+	output, err := exec.Command("vgremove", "-y", vgName).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to vgremove: err:[%w] output:[%s]", err, output)
+	}
+	return nil
+}
+
+// LVremove - remove a logical volume
+func LVremove(lvName, vgName string) error {
+	//lvremove /dev/testvg/testlv
+	lvpath := filepath.Join("/dev/", vgName, lvName)
+	output, err := exec.Command("lvremove", "-y", lvpath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to lvremove: err:[%w] output:[%s]", err, output)
+	}
+	return nil
+}
+
+// ListVGs - list the names of all volume groups
+func ListVGs() ([]string, error) {
+	output, err := exec.Command("vgs", "--noheadings", "-o", "vg_name").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to vgs: err:[%w] output:[%s]", err, output)
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// ListPVs - list the physical volumes of a volume group
+func ListPVs(vgName string) ([]string, error) {
+	output, err := exec.Command("pvs", "--noheadings", "-o", "pv_name",
+		"-S", fmt.Sprintf("vg_name=%s", vgName)).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pvs: err:[%w] output:[%s]", err, output)
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// DestroyLvm - Remove volume groups and marker LVM on physical volumes
+func DestroyLvm(targetDisks []string, vgName string) error {
+	if err := VGremove(vgName); err != nil {
+		return fmt.Errorf("VGremove failed err:[%w]", err)
+	}
+
+	for _, disk := range targetDisks {
+		if err := PVremove(disk); err != nil {
+			return fmt.Errorf("PVremove failed err:[%w]", err)
+		}
+	}
+	return nil
+}
+
+// LVdescribe - returns lvs fields of a logical volume
+func LVdescribe(lvName, vgName string) (map[string]string, error) {
+	fields := []string{"lv_size", "segtype", "stripes", "stripe_size", "chunk_size", "data_percent", "devices"}
+	output, err := exec.Command("lvs", "--noheadings", "--nosuffix", "--separator", "|",
+		"-o", strings.Join(fields, ","),
+		fmt.Sprintf("%s/%s", vgName, lvName)).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to lvs: err:[%w] output:[%s]", err, output)
+	}
+	values := strings.Split(strings.TrimSpace(string(output)), "|")
+	res := map[string]string{}
+	for i, f := range fields {
+		if i < len(values) && strings.TrimSpace(values[i]) != "" {
+			res[f] = strings.TrimSpace(values[i])
+		}
+	}
+	return res, nil
+}
+
+// lvmBackend provides thick logical volumes or, with thin set, thin
+// volumes of a thin pool that spans the volume group
+type lvmBackend struct {
+	cfg  Config
+	rec  Recorder
+	thin bool
+}
+
+func (b *lvmBackend) Name() string {
+	if b.thin {
+		return "lvm-thin"
+	}
+	return "lvm"
+}
+
+func (b *lvmBackend) BlockDevice() bool { return true }
+
+func (b *lvmBackend) Check() error {
+	return CheckLvmOnSystem()
+}
+
+// Provision creates the volume group and the thin pool. Without a disk an
+// existing volume group (and thin pool) is used.
+func (b *lvmBackend) Provision() error {
+	disks := b.cfg.disks()
+	if len(disks) == 0 {
+		return nil
+	}
+	for i, disk := range disks {
+		if err := PVcreate(disk); err != nil {
+			for _, d := range disks[:i] {
+				PVremove(d)
+			}
+			return err
+		}
+	}
+	if err := VGcreate(disks, b.cfg.Pool); err != nil {
+		for _, d := range disks {
+			PVremove(d)
+		}
+		return err
+	}
+	if err := b.rec.Add(KindVG, strings.Join(disks, ","), b.cfg.Pool); err != nil {
+		return err
+	}
+	if !b.thin {
+		return nil
+	}
+	stripes := 1
+	if b.cfg.Topology != nil && b.cfg.Topology.Groups[0].Type == "striped" {
+		stripes = len(disks)
+	}
+	if err := ThinPoolCreate(thinPoolName, b.cfg.Pool, stripes); err != nil {
+		return err
+	}
+	return b.rec.Add(KindLV, thinPoolName, b.cfg.Pool)
+}
+
+func (b *lvmBackend) Destroy() error {
+	if err := b.rec.Undo(KindLV, thinPoolName, b.cfg.Pool); err != nil {
+		log.Printf("remove thin pool failed: %v", err)
+	}
+	disks := b.cfg.disks()
+	if err := b.rec.Undo(KindVG, strings.Join(disks, ","), b.cfg.Pool); err != nil {
+		return err
+	}
+	for _, disk := range disks {
+		if err := wipeDisk(disk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *lvmBackend) CreateVolume(name string, sizeGb int) error {
+	var err error
+	if b.thin {
+		err = ThinLVcreate(name, thinPoolName, b.cfg.Pool, sizeGb)
+	} else {
+		var extra []string
+		if b.cfg.Topology != nil {
+			extra = b.cfg.Topology.LvcreateArgs()
+		}
+		err = LVcreate(name, b.cfg.Pool, sizeGb, extra...)
+	}
+	if err != nil {
+		return err
+	}
+	return b.rec.Add(KindLV, name, b.cfg.Pool)
+}
+
+func (b *lvmBackend) DestroyVolume(name string) error {
+	return b.rec.Undo(KindLV, name, b.cfg.Pool)
+}
+
+func (b *lvmBackend) DevicePath(name string) string {
+	return filepath.Join("/dev", b.cfg.Pool, name)
+}
+
+func (b *lvmBackend) Describe(name string) (map[string]string, error) {
+	res, err := LVdescribe(name, b.cfg.Pool)
+	if err == nil && b.cfg.Topology != nil {
+		res["topology"] = b.cfg.Topology.String()
+	}
+	return res, err
+}
+
+// Allocated returns the mapped part of a thin volume, thick volumes take
+// their whole size
+func (b *lvmBackend) Allocated(name string) (int64, map[string]string, error) {
+	output, err := exec.Command("lvs", "--noheadings", "--nosuffix", "--units", "b", "--separator", "|",
+		"-o", "lv_size,data_percent", fmt.Sprintf("%s/%s", b.cfg.Pool, name)).CombinedOutput()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to lvs: err:[%w] output:[%s]", err, output)
+	}
+	values := strings.Split(strings.TrimSpace(string(output)), "|")
+	raw := map[string]string{"lv_size": strings.TrimSpace(values[0])}
+	size, err := strconv.ParseInt(raw["lv_size"], 10, 64)
+	if err != nil {
+		return 0, raw, fmt.Errorf("invalid lv_size of %s: %q", name, raw["lv_size"])
+	}
+	if !b.thin || len(values) < 2 {
+		return size, raw, nil
+	}
+	raw["data_percent"] = strings.TrimSpace(values[1])
+	percent, err := strconv.ParseFloat(raw["data_percent"], 64)
+	if err != nil {
+		return 0, raw, fmt.Errorf("invalid data_percent of %s: %q", name, raw["data_percent"])
+	}
+	return int64(float64(size) * percent / 100), raw, nil
+}
+
+// lvSpace returns the lv_size and data_percent of the logical volumes
+// lvs selects with the given arguments, one pair per volume
+func lvSpace(args ...string) ([][2]string, error) {
+	args = append([]string{"--noheadings", "--nosuffix", "--units", "b", "--separator", "|",
+		"-o", "lv_size,data_percent"}, args...)
+	output, err := exec.Command("lvs", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to lvs: err:[%w] output:[%s]", err, output)
+	}
+	var res [][2]string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		values := strings.Split(strings.TrimSpace(line), "|")
+		if len(values) == 2 {
+			res = append(res, [2]string{strings.TrimSpace(values[0]), strings.TrimSpace(values[1])})
+		}
+	}
+	return res, nil
+}
+
+// Snapshot takes a thick COW snapshot of --snapshot-size, or one of the
+// size of the origin, or a thin snapshot in the thin pool
+func (b *lvmBackend) Snapshot(name, snap string) error {
+	var extra []string
+	switch {
+	case b.thin:
+	case b.cfg.SnapshotGb > 0:
+		extra = []string{"-L", fmt.Sprintf("%dG", b.cfg.SnapshotGb)}
+	default:
+		extra = []string{"-l", "100%ORIGIN"}
+	}
+	if err := LVsnapshot(snap, name, b.cfg.Pool, extra...); err != nil {
+		return err
+	}
+	return b.rec.Add(KindLV, snap, b.cfg.Pool)
+}
+
+func (b *lvmBackend) DestroySnapshot(name, snap string) error {
+	return b.rec.Undo(KindLV, snap, b.cfg.Pool)
+}
+
+// SnapshotSpace returns the size of a thick volume and the COW space its
+// snapshots use. Thin snapshots share the blocks of their origin, so for
+// lvm-thin it is the data of the whole thin pool.
+func (b *lvmBackend) SnapshotSpace(name string) (int64, map[string]string, error) {
+	if b.thin {
+		lvs, err := lvSpace(fmt.Sprintf("%s/%s", b.cfg.Pool, thinPoolName))
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(lvs) != 1 {
+			return 0, nil, fmt.Errorf("thin pool %s/%s not found", b.cfg.Pool, thinPoolName)
+		}
+		raw := map[string]string{"scope": "pool", "pool_size": lvs[0][0], "pool_data_percent": lvs[0][1]}
+		size, err := strconv.ParseInt(lvs[0][0], 10, 64)
+		if err != nil {
+			return 0, raw, fmt.Errorf("invalid size of the thin pool: %q", lvs[0][0])
+		}
+		percent, err := strconv.ParseFloat(lvs[0][1], 64)
+		if err != nil {
+			return 0, raw, fmt.Errorf("invalid data_percent of the thin pool: %q", lvs[0][1])
+		}
+		return int64(float64(size) * percent / 100), raw, nil
+	}
+
+	total, raw, err := b.Allocated(name)
+	if err != nil {
+		return 0, raw, err
+	}
+	snaps, err := lvSpace("-S", fmt.Sprintf("vg_name=%s && origin=%s", b.cfg.Pool, name))
+	if err != nil {
+		return 0, raw, err
+	}
+	var cow int64
+	for _, lv := range snaps {
+		size, err := strconv.ParseInt(lv[0], 10, 64)
+		if err != nil {
+			return 0, raw, fmt.Errorf("invalid lv_size of a snapshot of %s: %q", name, lv[0])
+		}
+		percent, err := strconv.ParseFloat(lv[1], 64)
+		if err != nil {
+			return 0, raw, fmt.Errorf("invalid data_percent of a snapshot of %s: %q", name, lv[1])
+		}
+		cow += int64(float64(size) * percent / 100)
+	}
+	raw["snapshots"] = strconv.Itoa(len(snaps))
+	raw["snapshot_cow_bytes"] = strconv.FormatInt(cow, 10)
+	return total + cow, raw, nil
+}
+
+func scanLvm(prefix string) []tracker.Resource {
+	var found []tracker.Resource
+	vgs, err := ListVGs()
+	if err != nil {
+		return nil
+	}
+	for _, vg := range vgs {
+		if !strings.HasPrefix(vg, prefix) {
+			continue
+		}
+		pvs, err := ListPVs(vg)
+		if err != nil || len(pvs) == 0 {
+			log.Printf("could not find physical volume of %s: %v", vg, err)
+			continue
+		}
+		found = append(found, tracker.Resource{Kind: KindVG, Args: []string{strings.Join(pvs, ","), vg}})
+	}
+	return found
+}
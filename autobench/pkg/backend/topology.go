@@ -0,0 +1,236 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// VdevGroup is one group of disks of a topology, e.g. a mirror of two
+// disks or the log device of a zpool
+type VdevGroup struct {
+	Class string   // "" for data, log, special or cache
+	Type  string   // "" for plain disks, mirror, raidz1..3, striped, raid1, raid5, raid6, raid10
+	Disks []string // device paths
+}
+
+// Topology is a multi-disk pool layout given as a compact string:
+// groups are separated by "+", a group is [class:][type:]disk,disk...
+//
+//	mirror:sdb,sdc+mirror:sdd,sde+log:nvme0n1
+//	raidz2:sdb,sdc,sdd,sde+special:mirror:nvme0n1,nvme1n1
+//	raid5:sdb,sdc,sdd
+type Topology struct {
+	spec   string
+	Groups []VdevGroup
+}
+
+// minDisks is the smallest number of disks of each group type
+var minDisks = map[string]int{
+	"":        1,
+	"mirror":  2,
+	"raidz1":  2,
+	"raidz2":  3,
+	"raidz3":  4,
+	"striped": 2,
+	"linear":  1,
+	"raid1":   2,
+	"raid5":   3,
+	"raid6":   5,
+	"raid10":  4,
+}
+
+var zfsGroupTypes = []string{"", "mirror", "raidz1", "raidz2", "raidz3"}
+var lvmGroupTypes = []string{"", "linear", "striped", "raid1", "raid5", "raid6", "raid10"}
+
+// ParseTopology parses a topology string, bare disk names are taken from /dev
+func ParseTopology(spec string) (*Topology, error) {
+	t := &Topology{spec: spec}
+	for _, g := range strings.Split(spec, "+") {
+		// Disk names such as /dev/disk/by-path/pci-0000:00:1f.2-ata-1 have
+		// colons too, only known classes and types are taken off the front
+		parts := strings.Split(strings.TrimSpace(g), ":")
+		var group VdevGroup
+		if len(parts) > 1 && contains(ZfsVdevClasses, parts[0]) {
+			group.Class, parts = parts[0], parts[1:]
+		}
+		if len(parts) > 1 && isGroupType(parts[0]) {
+			group.Type, parts = parts[0], parts[1:]
+			if group.Type == "raidz" {
+				group.Type = "raidz1"
+			}
+		}
+		disks := strings.Join(parts, ":")
+		if disks == "" {
+			return nil, fmt.Errorf("invalid vdev group %q in topology %q", g, spec)
+		}
+		for _, d := range strings.Split(disks, ",") {
+			if d = strings.TrimSpace(d); d == "" {
+				continue
+			}
+			if !strings.HasPrefix(d, "/") {
+				d = filepath.Join("/dev", d)
+			}
+			group.Disks = append(group.Disks, d)
+		}
+		if len(group.Disks) < minDisks[group.Type] {
+			return nil, fmt.Errorf("%s group %q needs at least %d disks", group.Type, g, minDisks[group.Type])
+		}
+		t.Groups = append(t.Groups, group)
+	}
+	return t, nil
+}
+
+// isGroupType reports whether s names a group type rather than a disk
+func isGroupType(s string) bool {
+	if s == "raidz" {
+		return true
+	}
+	_, ok := minDisks[s]
+	return ok && s != ""
+}
+
+func (t *Topology) String() string {
+	return t.spec
+}
+
+// Disks returns all disks of the topology
+func (t *Topology) Disks() []string {
+	var disks []string
+	for _, g := range t.Groups {
+		disks = append(disks, g.Disks...)
+	}
+	return disks
+}
+
+// Fits reports whether the group types and classes suit the backend
+func (t *Topology) Fits(backend string) bool {
+	return t.checkLayout(backend) == nil
+}
+
+// Validate checks that the layout fits the backend and that every disk is a
+// block device that is present, used once and not mounted
+func (t *Topology) Validate(backend string) error {
+	if err := t.checkLayout(backend); err != nil {
+		return err
+	}
+
+	mounts, _ := ioutil.ReadFile("/proc/mounts")
+	seen := map[string]bool{}
+	for _, d := range t.Disks() {
+		if seen[d] {
+			return fmt.Errorf("topology %s uses %s twice", t, d)
+		}
+		seen[d] = true
+		if !isBlockDevice(d) {
+			return fmt.Errorf("topology %s: %s is not a block device", t, d)
+		}
+		for _, line := range strings.Split(string(mounts), "\n") {
+			if fields := strings.Fields(line); len(fields) > 1 && onDisk(fields[0], d) {
+				return fmt.Errorf("topology %s: %s is mounted on %s", t, fields[0], fields[1])
+			}
+		}
+	}
+	return nil
+}
+
+// onDisk reports whether dev is disk or one of its partitions, sdb1 and
+// nvme0n1p1 but not sdba or nvme0n10. Disks with a name ending in a digit
+// separate partitions with p.
+func onDisk(dev, disk string) bool {
+	if !strings.HasPrefix(dev, disk) {
+		return false
+	}
+	rest := dev[len(disk):]
+	if rest == "" {
+		return true
+	}
+	if last := disk[len(disk)-1]; last >= '0' && last <= '9' {
+		return digitPartition.MatchString(rest)
+	}
+	return letterPartition.MatchString(rest)
+}
+
+var (
+	digitPartition  = regexp.MustCompile(`^p[0-9]+$`)
+	letterPartition = regexp.MustCompile(`^[0-9]+$`)
+)
+
+func (t *Topology) checkLayout(backend string) error {
+	types := lvmGroupTypes
+	switch backend {
+	case "zvol":
+		types = zfsGroupTypes
+	case "lvm", "lvm-thin":
+		if len(t.Groups) != 1 || t.Groups[0].Class != "" {
+			return fmt.Errorf("topology %s: lvm takes one group of disks", t)
+		}
+		if backend == "lvm-thin" && t.Groups[0].Type != "" && t.Groups[0].Type != "linear" && t.Groups[0].Type != "striped" {
+			return fmt.Errorf("topology %s: the thin pool can be linear or striped only", t)
+		}
+	default:
+		return fmt.Errorf("topology %s: the %s backend does not take a topology", t, backend)
+	}
+
+	data := 0
+	for _, g := range t.Groups {
+		if !contains(types, g.Type) {
+			return fmt.Errorf("topology %s: %s groups are not supported by the %s backend", t, g.Type, backend)
+		}
+		// zpool takes cache devices only as plain disks and log devices
+		// plain or mirrored
+		if g.Class == "cache" && g.Type != "" {
+			return fmt.Errorf("topology %s: cache devices cannot be a %s group", t, g.Type)
+		}
+		if g.Class == "log" && g.Type != "" && g.Type != "mirror" {
+			return fmt.Errorf("topology %s: log devices cannot be a %s group", t, g.Type)
+		}
+		// Every stripe of raid10 is a mirror of two disks
+		if g.Type == "raid10" && len(g.Disks)%2 != 0 {
+			return fmt.Errorf("topology %s: raid10 needs an even number of disks, got %d", t, len(g.Disks))
+		}
+		if g.Class == "" {
+			data++
+		}
+	}
+	if data == 0 {
+		return fmt.Errorf("topology %s has no data disks", t)
+	}
+	return nil
+}
+
+// ZpoolArgs returns the vdev arguments of `zpool create`
+func (t *Topology) ZpoolArgs() []string {
+	var args []string
+	for _, g := range t.Groups {
+		if g.Class != "" {
+			args = append(args, g.Class)
+		}
+		if g.Type != "" {
+			args = append(args, g.Type)
+		}
+		args = append(args, g.Disks...)
+	}
+	return args
+}
+
+// LvcreateArgs returns the segment type arguments of `lvcreate`
+func (t *Topology) LvcreateArgs() []string {
+	g := t.Groups[0]
+	n := len(g.Disks)
+	switch g.Type {
+	case "striped":
+		return []string{"--type", "striped", "-i", fmt.Sprint(n)}
+	case "raid1":
+		return []string{"--type", "raid1", "-m", fmt.Sprint(n - 1)}
+	case "raid5":
+		return []string{"--type", "raid5", "-i", fmt.Sprint(n - 1)}
+	case "raid6":
+		return []string{"--type", "raid6", "-i", fmt.Sprint(n - 2)}
+	case "raid10":
+		return []string{"--type", "raid10", "-i", fmt.Sprint(n / 2), "-m", "1"}
+	}
+	return nil
+}
@@ -0,0 +1,372 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/tracker"
+)
+
+// Tracked kinds of the zvol backend
+const (
+	KindZpool    = "zpool"    // pool name
+	KindZvol     = "zvol"     // pool name, zvol name
+	KindZfsParam = "zfsparam" // module parameter, previous value
+	KindZfsSnap  = "zfssnap"  // pool name, zvol name, snapshot name
+)
+
+func init() {
+	tracker.Register(KindZpool, func(a []string) error { return DestroyZpool(a[0]) })
+	tracker.Register(KindZvol, func(a []string) error { return DestroyZvol(a[0], a[1]) })
+	tracker.Register(KindZfsParam, func(a []string) error { _, err := SetZfsParam(a[0], a[1]); return err })
+	tracker.Register(KindZfsSnap, func(a []string) error { return DestroyZvol(a[0], a[1]+"@"+a[2]) })
+}
+
+const (
+	zfsParamsPath = "/sys/module/zfs/parameters"
+	zfsKstatPath  = "/proc/spl/kstat/zfs"
+)
+
+// Scopes of a zfs property, see ZfsPropScope
+const (
+	ScopeZvol  = "zvol"  // zfs create -o
+	ScopePool  = "pool"  // zpool create -o
+	ScopeVdev  = "vdev"  // log, special or cache device of the pool
+	ScopeParam = "param" // zfs module parameter
+)
+
+// zpoolCreateProps are the pool properties worth setting at creation
+var zpoolCreateProps = []string{"ashift", "autotrim", "autoexpand", "autoreplace", "failmode"}
+
+// ZfsVdevClasses are the allocation classes that take their own device
+var ZfsVdevClasses = []string{"log", "special", "cache"}
+
+// ZfsPropScope tells where a property given to the zvol backend goes:
+// vdev classes and pool properties need a new pool, zfs_* names are
+// module parameters and everything else is a zvol property
+func ZfsPropScope(name string) string {
+	switch {
+	case contains(ZfsVdevClasses, name):
+		return ScopeVdev
+	case contains(zpoolCreateProps, name) || strings.HasPrefix(name, "feature@"):
+		return ScopePool
+	case strings.HasPrefix(name, "zfs_"):
+		return ScopeParam
+	}
+	return ScopeZvol
+}
+
+// describeZvolProps are read back from every created zvol
+var describeZvolProps = []string{"volsize", "volblocksize", "compression", "primarycache",
+	"secondarycache", "logbias", "redundant_metadata", "sync", "dedup", "checksum"}
+
+func CheckZfsOnSystem() error {
+	output, err := exec.Command("zfs", "version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to collect tools data (zfs)! output:[%s] err:[%w]", output, err)
+	}
+	return nil
+}
+
+// CreateZpool - create a pool from the vdev arguments, e.g. "/dev/sdb" or
+// "mirror /dev/sdb /dev/sdc log /dev/nvme0n1", with the given pool properties
+func CreateZpool(zpoolName string, vdevs []string, props map[string]string) error {
+	// Workaround if something went wrong with specifying parameters
+	args := []string{"create", "-fd"}
+	for _, p := range sortedProps(props) {
+		args = append(args, "-o", p)
+	}
+	args = append(args, zpoolName)
+	output, err := exec.Command("zpool", append(args, vdevs...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to create zpool: err:[%w] output:[%s]", err, output)
+	}
+	return nil
+}
+
+func DestroyZpool(zpoolName string) error {
+	// Need handle to pool at first place
+	output, err := exec.Command("zpool", "destroy", zpoolName).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to destroy zvol: log:%s err:%w", output, err)
+	}
+	return nil
+}
+
+// ListZpools - list the names of all imported zpools
+func ListZpools() ([]string, error) {
+	output, err := exec.Command("zpool", "list", "-H", "-o", "name").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list zpools: log:%s err:%w", output, err)
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// CreateZvol - create a zvol with the given zfs properties
+func CreateZvol(zpoolName, zvolName string, sizeDisk int, props map[string]string) error {
+	//zfs create -V 1G -o volblocksize=16k tank/disk1
+	args := []string{"create", "-V", fmt.Sprintf("%dG", sizeDisk)}
+	for _, p := range sortedProps(props) {
+		args = append(args, "-o", p)
+	}
+	args = append(args, fmt.Sprintf("%s/%s", zpoolName, zvolName))
+	output, err := exec.Command("zfs", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to create zvol: log:%s err:%w", output, err)
+	}
+	return nil
+}
+
+func DestroyZvol(zpoolName, zvolName string) error {
+	output, err := exec.Command("zfs", "destroy",
+		fmt.Sprintf("%s/%s", zpoolName, zvolName)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to destroy zvol: log:%s err:%w", output, err)
+	}
+	return nil
+}
+
+// CreateZfsSnapshot - snapshot a zvol
+func CreateZfsSnapshot(zpoolName, zvolName, snapName string) error {
+	//zfs snapshot tank/disk1@snap1
+	output, err := exec.Command("zfs", "snapshot",
+		fmt.Sprintf("%s/%s@%s", zpoolName, zvolName, snapName)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot zvol: log:%s err:%w", output, err)
+	}
+	return nil
+}
+
+// ZfsGet - returns the values of zfs properties of a dataset
+func ZfsGet(dataset string, props []string) (map[string]string, error) {
+	output, err := exec.Command("zfs", "get", "-H", "-o", "property,value",
+		strings.Join(props, ","), dataset).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get zfs properties: log:%s err:%w", output, err)
+	}
+	return parseColumns(string(output)), nil
+}
+
+// SetZfsParam - set a zfs module parameter and return its previous value
+func SetZfsParam(name, value string) (string, error) {
+	path := filepath.Join(zfsParamsPath, name)
+	old, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unknown zfs module parameter %s: %w", name, err)
+	}
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return "", fmt.Errorf("failed to set %s=%s: %w", name, value, err)
+	}
+	return strings.TrimSpace(string(old)), nil
+}
+
+type zvolBackend struct {
+	cfg    Config
+	rec    Recorder
+	params [][]string // module parameters and their previous values
+}
+
+func (b *zvolBackend) Name() string      { return "zvol" }
+func (b *zvolBackend) BlockDevice() bool { return true }
+
+func (b *zvolBackend) Check() error {
+	return CheckZfsOnSystem()
+}
+
+// Provision sets the module parameters and creates the zpool. Without a
+// disk an existing pool is used.
+func (b *zvolBackend) Provision() error {
+	poolProps := map[string]string{}
+	vdevs := []string{b.cfg.Disk}
+	if b.cfg.Topology != nil {
+		vdevs = b.cfg.Topology.ZpoolArgs()
+	}
+	extra := len(vdevs)
+	for _, kv := range sortedProps(b.cfg.Props) {
+		name, value := splitProp(kv)
+		switch ZfsPropScope(name) {
+		case ScopePool:
+			poolProps[name] = value
+		case ScopeVdev:
+			if value != "none" {
+				vdevs = append(vdevs, name, value)
+			}
+		case ScopeParam:
+			old, err := SetZfsParam(name, value)
+			if err != nil {
+				return err
+			}
+			b.params = append(b.params, []string{name, old})
+			if err := b.rec.Add(KindZfsParam, name, old); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(b.cfg.disks()) == 0 {
+		if len(poolProps) != 0 || len(vdevs) > extra {
+			return fmt.Errorf("pool properties and vdevs need a disk to create the pool on")
+		}
+		return nil
+	}
+	if err := CreateZpool(b.cfg.Pool, vdevs, poolProps); err != nil {
+		return err
+	}
+	return b.rec.Add(KindZpool, b.cfg.Pool)
+}
+
+// Destroy destroys the pool, wipes its disks and restores the module parameters
+func (b *zvolBackend) Destroy() error {
+	if err := b.rec.Undo(KindZpool, b.cfg.Pool); err != nil {
+		return err
+	}
+	for _, kv := range sortedProps(b.cfg.Props) {
+		name, value := splitProp(kv)
+		if ZfsPropScope(name) == ScopeVdev && value != "none" {
+			if err := wipeDisk(value); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(b.params) - 1; i >= 0; i-- {
+		if err := b.rec.Undo(KindZfsParam, b.params[i]...); err != nil {
+			return err
+		}
+	}
+	b.params = nil
+	for _, disk := range b.cfg.disks() {
+		if err := wipeDisk(disk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *zvolBackend) CreateVolume(name string, sizeGb int) error {
+	props := map[string]string{}
+	for k, v := range b.cfg.Props {
+		if ZfsPropScope(k) == ScopeZvol {
+			props[k] = v
+		}
+	}
+	if err := CreateZvol(b.cfg.Pool, name, sizeGb, props); err != nil {
+		return err
+	}
+	return b.rec.Add(KindZvol, b.cfg.Pool, name)
+}
+
+func (b *zvolBackend) DestroyVolume(name string) error {
+	return b.rec.Undo(KindZvol, b.cfg.Pool, name)
+}
+
+func (b *zvolBackend) DevicePath(name string) string {
+	return filepath.Join("/dev/zvol", b.cfg.Pool, name)
+}
+
+func (b *zvolBackend) Describe(name string) (map[string]string, error) {
+	res, err := ZfsGet(fmt.Sprintf("%s/%s", b.cfg.Pool, name), describeZvolProps)
+	if err != nil {
+		return nil, err
+	}
+	output, err := exec.Command("zpool", "get", "-H", "-o", "property,value",
+		strings.Join(zpoolCreateProps, ","), b.cfg.Pool).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get zpool properties: log:%s err:%w", output, err)
+	}
+	for k, v := range parseColumns(string(output)) {
+		res["pool."+k] = v
+	}
+	if b.cfg.Topology != nil {
+		res["pool.topology"] = b.cfg.Topology.String()
+	}
+	for _, p := range b.params {
+		if value, err := ioutil.ReadFile(filepath.Join(zfsParamsPath, p[0])); err == nil {
+			res[p[0]] = strings.TrimSpace(string(value))
+		}
+	}
+	return res, nil
+}
+
+// Allocated returns the referenced bytes of the zvol, used also counts the
+// refreservation of thick zvols and does not drop on discard
+func (b *zvolBackend) Allocated(name string) (int64, map[string]string, error) {
+	dataset := fmt.Sprintf("%s/%s", b.cfg.Pool, name)
+	output, err := exec.Command("zfs", "get", "-Hp", "-o", "property,value",
+		"referenced,used,logicalreferenced,refreservation", dataset).CombinedOutput()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get zfs space: log:%s err:%w", output, err)
+	}
+	raw := parseColumns(string(output))
+	referenced, err := strconv.ParseInt(raw["referenced"], 10, 64)
+	if err != nil {
+		return 0, raw, fmt.Errorf("invalid referenced of %s: %q", dataset, raw["referenced"])
+	}
+	return referenced, raw, nil
+}
+
+func (b *zvolBackend) Snapshot(name, snap string) error {
+	if err := CreateZfsSnapshot(b.cfg.Pool, name, snap); err != nil {
+		return err
+	}
+	return b.rec.Add(KindZfsSnap, b.cfg.Pool, name, snap)
+}
+
+func (b *zvolBackend) DestroySnapshot(name, snap string) error {
+	return b.rec.Undo(KindZfsSnap, b.cfg.Pool, name, snap)
+}
+
+// SnapshotSpace returns the space of the zvol data and of the blocks only
+// its snapshots still hold, the refreservation of thick zvols is left out
+func (b *zvolBackend) SnapshotSpace(name string) (int64, map[string]string, error) {
+	dataset := fmt.Sprintf("%s/%s", b.cfg.Pool, name)
+	output, err := exec.Command("zfs", "get", "-Hp", "-o", "property,value",
+		"usedbydataset,usedbysnapshots,referenced,written", dataset).CombinedOutput()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get zfs space: log:%s err:%w", output, err)
+	}
+	raw := parseColumns(string(output))
+	var total int64
+	for _, prop := range []string{"usedbydataset", "usedbysnapshots"} {
+		v, err := strconv.ParseInt(raw[prop], 10, 64)
+		if err != nil {
+			return 0, raw, fmt.Errorf("invalid %s of %s: %q", prop, dataset, raw[prop])
+		}
+		total += v
+	}
+	return total, raw, nil
+}
+
+// CollectStats saves arcstats, the zil kstat and the per-vdev iostat of the
+// pool to dir, the file names end with suffix, e.g. arcstats-start.txt
+func (b *zvolBackend) CollectStats(dir, suffix string) error {
+	for _, kstat := range []string{"arcstats", "zil"} {
+		data, err := ioutil.ReadFile(filepath.Join(zfsKstatPath, kstat))
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", kstat, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%s-%s.txt", kstat, suffix)), data, 0644); err != nil {
+			return err
+		}
+	}
+	output, err := exec.Command("zpool", "iostat", "-v", "-p", "-l", b.cfg.Pool).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to zpool iostat: log:%s err:%w", output, err)
+	}
+	return ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("zpool-iostat-%s.txt", suffix)), output, 0644)
+}
+
+func scanZfs(prefix string) []tracker.Resource {
+	var found []tracker.Resource
+	if pools, err := ListZpools(); err == nil {
+		for _, pool := range pools {
+			if strings.HasPrefix(pool, prefix) {
+				found = append(found, tracker.Resource{Kind: KindZpool, Args: []string{pool}})
+			}
+		}
+	}
+	return found
+}
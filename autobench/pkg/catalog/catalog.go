@@ -0,0 +1,267 @@
+// Package catalog keeps guest and EVE images in a local cache dir. Every
+// image is stored once under its sha256 digest and found by name.
+package catalog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of catalog images
+const (
+	KindGuest = "guest" // boot image of qemu target guests
+	KindEve   = "eve"   // EVE live or installer image for the eve target
+)
+
+// Kinds lists the image kinds
+var Kinds = []string{KindGuest, KindEve}
+
+// Entry describes one image of the catalog
+type Entry struct {
+	Name     string    `json:"name"`
+	Kind     string    `json:"kind"`
+	Digest   string    `json:"digest"` // sha256:<hex>
+	Size     int64     `json:"size"`
+	Format   string    `json:"format,omitempty"`
+	OS       string    `json:"os,omitempty"`
+	Arch     string    `json:"arch,omitempty"`
+	Kernel   string    `json:"kernel,omitempty"`
+	Fio      string    `json:"fio,omitempty"`
+	Source   string    `json:"source,omitempty"` // file it was imported from
+	Imported time.Time `json:"imported"`
+}
+
+// Catalog is the index of a cache dir
+type Catalog struct {
+	dir     string
+	Entries []Entry `json:"images"`
+}
+
+// DefaultDir returns $XDG_CACHE_HOME/autobench or ~/.cache/autobench
+func DefaultDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "autobench")
+	}
+	return filepath.Join(os.TempDir(), "autobench-cache")
+}
+
+// Open reads the catalog of dir, a missing catalog is empty
+func Open(dir string) (*Catalog, error) {
+	c := &Catalog{dir: dir}
+	data, err := ioutil.ReadFile(c.indexPath())
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", c.indexPath(), err)
+	}
+	return c, nil
+}
+
+// Dir returns the cache dir
+func (c *Catalog) Dir() string {
+	return c.dir
+}
+
+func (c *Catalog) indexPath() string {
+	return filepath.Join(c.dir, "catalog.json")
+}
+
+// BlobPath returns the stored file of a digest
+func (c *Catalog) BlobPath(digest string) string {
+	return filepath.Join(c.dir, "blobs", "sha256", digest[len("sha256:"):])
+}
+
+// save writes the index through a temporary file
+func (c *Catalog) save() error {
+	sort.Slice(c.Entries, func(i, j int) bool { return c.Entries[i].Name < c.Entries[j].Name })
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.indexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.indexPath())
+}
+
+// Lookup returns the entry of an image and the path of its file
+func (c *Catalog) Lookup(name string) (Entry, string, error) {
+	for _, e := range c.Entries {
+		if e.Name == name {
+			return e, c.BlobPath(e.Digest), nil
+		}
+	}
+	return Entry{}, "", fmt.Errorf("image %s is not in the catalog %s", name, c.dir)
+}
+
+// FileDigest returns the sha256 digest of a file
+func FileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("could not hash %s: %w", path, err)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Import copies src into the cache and records it as e.Name, an image
+// of the same name is replaced. Name, Kind and the metadata come from e.
+func (c *Catalog) Import(src string, e Entry) (Entry, error) {
+	if e.Name == "" {
+		return e, fmt.Errorf("image name is empty")
+	}
+	blobs := filepath.Join(c.dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return e, err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return e, err
+	}
+	defer in.Close()
+	tmp, err := ioutil.TempFile(blobs, importPrefix)
+	if err != nil {
+		return e, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), in)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return e, fmt.Errorf("could not copy %s: %w", src, err)
+	}
+
+	e.Digest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	e.Size = size
+	e.Imported = time.Now().UTC()
+	if abs, err := filepath.Abs(src); err == nil {
+		e.Source = abs
+	}
+	// blobs are shared by images with the same content and never written
+	if _, err := os.Stat(c.BlobPath(e.Digest)); os.IsNotExist(err) {
+		if err := os.Chmod(tmp.Name(), 0444); err != nil {
+			return e, err
+		}
+		if err := os.Rename(tmp.Name(), c.BlobPath(e.Digest)); err != nil {
+			return e, err
+		}
+	}
+
+	var old []Entry
+	for _, x := range c.Entries {
+		if x.Name != e.Name {
+			old = append(old, x)
+		}
+	}
+	c.Entries = append(old, e)
+	if err := c.save(); err != nil {
+		return e, err
+	}
+	return e, c.prune()
+}
+
+// Remove drops an image from the catalog, its file goes away with the
+// last image that refers to it
+func (c *Catalog) Remove(name string) error {
+	if _, _, err := c.Lookup(name); err != nil {
+		return err
+	}
+	var left []Entry
+	for _, e := range c.Entries {
+		if e.Name != name {
+			left = append(left, e)
+		}
+	}
+	c.Entries = left
+	if err := c.save(); err != nil {
+		return err
+	}
+	return c.prune()
+}
+
+// importPrefix names the temp files of imports in the blob dir
+const importPrefix = "import-"
+
+// prune removes blobs no image refers to, imports in progress are left alone
+func (c *Catalog) prune() error {
+	used := map[string]bool{}
+	for _, e := range c.Entries {
+		used[filepath.Base(c.BlobPath(e.Digest))] = true
+	}
+	files, err := ioutil.ReadDir(filepath.Join(c.dir, "blobs", "sha256"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		// Files being imported are not in the catalog yet
+		if !used[f.Name()] && !f.IsDir() && !strings.HasPrefix(f.Name(), importPrefix) {
+			if err := os.Remove(filepath.Join(c.dir, "blobs", "sha256", f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Verify rehashes the file of an image and compares it with the catalog
+func (c *Catalog) Verify(name string) error {
+	e, path, err := c.Lookup(name)
+	if err != nil {
+		return err
+	}
+	digest, err := FileDigest(path)
+	if err != nil {
+		return err
+	}
+	if digest != e.Digest {
+		return fmt.Errorf("image %s is corrupted: %s has %s, the catalog says %s", name, path, digest, e.Digest)
+	}
+	return nil
+}
+
+// Checkout copies a verified image to dest, for tools that write next to
+// their image files
+func (c *Catalog) Checkout(name, dest string) error {
+	if err := c.Verify(name); err != nil {
+		return err
+	}
+	_, path, _ := c.Lookup(name)
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("could not copy %s to %s: %w", name, dest, err)
+	}
+	return out.Close()
+}
@@ -11,6 +11,11 @@ import (
 	"math"
 
 	"os"
+	"strings"
+	"time"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/iolog"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
 )
 
 type LatNS struct {
@@ -37,6 +42,8 @@ type fioJSON struct {
 			NumJobs string `json:"numjobs"`
 			BwLog	string `json:"write_bw_log"`
 			IOPSLog	string `json:"write_iops_log"`
+			Rate     string `json:"rate"`
+			RateIOPS string `json:"rate_iops"`
 		} `json:"job options"`
 		Read struct {
 			BW       int     `json:"bw"`
@@ -70,6 +77,17 @@ type fioJSON struct {
 			BWMax    int     `json:"bw_max"`
 			BWMean   float64 `json:"bw_mean"`
 		} `json:"write"`
+		Trim struct {
+			BW       int     `json:"bw"`
+			Iops     float64 `json:"iops"`
+			IoKbs    int     `json:"io_kbytes"`
+			TotalIos int     `json:"total_ios"`
+			ClatNS   LatNS   `json:"clat_ns"`
+		} `json:"trim"`
+		Sync struct {
+			TotalIos int   `json:"total_ios"`
+			LatNS    LatNS `json:"lat_ns"`
+		} `json:"sync"`
 		JobRuntime        int     `json:"job_runtime"`
 		UsrCPU            float64 `json:"usr_cpu"`
 		SysCPU            float64 `json:"sys_cpu"`
@@ -113,7 +131,7 @@ func formatCSV(in fioJSON, to io.Writer) error {
 		"Group ID", "Pattern", "Block Size", "IO Depth", "Jobs",
 		"MB/s", "BWMim (KiB/s)", "BWMax (KiB/s)", "IOPS min", "IOPS max",
 		"Latency Min (ms)", "Latency Max (ms)", "Latency stddev (ms)",
-		"cLatency p99 (ms)",
+		"cLatency p99 (ms)", "IOPS", "Rate", "Latency Target (ms)", "Latency Depth",
 	}
 
 	var w = csv.NewWriter(to)
@@ -122,6 +140,9 @@ func formatCSV(in fioJSON, to io.Writer) error {
 	}
 
 	for _, v := range in.Jobs {
+		if strings.HasPrefix(v.TestName, mkconfig.ProfilePrefix) || v.TestName == mkconfig.ReplayJob {
+			continue
+		}
 		var bw = v.Write.BW
 		var bwMin = v.Write.BWMin
 		var bwMax = v.Write.BWMax
@@ -143,6 +164,12 @@ func formatCSV(in fioJSON, to io.Writer) error {
 			latNsStdDev = v.Read.LatNS.Stddev / 1000000
 			cLatNsPercent = float64(v.Read.ClatNS.Percentile["99.000000"]) / 1000000
 		}
+		// Mixed jobs report both sides, the bandwidth adds up and the
+		// latency is the worse side
+		if v.TestOption.RW == "rw" || v.TestOption.RW == "randrw" {
+			bw = v.Read.BW + v.Write.BW
+			cLatNsPercent = math.Max(cLatNsPercent, float64(v.Read.ClatNS.Percentile["99.000000"])/1000000)
+		}
 		var row = []string{
 			fmt.Sprintf("%v", v.GroupID),
 			v.TestOption.RW,
@@ -158,7 +185,15 @@ func formatCSV(in fioJSON, to io.Writer) error {
 			fmt.Sprintf("%.2f", latNsMax),
 			fmt.Sprintf("%.2f", latNsStdDev),
 			fmt.Sprintf("%.2f", cLatNsPercent),
-
+			fmt.Sprintf("%.0f", v.Read.Iops+v.Write.Iops),
+			rateLabel(v.TestOption.Rate, v.TestOption.RateIOPS),
+			"",
+			"",
+		}
+		// Latency target jobs report the queue depth they settled on
+		if v.LatencyTarget != 0 {
+			row[16] = fmt.Sprintf("%.2f", float64(v.LatencyTarget)/1000)
+			row[17] = fmt.Sprintf("%d", v.LatencyDepth)
 		}
 		if err := w.Write(row); err != nil {
 			return err
@@ -169,6 +204,17 @@ func formatCSV(in fioJSON, to io.Writer) error {
 	return nil
 }
 
+// rateLabel names the rate point of a job, empty at full speed
+func rateLabel(rate, rateIOPS string) string {
+	if rate != "" {
+		return rate
+	}
+	if rateIOPS != "" {
+		return rateIOPS + "iops"
+	}
+	return ""
+}
+
 func cleanJSON(in []byte) ([]byte, error) {
 	var begin = bytes.IndexAny(in, "{")
 	var end = bytes.LastIndexAny(in, "}") + 1
@@ -205,3 +251,226 @@ func ConvertJSONtoCSV(inputPath, outputPath string) error {
 
 	return nil
 }
+
+// JobSummary is the throughput and tail latency of one fio job, the read
+// and write sides added up
+type JobSummary struct {
+	Name   string
+	BWKiBs int
+	IOPS   float64
+	P99Ms  float64 // the higher clat p99 of read and write
+	MeanMs float64 // the higher clat mean of read and write
+}
+
+// Summarize reads the jobs of a fio JSON result
+func Summarize(inputPath string) ([]JobSummary, error) {
+	data, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file [%s]: %w", inputPath, err)
+	}
+	text, err := cleanJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not clean JSON: %w", err)
+	}
+	obj, err := parseJSON(text)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse JSON: %w", err)
+	}
+
+	var out []JobSummary
+	for _, v := range obj.Jobs {
+		p99 := math.Max(float64(v.Read.ClatNS.Percentile["99.000000"]), float64(v.Write.ClatNS.Percentile["99.000000"]))
+		out = append(out, JobSummary{
+			Name:   v.TestName,
+			BWKiBs: v.Read.BW + v.Write.BW,
+			IOPS:   v.Read.Iops + v.Write.Iops,
+			P99Ms:  p99 / 1000000,
+			MeanMs: math.Max(v.Read.ClatNS.Mean, v.Write.ClatNS.Mean) / 1000000,
+		})
+	}
+	return out, nil
+}
+
+// TrimSummary is what the trims of a fio JSON result did
+type TrimSummary struct {
+	IOs    int
+	KiB    int64
+	BWKiBs int
+	IOPS   float64
+	P50Ms  float64
+	P99Ms  float64
+	MaxMs  float64
+}
+
+// SummarizeTrim adds up the trims of all jobs of a fio JSON result, the
+// latencies are those of the slowest job
+func SummarizeTrim(inputPath string) (TrimSummary, error) {
+	var sum TrimSummary
+	data, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		return sum, fmt.Errorf("could not read file [%s]: %w", inputPath, err)
+	}
+	text, err := cleanJSON(data)
+	if err != nil {
+		return sum, fmt.Errorf("could not clean JSON: %w", err)
+	}
+	obj, err := parseJSON(text)
+	if err != nil {
+		return sum, fmt.Errorf("could not parse JSON: %w", err)
+	}
+	ms := func(ns int64) float64 { return float64(ns) / 1000000 }
+	for _, v := range obj.Jobs {
+		t := v.Trim
+		if t.TotalIos == 0 {
+			continue
+		}
+		sum.IOs += t.TotalIos
+		sum.KiB += int64(t.IoKbs)
+		sum.BWKiBs += t.BW
+		sum.IOPS += t.Iops
+		sum.P50Ms = math.Max(sum.P50Ms, ms(t.ClatNS.Percentile["50.000000"]))
+		sum.P99Ms = math.Max(sum.P99Ms, ms(t.ClatNS.Percentile["99.000000"]))
+		sum.MaxMs = math.Max(sum.MaxMs, ms(t.ClatNS.Max))
+	}
+	if sum.IOs == 0 {
+		return sum, fmt.Errorf("no trims in %s", inputPath)
+	}
+	return sum, nil
+}
+
+// ConvertProfiles writes a row per workload profile of a fio JSON result
+// to outputPath. It returns false and writes nothing without profiles.
+func ConvertProfiles(inputPath, outputPath string) (bool, error) {
+	data, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		return false, fmt.Errorf("could not read file [%s]: %w", inputPath, err)
+	}
+	text, err := cleanJSON(data)
+	if err != nil {
+		return false, fmt.Errorf("could not clean JSON: %w", err)
+	}
+	obj, err := parseJSON(text)
+	if err != nil {
+		return false, fmt.Errorf("could not parse JSON: %w", err)
+	}
+
+	var rows [][]string
+	ms := func(ns int64) string { return fmt.Sprintf("%.2f", float64(ns)/1000000) }
+	for _, v := range obj.Jobs {
+		if !strings.HasPrefix(v.TestName, mkconfig.ProfilePrefix) {
+			continue
+		}
+		// Jobs of a profile are one group, reported under the first job
+		name := strings.TrimPrefix(v.TestName, mkconfig.ProfilePrefix)
+		if i := strings.Index(name, "."); i >= 0 {
+			name = name[:i]
+		}
+		rows = append(rows, []string{
+			name,
+			fmt.Sprintf("%.2f", mbps(v.Read.BW)),
+			fmt.Sprintf("%.2f", mbps(v.Write.BW)),
+			fmt.Sprintf("%.0f", v.Read.Iops),
+			fmt.Sprintf("%.0f", v.Write.Iops),
+			ms(v.Read.ClatNS.Percentile["99.000000"]),
+			ms(v.Write.ClatNS.Percentile["99.000000"]),
+			fmt.Sprintf("%d", v.Sync.TotalIos),
+			ms(v.Sync.LatNS.Percentile["99.000000"]),
+		})
+	}
+	if len(rows) == 0 {
+		return false, nil
+	}
+
+	fd, err := os.Create(outputPath)
+	if err != nil {
+		return false, fmt.Errorf("could not create CSV file [%s]: %w", outputPath, err)
+	}
+	defer fd.Close()
+	w := csv.NewWriter(fd)
+	w.Write([]string{
+		"Profile", "Read MB/s", "Write MB/s", "Read IOPS", "Write IOPS",
+		"Read cLatency p99 (ms)", "Write cLatency p99 (ms)", "Syncs", "Sync Latency p99 (ms)",
+	})
+	w.WriteAll(rows)
+	return true, w.Error()
+}
+
+// ConvertReplay writes the replay fidelity of a fio JSON result to
+// outputPath: the IOs and time recorded in the trace of replay against
+// what the replay achieved, with the usual bandwidth and latency. It
+// returns false and writes nothing without a replay job.
+func ConvertReplay(inputPath, outputPath string, replay *mkconfig.Replay) (bool, error) {
+	data, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		return false, fmt.Errorf("could not read file [%s]: %w", inputPath, err)
+	}
+	text, err := cleanJSON(data)
+	if err != nil {
+		return false, fmt.Errorf("could not clean JSON: %w", err)
+	}
+	obj, err := parseJSON(text)
+	if err != nil {
+		return false, fmt.Errorf("could not parse JSON: %w", err)
+	}
+	info, err := iolog.Inspect(replay.Source)
+	if err != nil {
+		return false, fmt.Errorf("could not read trace [%s]: %w", replay.Source, err)
+	}
+
+	var rows [][]string
+	ms := func(ns int64) string { return fmt.Sprintf("%.2f", float64(ns)/1000000) }
+	for _, v := range obj.Jobs {
+		if v.TestName != mkconfig.ReplayJob {
+			continue
+		}
+		scale := replay.TimeScale
+		if scale == 0 {
+			scale = 100
+		}
+		// Timing is only known for traces with timestamps, the ratio
+		// is the replay time over the expected one, 1 is faithful
+		expected := info.Duration * 100 / time.Duration(scale)
+		achieved := time.Duration(v.JobRuntime) * time.Millisecond
+		var recordedS, expectedS, ratio string
+		if info.Duration != 0 {
+			recordedS = fmt.Sprintf("%.2f", info.Duration.Seconds())
+			expectedS = fmt.Sprintf("%.2f", expected.Seconds())
+			ratio = fmt.Sprintf("%.3f", achieved.Seconds()/expected.Seconds())
+		}
+		replayed := v.Read.TotalIos + v.Write.TotalIos
+		rows = append(rows, []string{
+			replay.Source,
+			info.Format,
+			fmt.Sprintf("%d", info.IOs),
+			fmt.Sprintf("%d", replayed),
+			recordedS,
+			expectedS,
+			fmt.Sprintf("%.2f", achieved.Seconds()),
+			ratio,
+			fmt.Sprintf("%.2f", mbps(v.Read.BW)),
+			fmt.Sprintf("%.2f", mbps(v.Write.BW)),
+			fmt.Sprintf("%.0f", v.Read.Iops),
+			fmt.Sprintf("%.0f", v.Write.Iops),
+			ms(v.Read.ClatNS.Percentile["99.000000"]),
+			ms(v.Write.ClatNS.Percentile["99.000000"]),
+		})
+	}
+	if len(rows) == 0 {
+		return false, nil
+	}
+
+	fd, err := os.Create(outputPath)
+	if err != nil {
+		return false, fmt.Errorf("could not create CSV file [%s]: %w", outputPath, err)
+	}
+	defer fd.Close()
+	w := csv.NewWriter(fd)
+	w.Write([]string{
+		"Trace", "Format", "Recorded IOs", "Replayed IOs",
+		"Recorded Time (s)", "Expected Time (s)", "Replay Time (s)", "Timing Ratio",
+		"Read MB/s", "Write MB/s", "Read IOPS", "Write IOPS",
+		"Read cLatency p99 (ms)", "Write cLatency p99 (ms)",
+	})
+	w.WriteAll(rows)
+	return true, w.Error()
+}
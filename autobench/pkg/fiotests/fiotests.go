@@ -138,23 +138,31 @@ func GetCPUdump(timeSecondsForOneTest int, dirForResults string, countTests int)
 	return nil
 }
 
-func RunFIOTest(client *ssh.Client, sshUser, localResultsFolder, localDirResults, targetDevice string, fioOptions mkconfig.FioOptions, fioTestTime time.Duration) error {
-	curentDate := fmt.Sprintf(time.Now().Format("2006-01-02-15:04:05"))
-
+// ResultsDir returns localDirResults, or creates a dated dir named after
+// localResultsFolder next to the executable when it is empty
+func ResultsDir(localResultsFolder, localDirResults string) (string, error) {
+	if localDirResults != "" {
+		return localDirResults, nil
+	}
 	ex, err := os.Executable()
 	if err != nil {
-		return fmt.Errorf("could not get executable path: %w", err)
+		return "", fmt.Errorf("could not get executable path: %w", err)
+	}
+	curentDate := time.Now().Format("2006-01-02-15:04:05")
+	dir := filepath.Join(filepath.Dir(ex), localResultsFolder+curentDate)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", fmt.Errorf("could not create local dir for result: %w", err)
 	}
-	exPath := filepath.Dir(ex)
+	return dir, nil
+}
+
+func RunFIOTest(client *ssh.Client, sshUser, localResultsFolder, localDirResults, targetDevice string, fioOptions mkconfig.FioOptions, fioTestTime time.Duration) error {
+	curentDate := fmt.Sprintf(time.Now().Format("2006-01-02-15:04:05"))
 
 	// Create folder for results
-	localResultsAbsDir := localDirResults
-	if localResultsAbsDir == "" {
-		localResultsAbsDir = filepath.Join(exPath, localResultsFolder + curentDate)
-		err = os.Mkdir(localResultsAbsDir, 0755)
-		if err != nil {
-			return fmt.Errorf("could not create local dir for result: %w", err)
-		}
+	localResultsAbsDir, err := ResultsDir(localResultsFolder, localDirResults)
+	if err != nil {
+		return err
 	}
 
 	// Check FIO tools on VM
@@ -188,6 +196,11 @@ func RunFIOTest(client *ssh.Client, sshUser, localResultsFolder, localDirResults
 		return fmt.Errorf("could not create remote dir for log-result: %w", err)
 	}
 
+	fioOptions, err = uploadReplay(client, fioOptions, remoteResultsAbsDir)
+	if err != nil {
+		return err
+	}
+
 	// Create config for fio
 	localFioConfig := filepath.Join(localResultsAbsDir, "fio_config.cfg")
 	if err := mkconfig.GenerateFIOConfig(
@@ -232,31 +245,8 @@ func RunFIOTest(client *ssh.Client, sshUser, localResultsFolder, localDirResults
 		}
 	}()
 
-	// Heartbeat
-	timerTomeOut := time.After(totalTime)
-	ticker := time.NewTicker(90 * time.Second)
-	defer ticker.Stop()
-
-	there:
-	for {
-		select {
-		case <-timerTomeOut:
-			ticker.Stop()
-			break there
-		case <- ticker.C:
-			if err := sshwork.SendCommandSSH(client, "pgrep fio", true); err != nil {
-				return fmt.Errorf("VM is fail. Test failed FIO process on VM not found")
-			}
-			fmt.Println("Checking... Nothing broken yet. Let's wait a bit. ")
-		}
-	}
-
-	for i := 0; i < 60; i++ {
-		if err := sshwork.SendCommandSSH(client, "pgrep fio", true); err != nil {
-			break
-		}
-		fmt.Println("Waiting...")
-		time.Sleep(5 * time.Second)
+	if err := waitFIO(client, totalTime); err != nil {
+		return err
 	}
 
 	// Download fio reults
@@ -301,6 +291,59 @@ func RunFIOTest(client *ssh.Client, sshUser, localResultsFolder, localDirResults
 		}
 	}
 
+	collectHostInfo(localResultsAbsDir)
+
+	if err := fioconv.ConvertJSONtoCSV(
+		filepath.Join(localResultsAbsDir, "/result.json"),
+		filepath.Join(localResultsAbsDir, "/FIOresult.csv"),
+	); err != nil {
+		fmt.Println("Attention! Could not convert JSON to CSV:", err)
+	}
+	if _, err := fioconv.ConvertProfiles(
+		filepath.Join(localResultsAbsDir, "/result.json"),
+		filepath.Join(localResultsAbsDir, "/FIOprofiles.csv"),
+	); err != nil {
+		fmt.Println("Attention! Could not convert profiles to CSV:", err)
+	}
+	convertReplay(fioOptions, localResultsAbsDir)
+
+	return nil
+}
+
+// waitFIO waits for the fio run of the guest to finish
+func waitFIO(client *ssh.Client, totalTime time.Duration) error {
+	// Heartbeat
+	timerTomeOut := time.After(totalTime)
+	ticker := time.NewTicker(90 * time.Second)
+	defer ticker.Stop()
+
+	there:
+	for {
+		select {
+		case <-timerTomeOut:
+			ticker.Stop()
+			break there
+		case <- ticker.C:
+			if err := sshwork.SendCommandSSH(client, "pgrep fio", true); err != nil {
+				return fmt.Errorf("VM is fail. Test failed FIO process on VM not found")
+			}
+			fmt.Println("Checking... Nothing broken yet. Let's wait a bit. ")
+		}
+	}
+
+	for i := 0; i < 60; i++ {
+		if err := sshwork.SendCommandSSH(client, "pgrep fio", true); err != nil {
+			break
+		}
+		fmt.Println("Waiting...")
+		time.Sleep(5 * time.Second)
+	}
+
+	return nil
+}
+
+// collectHostInfo saves the host dmesg and hardware description
+func collectHostInfo(localResultsAbsDir string) {
 	// Save local dmesg file
 	out, err := exec.Command("cp", "/var/log/dmesg",
 							filepath.Join(localResultsAbsDir, "/host_dmesg"),
@@ -322,35 +365,84 @@ func RunFIOTest(client *ssh.Client, sshUser, localResultsFolder, localDirResults
     	defer file.Close()
     	file.WriteString(string(output))
 	}
+}
+
+// RunFIOTestShared runs the fio matrix like RunFIOTest, but the job file,
+// logs and results go through a directory shared with the guest instead of
+// SFTP: localDir on the host is mounted at guestDir in the guest
+func RunFIOTestShared(client *ssh.Client, sshUser, localDir, guestDir, targetDevice string, fioOptions mkconfig.FioOptions, fioTestTime time.Duration) error {
+	if err := sshwork.SendCommandSSH(client, "fio -h", true); err != nil {
+		return fmt.Errorf("FIO tools not found on VM: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(localDir, "logs"), 0777); err != nil {
+		return fmt.Errorf("could not create dir for log-result: %w", err)
+	}
+	fioOptions, err := shareReplay(fioOptions, localDir, guestDir)
+	if err != nil {
+		return err
+	}
+
+	if err := mkconfig.GenerateFIOConfig(
+		fioOptions,
+		fioTestTime,
+		filepath.Join(localDir, "fio_config.cfg"),
+		sshUser,
+		targetDevice,
+		filepath.Join(guestDir, "logs"),
+	); err != nil {
+		return fmt.Errorf("create fio config failed: %w", err)
+	}
+
+	var countTests = mkconfig.CountTests(fioOptions)
+	const bufferTime = 60 * time.Second
+	var totalTime = time.Duration(int64(countTests)*int64(fioTestTime) + int64(bufferTime))
+
+	go GetMemoryDump(int(fioTestTime.Seconds()), localDir, countTests)
+	go GetCPUdump(int(fioTestTime.Seconds()), localDir, countTests)
+
+	fioRunCmd := fmt.Sprintf(
+		"sudo fio %s --output-format=normal,json --output=%s & ",
+		filepath.Join(guestDir, "fio_config.cfg"),
+		filepath.Join(guestDir, "result.json"),
+	)
+	go func() {
+		if err := sshwork.SendCommandSSH(client, fioRunCmd, true); err != nil {
+			fmt.Println("FIO test failed (maybe we need sudo):", err)
+		}
+	}()
+
+	if err := waitFIO(client, totalTime); err != nil {
+		return err
+	}
+
+	if err := sshwork.SendCommandSSH(client,
+		fmt.Sprintf("sudo sh -c 'dmesg > %s; sync'", filepath.Join(guestDir, "guest_dmesg")), true); err != nil {
+		fmt.Println("could not get dmesg of VM: ", err)
+	}
+	collectHostInfo(localDir)
 
 	if err := fioconv.ConvertJSONtoCSV(
-		filepath.Join(localResultsAbsDir, "/result.json"),
-		filepath.Join(localResultsAbsDir, "/FIOresult.csv"),
+		filepath.Join(localDir, "result.json"),
+		filepath.Join(localDir, "FIOresult.csv"),
 	); err != nil {
 		fmt.Println("Attention! Could not convert JSON to CSV:", err)
 	}
-
+	if _, err := fioconv.ConvertProfiles(
+		filepath.Join(localDir, "result.json"),
+		filepath.Join(localDir, "FIOprofiles.csv"),
+	); err != nil {
+		fmt.Println("Attention! Could not convert profiles to CSV:", err)
+	}
+	convertReplay(fioOptions, localDir)
 	return nil
 }
 
 func RunFIOTestLocal(user, localResultsFolder, localDirResults, targetDevice string,
 					fioOptions mkconfig.FioOptions, fioTestTime time.Duration) error {
-	curentDate := fmt.Sprintf(time.Now().Format("2006-01-02-15:04:05"))
-
-	ex, err := os.Executable()
-	if err != nil {
-		return fmt.Errorf("could not get executable path: %w", err)
-	}
-	exPath := filepath.Dir(ex)
-
 	// Create folder for results
-	localResultsAbsDir := localDirResults
-	if localResultsAbsDir == "" {
-		localResultsAbsDir = filepath.Join(exPath, localResultsFolder + curentDate)
-		err = os.Mkdir(localResultsAbsDir, 0755)
-		if err != nil {
-			return fmt.Errorf("could not create local dir for result: %w", err)
-		}
+	localResultsAbsDir, err := ResultsDir(localResultsFolder, localDirResults)
+	if err != nil {
+		return err
 	}
 
 	localResultsAbsDirLogs := filepath.Join(localResultsAbsDir, "logs")
@@ -361,7 +453,9 @@ func RunFIOTestLocal(user, localResultsFolder, localDirResults, targetDevice str
 
 	// Create config for fio
 	localFioConfig := filepath.Join(localResultsAbsDir, "fio_config.cfg")
-	mkconfig.GenerateFIOConfig(fioOptions, fioTestTime, localFioConfig, user, targetDevice, localResultsAbsDirLogs)
+	if err := mkconfig.GenerateFIOConfig(fioOptions, fioTestTime, localFioConfig, user, targetDevice, localResultsAbsDirLogs); err != nil {
+		return fmt.Errorf("create fio config failed: %w", err)
+	}
 
 	// Waiting end fio test
 	var countTests = mkconfig.CountTests(fioOptions)
@@ -432,6 +526,13 @@ func RunFIOTestLocal(user, localResultsFolder, localDirResults, targetDevice str
 	); err != nil {
 		fmt.Println("Attention! Could not convert JSON to CSV: %w", err)
 	}
+	if _, err := fioconv.ConvertProfiles(
+		filepath.Join(localResultsAbsDir, "/result.json"),
+		filepath.Join(localResultsAbsDir, "/FIOprofiles.csv"),
+	); err != nil {
+		fmt.Println("Attention! Could not convert profiles to CSV:", err)
+	}
+	convertReplay(fioOptions, localResultsAbsDir)
 
 	fmt.Println("Tests finished!")
 	return nil
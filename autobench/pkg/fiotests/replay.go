@@ -0,0 +1,71 @@
+package fiotests
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/fioconv"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/sshwork"
+	"golang.org/x/crypto/ssh"
+)
+
+// uploadReplay sends the trace to replay into remoteDir of the VM and
+// returns the options that point fio at the copy
+func uploadReplay(client *ssh.Client, fioOptions mkconfig.FioOptions, remoteDir string) (mkconfig.FioOptions, error) {
+	if fioOptions.Replay == nil {
+		return fioOptions, nil
+	}
+	replay := *fioOptions.Replay
+	replay.Path = filepath.Join(remoteDir, filepath.Base(replay.Source))
+	if err := sshwork.SendFileSCP(client, replay.Source, replay.Path); err != nil {
+		return fioOptions, fmt.Errorf("could not send trace %s to VM: %w", replay.Source, err)
+	}
+	fioOptions.Replay = &replay
+	return fioOptions, nil
+}
+
+// shareReplay copies the trace to replay into localDir, which the guest
+// sees as guestDir, and returns the options that point fio at the copy
+func shareReplay(fioOptions mkconfig.FioOptions, localDir, guestDir string) (mkconfig.FioOptions, error) {
+	if fioOptions.Replay == nil {
+		return fioOptions, nil
+	}
+	replay := *fioOptions.Replay
+	name := filepath.Base(replay.Source)
+	in, err := os.Open(replay.Source)
+	if err != nil {
+		return fioOptions, err
+	}
+	defer in.Close()
+	out, err := os.Create(filepath.Join(localDir, name))
+	if err != nil {
+		return fioOptions, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fioOptions, fmt.Errorf("could not copy trace %s: %w", replay.Source, err)
+	}
+	if err := out.Close(); err != nil {
+		return fioOptions, err
+	}
+	replay.Path = filepath.Join(guestDir, name)
+	fioOptions.Replay = &replay
+	return fioOptions, nil
+}
+
+// convertReplay writes FIOreplay.csv next to result.json for replay runs
+func convertReplay(fioOptions mkconfig.FioOptions, dir string) {
+	if fioOptions.Replay == nil {
+		return
+	}
+	if _, err := fioconv.ConvertReplay(
+		filepath.Join(dir, "result.json"),
+		filepath.Join(dir, "FIOreplay.csv"),
+		fioOptions.Replay,
+	); err != nil {
+		fmt.Println("Attention! Could not convert replay to CSV:", err)
+	}
+}
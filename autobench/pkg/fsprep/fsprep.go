@@ -0,0 +1,140 @@
+// Package fsprep formats and mounts the test device for file based fio
+// jobs, on the host or in a guest over SSH.
+package fsprep
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/sshwork"
+	"golang.org/x/crypto/ssh"
+)
+
+// Types are the filesystems the test device can be formatted with
+var Types = []string{"ext4", "xfs", "btrfs", "f2fs"}
+
+// Packages provide the mkfs of every type on Debian and Ubuntu guests
+var Packages = map[string]string{
+	"ext4":  "e2fsprogs",
+	"xfs":   "xfsprogs",
+	"btrfs": "btrfs-progs",
+	"f2fs":  "f2fs-tools",
+}
+
+// force makes mkfs overwrite an existing filesystem
+var force = map[string]string{
+	"ext4":  "-F",
+	"xfs":   "-f",
+	"btrfs": "-f",
+	"f2fs":  "-f",
+}
+
+// Config is how the filesystem is made and mounted
+type Config struct {
+	Type      string `json:"type"`
+	MkfsOpts  string `json:"mkfs_options,omitempty"`
+	MountOpts string `json:"mount_options,omitempty"`
+}
+
+// Record is the filesystem as it was set up on the device
+type Record struct {
+	Config
+	Device      string `json:"device"`
+	MountPoint  string `json:"mount_point"`
+	Mkfs        string `json:"mkfs"`
+	MkfsVersion string `json:"mkfs_version,omitempty"`
+	Mounted     string `json:"mounted_options"` // as the kernel reports them
+	AvailBytes  int64  `json:"avail_bytes"`     // free space after mount
+}
+
+// Runner runs a command as root on the machine that has the device
+type Runner func(cmd string) (string, error)
+
+// Local runs commands on the host, autobench itself runs as root there
+func Local(cmd string) (string, error) {
+	out, err := exec.Command("sh", "-c", cmd).CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("%s failed err:[%w] output:[%s]", cmd, err, out)
+	}
+	return string(out), nil
+}
+
+// SSH runs commands with sudo on the machine of client
+func SSH(client *ssh.Client) Runner {
+	return func(cmd string) (string, error) {
+		out, err := sshwork.GetCommandOutputSSH(client, "sudo "+cmd)
+		if err != nil {
+			return out, fmt.Errorf("%w output:[%s]", err, out)
+		}
+		return out, nil
+	}
+}
+
+// Check validates the type of c
+func (c Config) Check() error {
+	if _, ok := force[c.Type]; !ok {
+		return fmt.Errorf("invalid filesystem: %s\n\tUse something from this list: %v", c.Type, Types)
+	}
+	return nil
+}
+
+// Prepare formats dev with c and mounts it on dir, whatever was on dev or
+// mounted on dir before is gone
+func Prepare(run Runner, c Config, dev, dir string) (*Record, error) {
+	if err := c.Check(); err != nil {
+		return nil, err
+	}
+	rec := &Record{Config: c, Device: dev, MountPoint: dir}
+	run("umount " + dir)
+	if _, err := run("wipefs -a " + dev); err != nil {
+		return nil, err
+	}
+	rec.Mkfs = strings.Join(strings.Fields(fmt.Sprintf("mkfs.%s %s %s %s", c.Type, force[c.Type], c.MkfsOpts, dev)), " ")
+	if _, err := run(rec.Mkfs); err != nil {
+		return nil, fmt.Errorf("mkfs failed: %w", err)
+	}
+	// Every mkfs prints its version with -V, mkfs.btrfs with --version
+	version := "-V"
+	if c.Type == "btrfs" {
+		version = "--version"
+	}
+	if out, err := run(fmt.Sprintf("mkfs.%s %s", c.Type, version)); err == nil {
+		rec.MkfsVersion = strings.TrimSpace(strings.SplitN(out, "\n", 2)[0])
+	}
+	if _, err := run("mkdir -p " + dir); err != nil {
+		return nil, err
+	}
+	mount := fmt.Sprintf("mount -t %s %s %s", c.Type, dev, dir)
+	if c.MountOpts != "" {
+		mount = fmt.Sprintf("mount -t %s -o %s %s %s", c.Type, c.MountOpts, dev, dir)
+	}
+	if _, err := run(mount); err != nil {
+		return nil, fmt.Errorf("mount failed: %w", err)
+	}
+	out, err := run("findmnt -no OPTIONS " + dir)
+	if err != nil {
+		return rec, err
+	}
+	rec.Mounted = strings.TrimSpace(out)
+	// df prints a header line and the available bytes
+	out, err = run("df -B1 --output=avail " + dir)
+	if err != nil {
+		return rec, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return rec, fmt.Errorf("no free space of %s in df output", dir)
+	}
+	if rec.AvailBytes, err = strconv.ParseInt(fields[len(fields)-1], 10, 64); err != nil {
+		return rec, fmt.Errorf("could not parse free space of %s: %w", dir, err)
+	}
+	return rec, nil
+}
+
+// Release unmounts dir
+func Release(run Runner, dir string) error {
+	_, err := run("umount " + dir)
+	return err
+}
@@ -0,0 +1,194 @@
+// Package iolog reads the recorded timing of fio iologs and blktrace
+// captures, and records new captures with blktrace.
+package iolog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of replayable traces
+const (
+	FormatBlktrace = "blktrace"
+	FormatIolog2   = "iolog2"
+	FormatIolog3   = "iolog3"
+)
+
+// Info is what a trace recorded
+type Info struct {
+	Format   string        `json:"format"`
+	IOs      int           `json:"ios"`
+	Reads    int           `json:"reads"`
+	Writes   int           `json:"writes"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration_ns"` // from the first to the last IO, 0 for iolog2
+}
+
+// blktrace events, see include/uapi/linux/blktrace_api.h
+const (
+	blkMagic      = 0x65617400
+	blkTraceSize  = 48
+	blkTAQueue    = 1       // __BLK_TA_QUEUE
+	blkTCRead     = 1 << 16 // BLK_TC_READ
+	blkTCWrite    = 1 << 17 // BLK_TC_WRITE
+	blkTCNotify   = 1 << 31 // BLK_TC_NOTIFY, not an IO
+	blkActionMask = 0xffff
+)
+
+// Inspect detects the format of a trace and sums up its IOs
+func Inspect(path string) (Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Info{}, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	head, err := r.Peek(4)
+	if err != nil {
+		return Info{}, fmt.Errorf("%s is too short for a trace: %w", path, err)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if order.Uint32(head)&0xffffff00 == blkMagic {
+			return inspectBlktrace(r, order)
+		}
+	}
+	line, _ := r.ReadString('\n')
+	switch strings.TrimSpace(line) {
+	case "fio version 2 iolog":
+		return inspectIolog(r, FormatIolog2)
+	case "fio version 3 iolog":
+		return inspectIolog(r, FormatIolog3)
+	}
+	return Info{}, fmt.Errorf("%s is neither a blktrace capture nor a fio iolog", path)
+}
+
+func inspectBlktrace(r io.Reader, order binary.ByteOrder) (Info, error) {
+	info := Info{Format: FormatBlktrace}
+	var first, last uint64
+	hdr := make([]byte, blkTraceSize)
+	for {
+		if _, err := io.ReadFull(r, hdr); err == io.EOF {
+			break
+		} else if err != nil {
+			return info, fmt.Errorf("truncated blktrace event: %w", err)
+		}
+		if order.Uint32(hdr[0:])&0xffffff00 != blkMagic {
+			return info, fmt.Errorf("bad blktrace magic after %d IOs", info.IOs)
+		}
+		t := order.Uint64(hdr[8:])
+		size := order.Uint32(hdr[24:])
+		action := order.Uint32(hdr[28:])
+		pdu := order.Uint16(hdr[46:])
+		if _, err := io.CopyN(io.Discard, r, int64(pdu)); err != nil {
+			return info, fmt.Errorf("truncated blktrace payload: %w", err)
+		}
+		if action&blkTCNotify != 0 || action&blkActionMask != blkTAQueue {
+			continue
+		}
+		if info.IOs == 0 || t < first {
+			first = t
+		}
+		if t > last {
+			last = t
+		}
+		info.IOs++
+		info.Bytes += int64(size)
+		switch {
+		case action&blkTCWrite != 0:
+			info.Writes++
+		case action&blkTCRead != 0:
+			info.Reads++
+		}
+	}
+	if info.IOs > 1 {
+		info.Duration = time.Duration(last - first)
+	}
+	return info, nil
+}
+
+// inspectIolog reads "[time] file action offset length" lines, v3 logs
+// start with a timestamp in milliseconds
+func inspectIolog(r *bufio.Reader, format string) (Info, error) {
+	info := Info{Format: format}
+	var first, last int64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if format == FormatIolog3 {
+			if len(f) == 0 {
+				continue
+			}
+			ts, err := strconv.ParseInt(f[0], 10, 64)
+			if err != nil {
+				return info, fmt.Errorf("bad iolog timestamp %q", f[0])
+			}
+			f = f[1:]
+			if len(f) == 4 {
+				if info.IOs == 0 {
+					first = ts
+				}
+				last = ts
+			}
+		}
+		// File actions (add, open, close) have no offset and length
+		if len(f) != 4 {
+			continue
+		}
+		length, err := strconv.ParseInt(f[3], 10, 64)
+		if err != nil {
+			return info, fmt.Errorf("bad iolog length %q", f[3])
+		}
+		switch f[1] {
+		case "read":
+			info.Reads++
+		case "write":
+			info.Writes++
+		default:
+			continue
+		}
+		info.IOs++
+		info.Bytes += length
+	}
+	info.Duration = time.Duration(last-first) * time.Millisecond
+	return info, scanner.Err()
+}
+
+// Capture records the IOs of dev for duration with blktrace and writes
+// them as one binary trace that fio can replay
+func Capture(dev string, duration time.Duration, out string) error {
+	for _, tool := range []string{"blktrace", "blkparse"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("%s not found, install blktrace", tool)
+		}
+	}
+	trace := exec.Command("blktrace", "-d", dev, "-w", strconv.Itoa(int(duration.Seconds())), "-o", "-")
+	parse := exec.Command("blkparse", "-q", "-i", "-", "-d", out, "-O")
+	pipe, err := trace.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	parse.Stdin = pipe
+	var traceErr, parseErr bytes.Buffer
+	trace.Stderr = &traceErr
+	parse.Stderr = &parseErr
+	if err := parse.Start(); err != nil {
+		return fmt.Errorf("blkparse failed: %w", err)
+	}
+	if err := trace.Run(); err != nil {
+		parse.Wait()
+		return fmt.Errorf("blktrace -d %s failed err:[%w] output:[%s]", dev, err, traceErr.String())
+	}
+	if err := parse.Wait(); err != nil {
+		return fmt.Errorf("blkparse failed err:[%w] output:[%s]", err, parseErr.String())
+	}
+	return nil
+}
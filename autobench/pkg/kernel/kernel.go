@@ -0,0 +1,176 @@
+// Package kernel identifies Linux kernel images by release and build ID
+package kernel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Info identifies a kernel
+type Info struct {
+	Image   string `json:"image"`             // bzImage passed to -kernel
+	Vmlinux string `json:"vmlinux,omitempty"` // ELF image of the same build, if found
+	Version string `json:"version"`           // banner of the bzImage header
+	Release string `json:"release"`           // first word of Version, as uname -r shows it
+	BuildID string `json:"build_id"`          // GNU build ID, or sha256:<hex> of the bzImage without vmlinux
+}
+
+// bzImagePaths are tried in a linux build tree
+var bzImagePaths = []string{"arch/x86/boot/bzImage", "arch/x86_64/boot/bzImage"}
+
+// Inspect identifies a bzImage or a linux build tree. The build ID is
+// read from vmlinux of the tree, a bare bzImage is identified by its hash.
+func Inspect(path string) (Info, error) {
+	var info Info
+	fi, err := os.Stat(path)
+	if err != nil {
+		return info, err
+	}
+	tree := ""
+	if fi.IsDir() {
+		tree = path
+		for _, p := range bzImagePaths {
+			if _, err := os.Stat(filepath.Join(tree, p)); err == nil {
+				info.Image = filepath.Join(tree, p)
+				break
+			}
+		}
+		if info.Image == "" {
+			return info, fmt.Errorf("no bzImage in %s, build the kernel first", path)
+		}
+	} else {
+		info.Image = path
+		// <tree>/arch/x86/boot/bzImage
+		tree = filepath.Join(filepath.Dir(path), "..", "..", "..")
+	}
+	if info.Image, err = filepath.Abs(info.Image); err != nil {
+		return info, err
+	}
+
+	if info.Version, err = bzImageVersion(info.Image); err != nil {
+		return info, err
+	}
+	fields := strings.Fields(info.Version)
+	if len(fields) == 0 {
+		return info, fmt.Errorf("%s has an empty version string", info.Image)
+	}
+	info.Release = fields[0]
+
+	vmlinux := filepath.Join(tree, "vmlinux")
+	if id, err := elfBuildID(vmlinux); err == nil && id != "" {
+		info.Vmlinux, _ = filepath.Abs(vmlinux)
+		info.BuildID = id
+		return info, nil
+	}
+	if info.BuildID, err = fileDigest(info.Image); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// bzImageVersion reads the kernel_version string of the x86 boot header
+func bzImageVersion(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, 0x210)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return "", fmt.Errorf("%s is not a bzImage: %w", path, err)
+	}
+	if string(hdr[0x202:0x206]) != "HdrS" {
+		return "", fmt.Errorf("%s is not a bzImage: no HdrS signature", path)
+	}
+	offset := int64(binary.LittleEndian.Uint16(hdr[0x20e:])) + 0x200
+	buf := make([]byte, 256)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if i := bytes.IndexByte(buf[:n], 0); i > 0 {
+		return string(buf[:i]), nil
+	}
+	return "", fmt.Errorf("%s has no kernel version string", path)
+}
+
+// parseNotes returns the GNU build ID of raw ELF notes
+func parseNotes(data []byte, order binary.ByteOrder) string {
+	const ntGNUBuildID = 3
+	for len(data) >= 12 {
+		namesz := int(order.Uint32(data[0:]))
+		descsz := int(order.Uint32(data[4:]))
+		typ := order.Uint32(data[8:])
+		data = data[12:]
+		nameEnd := (namesz + 3) &^ 3
+		descEnd := nameEnd + (descsz+3)&^3
+		if len(data) < nameEnd+descsz {
+			return ""
+		}
+		if typ == ntGNUBuildID && strings.TrimRight(string(data[:namesz]), "\x00") == "GNU" {
+			return hex.EncodeToString(data[nameEnd : nameEnd+descsz])
+		}
+		if len(data) < descEnd {
+			return ""
+		}
+		data = data[descEnd:]
+	}
+	return ""
+}
+
+func elfBuildID(path string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_NOTE {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			continue
+		}
+		if id := parseNotes(data, f.ByteOrder); id != "" {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+func fileDigest(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// Host identifies the running kernel by /proc and /sys/kernel/notes
+func Host() (Info, error) {
+	var info Info
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return info, err
+	}
+	info.Release = strings.TrimSpace(string(release))
+	if version, err := ioutil.ReadFile("/proc/version"); err == nil {
+		info.Version = strings.TrimSpace(string(version))
+	}
+	if notes, err := ioutil.ReadFile("/sys/kernel/notes"); err == nil {
+		info.BuildID = parseNotes(notes, binary.LittleEndian)
+	}
+	return info, nil
+}
@@ -0,0 +1,64 @@
+package lio
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// TunedAttribs are the backstore attributes that matter for performance.
+// The transfer size limit is optimal_sectors, hw_max_sectors is read-only.
+var TunedAttribs = []string{
+	"emulate_write_cache",
+	"queue_depth",
+	"block_size",
+	"emulate_tpu",
+	"emulate_tpws",
+	"max_unmap_lba_count",
+	"optimal_sectors",
+}
+
+func attribPath(b Backstore, name string) string {
+	return filepath.Join(b.Path(), "attrib", name)
+}
+
+// SetAttribs writes attrib/<name> of a backstore. block_size can only be
+// changed before the backstore is exported, so call it before AddLUN.
+func SetAttribs(b Backstore, attrs map[string]string) error {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := attribPath(b, name)
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("backstore %s has no attribute %s", b, name)
+		}
+		if err := writeAttrIfChanged(path, attrs[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadAttribs returns all attributes of a backstore
+func ReadAttribs(b Backstore) (map[string]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(b.Path(), "attrib"))
+	if err != nil {
+		return nil, fmt.Errorf("attributes of %s: %w", b, err)
+	}
+	attrs := map[string]string{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		// write-only attributes fail to read
+		if v, err := readAttr(filepath.Join(b.Path(), "attrib", e.Name())); err == nil {
+			attrs[e.Name()] = v
+		}
+	}
+	return attrs, nil
+}
@@ -0,0 +1,202 @@
+package lio
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Plugin is a backstore type of the LIO core
+type Plugin string
+
+const (
+	IBlock  Plugin = "iblock" // block device
+	FileIO  Plugin = "fileio" // file or block device through the VFS
+	RamDisk Plugin = "rd_mcp" // memory
+	User    Plugin = "user"   // tcm_user, handled by a userspace daemon such as tcmu-runner
+)
+
+// Plugins lists all backstore types
+var Plugins = []Plugin{IBlock, FileIO, RamDisk, User}
+
+// Backstore is a storage object of the LIO core, core/<plugin>_<hba>/<name>
+type Backstore struct {
+	Plugin Plugin
+	HBA    int
+	Name   string
+}
+
+// BackstoreConfig holds the creation parameters of a backstore
+type BackstoreConfig struct {
+	Dev        string // block device for iblock, file or block device for fileio
+	SizeBytes  int64  // size of fileio and ramdisk backstores
+	Serial     string // vpd_unit_serial, a NAA serial is generated when empty
+	Buffered   bool   // fileio through the page cache
+	UserConfig string // tcm_user handler config, e.g. "rbd/pool/image"
+}
+
+func (b Backstore) hbaPath() string {
+	return filepath.Join(coreRoot, fmt.Sprintf("%s_%d", b.Plugin, b.HBA))
+}
+
+// Path returns the configfs dir of the backstore
+func (b Backstore) Path() string {
+	return filepath.Join(b.hbaPath(), b.Name)
+}
+
+// String returns <plugin>_<hba>/<name>, see ParseBackstore
+func (b Backstore) String() string {
+	return fmt.Sprintf("%s_%d/%s", b.Plugin, b.HBA, b.Name)
+}
+
+// ParseBackstore parses <plugin>_<hba>/<name>
+func ParseBackstore(s string) (Backstore, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return Backstore{}, fmt.Errorf("invalid backstore %q", s)
+	}
+	i := strings.LastIndex(parts[0], "_")
+	if i < 0 {
+		return Backstore{}, fmt.Errorf("invalid backstore hba %q", parts[0])
+	}
+	hba, err := strconv.Atoi(parts[0][i+1:])
+	if err != nil {
+		return Backstore{}, fmt.Errorf("invalid backstore hba %q: %w", parts[0], err)
+	}
+	return Backstore{Plugin: Plugin(parts[0][:i]), HBA: hba, Name: parts[1]}, nil
+}
+
+// control returns the control string that configures the backstore
+func (b Backstore) control(cfg BackstoreConfig) (string, error) {
+	switch b.Plugin {
+	case IBlock:
+		return fmt.Sprintf("udev_path=%s", cfg.Dev), nil
+	case FileIO:
+		ctl := fmt.Sprintf("fd_dev_name=%s,fd_dev_size=%d", cfg.Dev, cfg.SizeBytes)
+		if cfg.Buffered {
+			ctl += ",fd_buffered_io=1"
+		}
+		return ctl, nil
+	case RamDisk:
+		return fmt.Sprintf("rd_pages=%d", cfg.SizeBytes/int64(os.Getpagesize())), nil
+	case User:
+		return fmt.Sprintf("dev_config=%s,dev_size=%d", cfg.UserConfig, cfg.SizeBytes), nil
+	}
+	return "", fmt.Errorf("unknown backstore plugin %s", b.Plugin)
+}
+
+// CreateBackstore creates and enables a backstore and returns its unit serial
+func CreateBackstore(b Backstore, cfg BackstoreConfig) (string, error) {
+	ctl, err := b.control(cfg)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(b.Path(), os.ModeDir); err != nil {
+		return "", fmt.Errorf("cannot create %s: %v", b, err)
+	}
+	if err := waitForFile(filepath.Join(b.Path(), "control")); err != nil {
+		return "", fmt.Errorf("error waitForFile: %v", err)
+	}
+	if err := writeAttr(filepath.Join(b.Path(), "control"), ctl); err != nil {
+		return "", err
+	}
+	if cfg.Dev != "" && (b.Plugin == IBlock || b.Plugin == FileIO) {
+		if err := writeAttr(filepath.Join(b.Path(), "udev_path"), cfg.Dev); err != nil {
+			return "", err
+		}
+	}
+	serial := cfg.Serial
+	if serial == "" {
+		serial = GenerateNaaSerial()
+	}
+	if err := writeAttr(filepath.Join(b.Path(), "wwn", "vpd_unit_serial"), serial); err != nil {
+		return "", err
+	}
+	if err := writeAttr(filepath.Join(b.Path(), "enable"), "1"); err != nil {
+		return "", err
+	}
+	return serial, nil
+}
+
+// DeleteBackstore removes a backstore. It refuses while a LUN still
+// exports it, the HBA dir goes away with its last backstore. A backstore
+// that does not exist counts as deleted, its creation may have failed.
+func DeleteBackstore(b Backstore) error {
+	if _, err := os.Stat(b.Path()); os.IsNotExist(err) {
+		return nil
+	}
+	luns, err := b.LUNs()
+	if err != nil {
+		return err
+	}
+	if len(luns) != 0 {
+		return fmt.Errorf("backstore %s is exported by %v", b, luns)
+	}
+	if err := rmdir(b.Path()); err != nil {
+		return err
+	}
+	if left, err := listDirs(b.hbaPath()); err == nil && len(left) == 0 {
+		return rmdir(b.hbaPath())
+	}
+	return nil
+}
+
+// Serial returns the unit serial of the backstore
+func (b Backstore) Serial() (string, error) {
+	//it returns something like "T10 VPD Unit Serial Number: 5001405043a8fbf4"
+	serial, err := readAttr(filepath.Join(b.Path(), "wwn", "vpd_unit_serial"))
+	if err != nil {
+		return "", fmt.Errorf("serial of %s: %s", b, err)
+	}
+	parts := strings.Fields(serial)
+	if len(parts) == 0 {
+		return "", fmt.Errorf("serial of %s: empty line", b)
+	}
+	return parts[len(parts)-1], nil
+}
+
+// LUNs returns the LUNs of all fabrics that export the backstore
+func (b Backstore) LUNs() ([]LUN, error) {
+	var res []LUN
+	for _, f := range Fabrics {
+		wwns, err := ListTargets(f)
+		if err != nil {
+			return nil, err
+		}
+		for _, wwn := range wwns {
+			luns, err := ListLUNs(f, wwn)
+			if err != nil {
+				return nil, err
+			}
+			for _, l := range luns {
+				if l.Backstore == b {
+					res = append(res, l)
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// ListBackstores enumerates the backstores of all plugins
+func ListBackstores() ([]Backstore, error) {
+	hbas, err := listDirs(coreRoot)
+	if err != nil {
+		return nil, err
+	}
+	var res []Backstore
+	for _, hba := range hbas {
+		names, err := listDirs(filepath.Join(coreRoot, hba))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if b, err := ParseBackstore(hba + "/" + name); err == nil {
+				res = append(res, b)
+			}
+		}
+	}
+	return res, nil
+}
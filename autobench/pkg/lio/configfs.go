@@ -0,0 +1,136 @@
+package lio
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	configfsRoot = "/sys/kernel/config"
+	targetRoot   = configfsRoot + "/target"
+	coreRoot     = targetRoot + "/core"
+	nvmetRoot    = configfsRoot + "/nvmet"
+	naaPrefix    = "5001405" // from rtslib-fb
+)
+
+// CheckConfigFS verifies that the LIO core is available
+func CheckConfigFS() error {
+	if _, err := os.Stat(targetRoot); err != nil {
+		return fmt.Errorf("target access error (%s): %v", targetRoot, err)
+	}
+	if _, err := os.Stat(coreRoot); err != nil {
+		return fmt.Errorf("target core access error (%s): %s", coreRoot, err)
+	}
+	return nil
+}
+
+// GenerateNaaSerial returns a random serial with the LIO NAA prefix
+func GenerateNaaSerial() string {
+	return fmt.Sprintf("%s%09x", naaPrefix, rand.Uint32())
+}
+
+func writeAttr(path, value string) error {
+	if err := ioutil.WriteFile(path, []byte(value), 0660); err != nil {
+		return fmt.Errorf("error set %s=%s: %v", path, value, err)
+	}
+	return nil
+}
+
+// writeAttrIfChanged skips attributes that already hold the value, some of
+// them are read-only once the object is in use
+func writeAttrIfChanged(path, value string) error {
+	if cur, err := readAttr(path); err == nil && cur == value {
+		return nil
+	}
+	return writeAttr(path, value)
+}
+
+func readAttr(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func listDirs(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func listLinks(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Mode()&os.ModeSymlink != 0 {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func waitForFile(fileName string) error {
+	maxDelay := time.Second * 5
+	delay := time.Millisecond * 500
+	var waited time.Duration
+	for {
+		if delay != 0 {
+			time.Sleep(delay)
+			waited += delay
+		}
+		if _, err := os.Stat(fileName); err == nil {
+			return nil
+		} else {
+			if waited > maxDelay {
+				return fmt.Errorf("file not found: error %v", err)
+			}
+			delay = 2 * delay
+			if delay > maxDelay {
+				delay = maxDelay
+			}
+		}
+	}
+}
+
+// mkdir creates a configfs object, the parent has to exist
+func mkdir(path string) error {
+	if err := os.Mkdir(path, os.ModeDir); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("cannot create %s: %v", path, err)
+	}
+	return nil
+}
+
+// rmdir removes a configfs object, a missing one is not an error
+func rmdir(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove %s: %v", path, err)
+	}
+	return nil
+}
+
+func linkName(dir, target string) string {
+	return filepath.Join(dir, filepath.Base(target))
+}
@@ -0,0 +1,240 @@
+package lio
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fabric is a LIO fabric module
+type Fabric string
+
+const (
+	Vhost    Fabric = "vhost"    // vhost-scsi, exported to QEMU guests
+	Loopback Fabric = "loopback" // exported as a SCSI disk of the host itself
+)
+
+// Fabrics lists the supported fabrics
+var Fabrics = []Fabric{Vhost, Loopback}
+
+// LUN is one logical unit of a target portal group
+type LUN struct {
+	Fabric    Fabric
+	WWN       string
+	TPG       int
+	Index     int
+	Backstore Backstore
+}
+
+func (l LUN) String() string {
+	return fmt.Sprintf("%s/%s/tpgt_%d/lun_%d", l.Fabric, l.WWN, l.TPG, l.Index)
+}
+
+func fabricPath(f Fabric) string {
+	return filepath.Join(targetRoot, string(f))
+}
+
+func tpgPath(f Fabric, wwn string, tpg int) string {
+	return filepath.Join(fabricPath(f), wwn, fmt.Sprintf("tpgt_%d", tpg))
+}
+
+func lunPath(f Fabric, wwn string, tpg, lun int) string {
+	return filepath.Join(tpgPath(f, wwn, tpg), "lun", fmt.Sprintf("lun_%d", lun))
+}
+
+// CheckFabric loads the fabric module by creating its configfs dir
+func CheckFabric(f Fabric) error {
+	if err := CheckConfigFS(); err != nil {
+		return err
+	}
+	if err := mkdir(fabricPath(f)); err != nil {
+		return fmt.Errorf("%s fabric is not available: %w", f, err)
+	}
+	return nil
+}
+
+// CreateTPG creates the target and its portal group and sets the nexus.
+// vhost uses the target wwn as nexus, loopback gets an own initiator wwn.
+func CreateTPG(f Fabric, wwn string, tpg int) error {
+	root := tpgPath(f, wwn, tpg)
+	if err := os.MkdirAll(filepath.Join(root, "lun"), os.ModeDir); err != nil {
+		return fmt.Errorf("cannot create %s tpg: %v", f, err)
+	}
+	nexus := wwn
+	if f == Loopback {
+		nexus = "naa." + GenerateNaaSerial()
+	}
+	if err := waitForFile(filepath.Join(root, "nexus")); err != nil {
+		return fmt.Errorf("error waitForFile: %v", err)
+	}
+	if cur, _ := readAttr(filepath.Join(root, "nexus")); cur != "" {
+		return nil
+	}
+	return writeAttr(filepath.Join(root, "nexus"), nexus)
+}
+
+// AddLUN exports a backstore as lun_<index> of the portal group
+func AddLUN(f Fabric, wwn string, tpg, index int, b Backstore) error {
+	if _, err := os.Stat(b.Path()); err != nil {
+		return fmt.Errorf("backstore access error (%s): %s", b, err)
+	}
+	dir := lunPath(f, wwn, tpg, index)
+	if err := mkdir(dir); err != nil {
+		return err
+	}
+	link := linkName(dir, b.Path())
+	if _, err := os.Lstat(link); os.IsNotExist(err) {
+		if err := os.Symlink(b.Path(), link); err != nil {
+			return fmt.Errorf("error create symlink: %v", err)
+		}
+	}
+	return nil
+}
+
+// RemoveLUN unexports lun_<index>
+func RemoveLUN(f Fabric, wwn string, tpg, index int) error {
+	dir := lunPath(f, wwn, tpg, index)
+	links, err := listLinks(dir)
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		if err := os.Remove(filepath.Join(dir, l)); err != nil {
+			return fmt.Errorf("error delete symlink: %v", err)
+		}
+	}
+	return rmdir(dir)
+}
+
+// DeleteTarget removes all LUNs and portal groups of a target and the
+// target, a target that does not exist counts as deleted
+func DeleteTarget(f Fabric, wwn string) error {
+	root := filepath.Join(fabricPath(f), wwn)
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil
+	}
+	luns, err := ListLUNs(f, wwn)
+	if err != nil {
+		return err
+	}
+	for _, l := range luns {
+		if err := RemoveLUN(f, wwn, l.TPG, l.Index); err != nil {
+			return err
+		}
+	}
+	tpgs, err := listTPGs(f, wwn)
+	if err != nil {
+		return err
+	}
+	for _, tpg := range tpgs {
+		if err := rmdir(tpgPath(f, wwn, tpg)); err != nil {
+			return err
+		}
+	}
+	return rmdir(root)
+}
+
+// ListTargets returns the wwns of a fabric
+func ListTargets(f Fabric) ([]string, error) {
+	dirs, err := listDirs(fabricPath(f))
+	if err != nil {
+		return nil, err
+	}
+	var wwns []string
+	for _, d := range dirs {
+		// the fabric dir also holds discovery_auth and similar groups
+		if strings.Contains(d, ".") {
+			wwns = append(wwns, d)
+		}
+	}
+	return wwns, nil
+}
+
+func listTPGs(f Fabric, wwn string) ([]int, error) {
+	dirs, err := listDirs(filepath.Join(fabricPath(f), wwn))
+	if err != nil {
+		return nil, err
+	}
+	var tpgs []int
+	for _, d := range dirs {
+		if n, err := strconv.Atoi(strings.TrimPrefix(d, "tpgt_")); err == nil && strings.HasPrefix(d, "tpgt_") {
+			tpgs = append(tpgs, n)
+		}
+	}
+	sort.Ints(tpgs)
+	return tpgs, nil
+}
+
+// ListLUNs returns the LUNs of all portal groups of a target
+func ListLUNs(f Fabric, wwn string) ([]LUN, error) {
+	tpgs, err := listTPGs(f, wwn)
+	if err != nil {
+		return nil, err
+	}
+	var res []LUN
+	for _, tpg := range tpgs {
+		dirs, err := listDirs(filepath.Join(tpgPath(f, wwn, tpg), "lun"))
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range dirs {
+			index, err := strconv.Atoi(strings.TrimPrefix(d, "lun_"))
+			if err != nil {
+				continue
+			}
+			l := LUN{Fabric: f, WWN: wwn, TPG: tpg, Index: index}
+			links, err := listLinks(lunPath(f, wwn, tpg, index))
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range links {
+				target, err := os.Readlink(filepath.Join(lunPath(f, wwn, tpg, index), name))
+				if err != nil {
+					continue
+				}
+				// configfs returns relative links
+				if !filepath.IsAbs(target) {
+					target = filepath.Join(lunPath(f, wwn, tpg, index), target)
+				}
+				rel, err := filepath.Rel(coreRoot, target)
+				if err != nil {
+					continue
+				}
+				if b, err := ParseBackstore(rel); err == nil {
+					l.Backstore = b
+				}
+			}
+			res = append(res, l)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].TPG != res[j].TPG {
+			return res[i].TPG < res[j].TPG
+		}
+		return res[i].Index < res[j].Index
+	})
+	return res, nil
+}
+
+// HostDevice finds the host block device of a loopback LUN by the unit
+// serial of its backstore, which the kernel shows in vpd_pg80. The SCSI
+// scan runs asynchronously, so the lookup is retried.
+func HostDevice(serial string) (string, error) {
+	const tryTimes = 10
+	for i := 0; i < tryTimes; i++ {
+		pages, _ := filepath.Glob("/sys/block/*/device/vpd_pg80")
+		for _, page := range pages {
+			data, err := ioutil.ReadFile(page)
+			if err == nil && strings.Contains(string(data), serial) {
+				return filepath.Join("/dev", filepath.Base(filepath.Dir(filepath.Dir(page)))), nil
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	return "", fmt.Errorf("no host block device with serial %s", serial)
+}
@@ -0,0 +1,437 @@
+package lio
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NvmetConfig is the kernel NVMe target setup in the nvmetcli JSON format,
+// see configs/vhost.json
+type NvmetConfig struct {
+	Hosts      []NvmetHost      `json:"hosts"`
+	Ports      []NvmetPort      `json:"ports"`
+	Subsystems []NvmetSubsystem `json:"subsystems"`
+}
+
+type NvmetHost struct {
+	NQN string `json:"nqn"`
+}
+
+type NvmetPort struct {
+	Addr       NvmetAddr         `json:"addr"`
+	ANAGroups  []NvmetANAGroup   `json:"ana_groups"`
+	Param      map[string]string `json:"param"`
+	PortID     int               `json:"portid"`
+	Referrals  []json.RawMessage `json:"referrals"`
+	Subsystems []string          `json:"subsystems"`
+}
+
+type NvmetAddr struct {
+	Adrfam  string `json:"adrfam"`
+	Traddr  string `json:"traddr"`
+	Treq    string `json:"treq"`
+	Trsvcid string `json:"trsvcid"`
+	Trtype  string `json:"trtype"`
+}
+
+type NvmetANAGroup struct {
+	ANA struct {
+		State string `json:"state"`
+	} `json:"ana"`
+	GrpID int `json:"grpid"`
+}
+
+type NvmetSubsystem struct {
+	AllowedHosts []string          `json:"allowed_hosts"`
+	Attr         map[string]string `json:"attr"`
+	Namespaces   []NvmetNamespace  `json:"namespaces"`
+	NQN          string            `json:"nqn"`
+}
+
+type NvmetNamespace struct {
+	ANAGrpID int         `json:"ana_grpid"`
+	Device   NvmetDevice `json:"device"`
+	Enable   int         `json:"enable"`
+	NSID     int         `json:"nsid"`
+}
+
+type NvmetDevice struct {
+	NGUID string `json:"nguid"`
+	Path  string `json:"path"`
+	UUID  string `json:"uuid"`
+}
+
+// LoadNvmetConfig reads a nvmetcli JSON file
+func LoadNvmetConfig(path string) (*NvmetConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg NvmetConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("could not parse nvmet config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// NvmetVhostConfig returns the setup of configs/vhost.json for one device:
+// a subsystem with a single namespace behind a vhost port
+func NvmetVhostConfig(nqn, serial, devicePath string, portID int) *NvmetConfig {
+	port := NvmetPort{
+		Addr:       NvmetAddr{Treq: "not specified", Trtype: "vhost"},
+		Param:      map[string]string{"inline_data_size": "0", "pi_enable": "0"},
+		PortID:     portID,
+		Subsystems: []string{nqn},
+	}
+	grp := NvmetANAGroup{GrpID: 1}
+	grp.ANA.State = "optimized"
+	port.ANAGroups = []NvmetANAGroup{grp}
+
+	return &NvmetConfig{
+		Ports: []NvmetPort{port},
+		Subsystems: []NvmetSubsystem{{
+			Attr: map[string]string{
+				"allow_any_host": "1",
+				"model":          "Linux",
+				"serial":         serial,
+			},
+			Namespaces: []NvmetNamespace{{
+				ANAGrpID: 1,
+				Device:   NvmetDevice{Path: devicePath},
+				Enable:   1,
+				NSID:     1,
+			}},
+			NQN: nqn,
+		}},
+	}
+}
+
+func nvmetHostPath(nqn string) string {
+	return filepath.Join(nvmetRoot, "hosts", nqn)
+}
+
+func nvmetSubsystemPath(nqn string) string {
+	return filepath.Join(nvmetRoot, "subsystems", nqn)
+}
+
+func nvmetPortPath(id int) string {
+	return filepath.Join(nvmetRoot, "ports", strconv.Itoa(id))
+}
+
+// CheckNvmet verifies that the nvmet module is loaded
+func CheckNvmet() error {
+	if _, err := os.Stat(nvmetRoot); err != nil {
+		return fmt.Errorf("nvmet access error (%s): %v", nvmetRoot, err)
+	}
+	return nil
+}
+
+// ApplyNvmet creates the hosts, subsystems and ports of cfg
+func ApplyNvmet(cfg *NvmetConfig) error {
+	for _, h := range cfg.Hosts {
+		if err := mkdir(nvmetHostPath(h.NQN)); err != nil {
+			return err
+		}
+	}
+	for _, s := range cfg.Subsystems {
+		if err := createNvmetSubsystem(s); err != nil {
+			return err
+		}
+	}
+	for _, p := range cfg.Ports {
+		if err := createNvmetPort(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createNvmetSubsystem(s NvmetSubsystem) error {
+	root := nvmetSubsystemPath(s.NQN)
+	if err := mkdir(root); err != nil {
+		return err
+	}
+	for _, k := range sortedKeys(s.Attr) {
+		if err := writeAttrIfChanged(filepath.Join(root, "attr_"+k), s.Attr[k]); err != nil {
+			return err
+		}
+	}
+	for _, h := range s.AllowedHosts {
+		link := filepath.Join(root, "allowed_hosts", h)
+		if _, err := os.Lstat(link); os.IsNotExist(err) {
+			if err := os.Symlink(nvmetHostPath(h), link); err != nil {
+				return fmt.Errorf("error allow host %s: %v", h, err)
+			}
+		}
+	}
+	for _, ns := range s.Namespaces {
+		dir := filepath.Join(root, "namespaces", strconv.Itoa(ns.NSID))
+		if err := mkdir(dir); err != nil {
+			return err
+		}
+		attrs := [][2]string{
+			{"device_path", ns.Device.Path},
+			{"device_uuid", ns.Device.UUID},
+			{"device_nguid", ns.Device.NGUID},
+		}
+		if ns.ANAGrpID != 0 {
+			attrs = append(attrs, [2]string{"ana_grpid", strconv.Itoa(ns.ANAGrpID)})
+		}
+		for _, a := range attrs {
+			if a[1] == "" {
+				continue
+			}
+			if err := writeAttrIfChanged(filepath.Join(dir, a[0]), a[1]); err != nil {
+				return err
+			}
+		}
+		if err := writeAttrIfChanged(filepath.Join(dir, "enable"), strconv.Itoa(ns.Enable)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createNvmetPort(p NvmetPort) error {
+	root := nvmetPortPath(p.PortID)
+	if err := mkdir(root); err != nil {
+		return err
+	}
+	addr := [][2]string{
+		{"addr_trtype", p.Addr.Trtype},
+		{"addr_adrfam", p.Addr.Adrfam},
+		{"addr_traddr", p.Addr.Traddr},
+		{"addr_trsvcid", p.Addr.Trsvcid},
+		{"addr_treq", p.Addr.Treq},
+	}
+	for _, a := range addr {
+		if a[1] == "" {
+			continue
+		}
+		if err := writeAttrIfChanged(filepath.Join(root, a[0]), a[1]); err != nil {
+			return err
+		}
+	}
+	for _, k := range sortedKeys(p.Param) {
+		if err := writeAttrIfChanged(filepath.Join(root, "param_"+k), p.Param[k]); err != nil {
+			return err
+		}
+	}
+	for _, g := range p.ANAGroups {
+		dir := filepath.Join(root, "ana_groups", strconv.Itoa(g.GrpID))
+		if err := mkdir(dir); err != nil {
+			return err
+		}
+		if err := writeAttrIfChanged(filepath.Join(dir, "ana_state"), g.ANA.State); err != nil {
+			return err
+		}
+	}
+	for _, nqn := range p.Subsystems {
+		link := filepath.Join(root, "subsystems", nqn)
+		if _, err := os.Lstat(link); os.IsNotExist(err) {
+			if err := os.Symlink(nvmetSubsystemPath(nqn), link); err != nil {
+				return fmt.Errorf("error export %s on port %d: %v", nqn, p.PortID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteNvmetPort unexports all subsystems of a port and removes it
+func DeleteNvmetPort(id int) error {
+	root := nvmetPortPath(id)
+	links, err := listLinks(filepath.Join(root, "subsystems"))
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		if err := os.Remove(filepath.Join(root, "subsystems", l)); err != nil {
+			return fmt.Errorf("error unexport %s: %v", l, err)
+		}
+	}
+	grps, err := listDirs(filepath.Join(root, "ana_groups"))
+	if err != nil {
+		return err
+	}
+	for _, g := range grps {
+		// group 1 belongs to the port
+		if g != "1" {
+			if err := rmdir(filepath.Join(root, "ana_groups", g)); err != nil {
+				return err
+			}
+		}
+	}
+	return rmdir(root)
+}
+
+// DeleteNvmetSubsystem disables and removes the namespaces of a subsystem
+// and the subsystem. It refuses while a port still exports it.
+func DeleteNvmetSubsystem(nqn string) error {
+	ports, err := ListNvmetPorts()
+	if err != nil {
+		return err
+	}
+	for _, p := range ports {
+		if _, err := os.Lstat(filepath.Join(nvmetPortPath(p), "subsystems", nqn)); err == nil {
+			return fmt.Errorf("subsystem %s is exported on port %d", nqn, p)
+		}
+	}
+
+	root := nvmetSubsystemPath(nqn)
+	nss, err := listDirs(filepath.Join(root, "namespaces"))
+	if err != nil {
+		return err
+	}
+	for _, ns := range nss {
+		dir := filepath.Join(root, "namespaces", ns)
+		if err := writeAttrIfChanged(filepath.Join(dir, "enable"), "0"); err != nil {
+			return err
+		}
+		if err := rmdir(dir); err != nil {
+			return err
+		}
+	}
+	hosts, err := listLinks(filepath.Join(root, "allowed_hosts"))
+	if err != nil {
+		return err
+	}
+	for _, h := range hosts {
+		if err := os.Remove(filepath.Join(root, "allowed_hosts", h)); err != nil {
+			return fmt.Errorf("error disallow host %s: %v", h, err)
+		}
+	}
+	return rmdir(root)
+}
+
+// ClearNvmet removes the ports, subsystems and hosts of cfg
+func ClearNvmet(cfg *NvmetConfig) error {
+	for _, p := range cfg.Ports {
+		if err := DeleteNvmetPort(p.PortID); err != nil {
+			return err
+		}
+	}
+	for _, s := range cfg.Subsystems {
+		if err := DeleteNvmetSubsystem(s.NQN); err != nil {
+			return err
+		}
+	}
+	for _, h := range cfg.Hosts {
+		if err := rmdir(nvmetHostPath(h.NQN)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListNvmetPorts returns the ids of the nvmet ports
+func ListNvmetPorts() ([]int, error) {
+	dirs, err := listDirs(filepath.Join(nvmetRoot, "ports"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, d := range dirs {
+		if id, err := strconv.Atoi(d); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// ListNvmetSubsystems returns the nqns of the nvmet subsystems
+func ListNvmetSubsystems() ([]string, error) {
+	return listDirs(filepath.Join(nvmetRoot, "subsystems"))
+}
+
+// ReadNvmet returns the current nvmet setup
+func ReadNvmet() (*NvmetConfig, error) {
+	cfg := &NvmetConfig{}
+	hosts, err := listDirs(filepath.Join(nvmetRoot, "hosts"))
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		cfg.Hosts = append(cfg.Hosts, NvmetHost{NQN: h})
+	}
+
+	nqns, err := ListNvmetSubsystems()
+	if err != nil {
+		return nil, err
+	}
+	for _, nqn := range nqns {
+		root := nvmetSubsystemPath(nqn)
+		s := NvmetSubsystem{NQN: nqn, Attr: readPrefixed(root, "attr_")}
+		s.AllowedHosts, _ = listLinks(filepath.Join(root, "allowed_hosts"))
+		nss, _ := listDirs(filepath.Join(root, "namespaces"))
+		for _, n := range nss {
+			dir := filepath.Join(root, "namespaces", n)
+			ns := NvmetNamespace{}
+			ns.NSID, _ = strconv.Atoi(n)
+			ns.Device.Path, _ = readAttr(filepath.Join(dir, "device_path"))
+			ns.Device.UUID, _ = readAttr(filepath.Join(dir, "device_uuid"))
+			ns.Device.NGUID, _ = readAttr(filepath.Join(dir, "device_nguid"))
+			grp, _ := readAttr(filepath.Join(dir, "ana_grpid"))
+			ns.ANAGrpID, _ = strconv.Atoi(grp)
+			enable, _ := readAttr(filepath.Join(dir, "enable"))
+			ns.Enable, _ = strconv.Atoi(enable)
+			s.Namespaces = append(s.Namespaces, ns)
+		}
+		cfg.Subsystems = append(cfg.Subsystems, s)
+	}
+
+	ids, err := ListNvmetPorts()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		root := nvmetPortPath(id)
+		p := NvmetPort{PortID: id, Param: readPrefixed(root, "param_")}
+		addr := readPrefixed(root, "addr_")
+		p.Addr = NvmetAddr{Adrfam: addr["adrfam"], Traddr: addr["traddr"], Treq: addr["treq"],
+			Trsvcid: addr["trsvcid"], Trtype: addr["trtype"]}
+		grps, _ := listDirs(filepath.Join(root, "ana_groups"))
+		for _, g := range grps {
+			grp := NvmetANAGroup{}
+			grp.GrpID, _ = strconv.Atoi(g)
+			grp.ANA.State, _ = readAttr(filepath.Join(root, "ana_groups", g, "ana_state"))
+			p.ANAGroups = append(p.ANAGroups, grp)
+		}
+		p.Subsystems, _ = listLinks(filepath.Join(root, "subsystems"))
+		cfg.Ports = append(cfg.Ports, p)
+	}
+	return cfg, nil
+}
+
+// readPrefixed reads the attribute files of dir whose name starts with prefix
+func readPrefixed(dir, prefix string) map[string]string {
+	res := map[string]string{}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return res
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		if v, err := readAttr(filepath.Join(dir, e.Name())); err == nil {
+			res[strings.TrimPrefix(e.Name(), prefix)] = v
+		}
+	}
+	return res
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
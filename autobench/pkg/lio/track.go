@@ -0,0 +1,94 @@
+package lio
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/tracker"
+)
+
+// Tracked kinds of LIO and nvmet objects
+const (
+	KindBackstore      = "backstore"       // <plugin>_<hba>/<name>
+	KindTarget         = "target"          // fabric, wwn
+	KindNvmetSubsystem = "nvmet-subsystem" // nqn
+	KindNvmetPort      = "nvmet-port"      // port id
+)
+
+func init() {
+	tracker.Register(KindBackstore, func(a []string) error {
+		b, err := ParseBackstore(a[0])
+		if err != nil {
+			return err
+		}
+		return DeleteBackstore(b)
+	})
+	tracker.Register(KindTarget, func(a []string) error { return DeleteTarget(Fabric(a[0]), a[1]) })
+	tracker.Register(KindNvmetSubsystem, func(a []string) error { return DeleteNvmetSubsystem(a[0]) })
+	tracker.Register(KindNvmetPort, func(a []string) error {
+		id, err := strconv.Atoi(a[0])
+		if err != nil {
+			return err
+		}
+		return DeleteNvmetPort(id)
+	})
+}
+
+// Scan finds backstores whose name starts with prefix, the targets that
+// export them and nvmet subsystems whose nqn contains prefix with their
+// ports. The resources are returned in creation order.
+func Scan(prefix string) []tracker.Resource {
+	var found []tracker.Resource
+	add := func(kind string, args ...string) {
+		found = append(found, tracker.Resource{Kind: kind, Args: args})
+	}
+
+	if backstores, err := ListBackstores(); err == nil {
+		for _, b := range backstores {
+			if strings.HasPrefix(b.Name, prefix) {
+				add(KindBackstore, b.String())
+			}
+		}
+	}
+
+	for _, f := range Fabrics {
+		wwns, err := ListTargets(f)
+		if err != nil {
+			continue
+		}
+		for _, wwn := range wwns {
+			luns, err := ListLUNs(f, wwn)
+			if err != nil {
+				continue
+			}
+			for _, l := range luns {
+				if strings.HasPrefix(l.Backstore.Name, prefix) {
+					add(KindTarget, string(f), wwn)
+					break
+				}
+			}
+		}
+	}
+
+	nqns, err := ListNvmetSubsystems()
+	if err != nil {
+		return found
+	}
+	for _, nqn := range nqns {
+		if strings.Contains(nqn, prefix) {
+			add(KindNvmetSubsystem, nqn)
+		}
+	}
+	if ports, err := ListNvmetPorts(); err == nil {
+		for _, id := range ports {
+			links, _ := listLinks(nvmetPortPath(id) + "/subsystems")
+			for _, l := range links {
+				if strings.Contains(l, prefix) {
+					add(KindNvmetPort, strconv.Itoa(id))
+					break
+				}
+			}
+		}
+	}
+	return found
+}
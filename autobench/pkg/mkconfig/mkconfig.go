@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -11,26 +12,26 @@ import (
 
 const globalTpl = `[global]
 ioengine=libaio
-size=%dG
+size=%s
 direct=%s
 runtime=%s
 time_based=1
 group_reporting=1
-filename=%s
+%s
 log_avg_msec=250
 
 `
 
 const globalTplcheckSumm = `[global]
 ioengine=libaio
-size=%dG
+size=%s
 direct=%s
 runtime=%s
 verify=%s
 verify_fatal=1
 time_based=1
 group_reporting=1
-filename=%s
+%s
 log_avg_msec=250
 
 `
@@ -41,7 +42,7 @@ rw=%s
 bs=%s
 iodepth=%d
 numjobs=%d
-write_bw_log=%s
+%swrite_bw_log=%s
 write_iops_log=%s
 write_lat_log=%s
 stonewall
@@ -75,7 +76,7 @@ func (t *OpType) Set(v string) error {
 	var val = strings.Split(v, ",")
 	*t = []string{}
 
-	var valid = []string{"read", "write", "randread", "randwrite", "trim", "randtrim"}
+	var valid = []string{"read", "write", "randread", "randwrite", "rw", "randrw", "trim", "randtrim"}
 	for _, s := range val {
 		if !Contains(valid, s) {
 			return fmt.Errorf("Invalid value for operation type: %s\n\tUse something from this list: %v\n", s, valid)
@@ -147,6 +148,52 @@ func (d *DepthType) Set(v string) error {
 
 	return nil
 }
+// RateType is a list of fio bandwidth caps per job, e.g. 50m or 512k
+type RateType []string
+
+var rateRe = regexp.MustCompile(`^[0-9]+[kmg]?$`)
+
+func (r *RateType) Set(v string) error {
+	if strings.TrimSpace(v) == "" {
+		return nil
+	}
+	v = strings.ToLower(v)
+	*r = []string{}
+	for _, s := range strings.Split(v, ",") {
+		if !rateRe.MatchString(s) {
+			return fmt.Errorf("Invalid value for rate: %s\n\tUse bytes per second with an optional k, m or g suffix\n", s)
+		}
+		*r = append(*r, s)
+	}
+	return nil
+}
+
+// RateIOPSType is a list of fio IOPS caps per job
+type RateIOPSType []int
+
+func (r *RateIOPSType) Set(v string) error {
+	if strings.TrimSpace(v) == "" {
+		return nil
+	}
+	*r = []int{}
+	for _, s := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("Invalid value for rate_iops: %s\n", s)
+		}
+		*r = append(*r, n)
+	}
+	return nil
+}
+
+// LatencyTarget makes fio search for the highest queue depth, up to the
+// iodepth of the job, that keeps Percentile of the IOs under Target
+type LatencyTarget struct {
+	Target     string // e.g. 2ms
+	Window     string
+	Percentile string
+}
+
 type FioOptions struct {
 	Operations 	OpType
 	BlockSize   BSType
@@ -155,9 +202,79 @@ type FioOptions struct {
 	Direct		string
 	CheckSumm	string
 	SizeGb      int
+	Rates       RateType     // fixed bandwidth points, one job each
+	RatesIOPS   RateIOPSType // fixed IOPS points, one job each
+	RateProcess string       // linear or poisson
+	Latency     *LatencyTarget
+	Profiles    []Profile // replace the rw x bs x depth x jobs matrix
+	Replay      *Replay   // replaces the matrix with a trace replay
+	Files       *FileJobs
+}
+
+// FileJobs are the options of jobs on the files of a mounted filesystem
+type FileJobs struct {
+	Directory string // mount point, set by the runner once mounted
+	JobSizeMb int    // size of the files of a job, set by the runner to fit the filesystem
+	NrFiles   int
+	OpenFiles int
+	Fsync     int // fsync every that many writes
+	Fdatasync int // fdatasync every that many writes
+}
+
+// options returns the job options of f
+func (f *FileJobs) options() string {
+	var b strings.Builder
+	if f.Directory != "" && f.NrFiles != 0 {
+		fmt.Fprintf(&b, "nrfiles=%d\n", f.NrFiles)
+	}
+	if f.Directory != "" && f.OpenFiles != 0 {
+		fmt.Fprintf(&b, "openfiles=%d\n", f.OpenFiles)
+	}
+	if f.Fsync != 0 {
+		fmt.Fprintf(&b, "fsync=%d\n", f.Fsync)
+	}
+	if f.Fdatasync != 0 {
+		fmt.Fprintf(&b, "fdatasync=%d\n", f.Fdatasync)
+	}
+	return b.String()
+}
+
+// pointOptions returns the extra job options of every rate or latency
+// point of a job, a job at full speed has a single empty point
+func pointOptions(cfg FioOptions) []string {
+	process := ""
+	if cfg.RateProcess != "" {
+		process = fmt.Sprintf("rate_process=%s\n", cfg.RateProcess)
+	}
+	var points []string
+	for _, rate := range cfg.Rates {
+		points = append(points, fmt.Sprintf("rate=%s\n%s", rate, process))
+	}
+	for _, iops := range cfg.RatesIOPS {
+		points = append(points, fmt.Sprintf("rate_iops=%d\n%s", iops, process))
+	}
+	if l := cfg.Latency; l != nil {
+		points = append(points, fmt.Sprintf("latency_target=%s\nlatency_window=%s\nlatency_percentile=%s\n",
+			l.Target, l.Window, l.Percentile))
+	}
+	if len(points) == 0 {
+		points = []string{""}
+	}
+	if cfg.Files != nil {
+		for i := range points {
+			points[i] += cfg.Files.options()
+		}
+	}
+	return points
 }
 
 func CountTests(cfg FioOptions) int {
+	if cfg.Replay != nil {
+		return 1
+	}
+	if len(cfg.Profiles) != 0 {
+		return len(cfg.Profiles)
+	}
 	if len(cfg.Operations) == 0 {
 		cfg.Operations = OpType{"read", "write"}
 	}
@@ -173,7 +290,7 @@ func CountTests(cfg FioOptions) int {
 	if len(cfg.Iodepth) == 0 {
 		cfg.Iodepth = DepthType{1, 8, 32}
 	}
-	return len(cfg.Operations) * len(cfg.BlockSize) * len(cfg.Jobs) * len(cfg.Iodepth)
+	return len(cfg.Operations) * len(cfg.BlockSize) * len(cfg.Jobs) * len(cfg.Iodepth) * len(pointOptions(cfg))
 }
 
 // GenerateFIOConfig generate confiig for FIO from provided params
@@ -214,6 +331,21 @@ func GenerateFIOConfig(
 	if targetDevice != "" {
 		ftPath = targetDevice
 	}
+	target := "filename=" + ftPath
+	size := fmt.Sprintf("%dG", cfg.SizeGb)
+	if cfg.Files != nil && cfg.Files.Directory != "" {
+		// size is per job there, the sections reuse the files of the
+		// jobs with the same number instead of laying out their own
+		target = "directory=" + cfg.Files.Directory + "\nfilename_format=autobench.$jobnum.$filenum"
+		if cfg.Files.JobSizeMb != 0 {
+			size = fmt.Sprintf("%dM", cfg.Files.JobSizeMb)
+		}
+	}
+	for _, p := range cfg.Profiles {
+		if p.Files && !strings.HasPrefix(target, "directory=") {
+			return fmt.Errorf("profile %s works on many files and needs a filesystem (--fs)", p.Name)
+		}
+	}
 
 	fd, err := os.Create(outPath)
 	if err != nil {
@@ -222,9 +354,21 @@ func GenerateFIOConfig(
 	defer fd.Close()
 
 	if cfg.CheckSumm != "" {
-		fmt.Fprintf(fd, globalTplcheckSumm, cfg.SizeGb, cfg.Direct, sTime, cfg.CheckSumm, ftPath)
+		fmt.Fprintf(fd, globalTplcheckSumm, size, cfg.Direct, sTime, cfg.CheckSumm, target)
 	} else {
-		fmt.Fprintf(fd, globalTpl, cfg.SizeGb, cfg.Direct, sTime, ftPath)
+		fmt.Fprintf(fd, globalTpl, size, cfg.Direct, sTime, target)
+	}
+
+	if cfg.Replay != nil {
+		writeReplay(fd, cfg.Replay, ftPath, remoteDirResults)
+		return nil
+	}
+
+	if len(cfg.Profiles) != 0 {
+		for _, p := range cfg.Profiles {
+			writeProfile(fd, p, remoteDirResults)
+		}
+		return nil
 	}
 
 	for _, rw := range cfg.Operations {
@@ -232,10 +376,12 @@ func GenerateFIOConfig(
 			var count = 0
 			for _, depth := range cfg.Iodepth {
 				for _, job := range cfg.Jobs {
-					var section = fmt.Sprintf("%s-%s-%d", rw, bs, count)
-					var logResName = filepath.Join(remoteDirResults, section)
-					fmt.Fprintf(fd, sectionTpl, section, rw, bs, depth, job, logResName, logResName, logResName)
-					count++
+					for _, point := range pointOptions(cfg) {
+						var section = fmt.Sprintf("%s-%s-%d", rw, bs, count)
+						var logResName = filepath.Join(remoteDirResults, section)
+						fmt.Fprintf(fd, sectionTpl, section, rw, bs, depth, job, point, logResName, logResName, logResName)
+						count++
+					}
 				}
 			}
 		}
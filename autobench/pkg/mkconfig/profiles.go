@@ -0,0 +1,243 @@
+package mkconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ProfilePrefix starts the section names of profile jobs, fioconv reports
+// them apart from the synthetic patterns
+const ProfilePrefix = "profile-"
+
+// Profile is a named application-like workload. Its jobs run together as
+// one fio group, so the report has a single row per profile.
+type Profile struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Files       bool         `json:"files,omitempty"` // works on many files, needs a filesystem
+	Jobs        []ProfileJob `json:"jobs"`
+}
+
+// ProfileJob is one fio job of a profile, Options are plain fio job
+// options that override the global ones (size, filename...)
+type ProfileJob struct {
+	Name    string            `json:"name"`
+	Options map[string]string `json:"options"`
+}
+
+// BuiltinProfiles ship with autobench, profile files can add to them or
+// replace them by name
+var BuiltinProfiles = []Profile{
+	{
+		Name:        "oltp",
+		Description: "Database OLTP: 8k random 70/30 read/write with an fsync every 16 writes",
+		Jobs: []ProfileJob{
+			{Name: "data", Options: map[string]string{
+				"rw": "randrw", "bs": "8k", "rwmixread": "70", "iodepth": "8", "numjobs": "4", "fsync": "16",
+			}},
+		},
+	},
+	{
+		Name:        "log-append",
+		Description: "Log append: sequential 16k writes, each one followed by fdatasync",
+		Jobs: []ProfileJob{
+			{Name: "log", Options: map[string]string{
+				"rw": "write", "bs": "16k", "iodepth": "1", "numjobs": "1", "fdatasync": "1",
+			}},
+		},
+	},
+	{
+		Name:        "stream-read",
+		Description: "Streaming read: 8 streams of large sequential reads from separate regions of the test device",
+		Jobs: []ProfileJob{
+			{Name: "streams", Options: map[string]string{
+				"rw": "read", "bs": "1m", "iodepth": "4", "numjobs": "8", "size": "128m", "offset_increment": "128m",
+			}},
+		},
+	},
+	{
+		Name:        "boot-storm",
+		Description: "VM boot storm: many readers of small to medium random blocks with some small writes",
+		Jobs: []ProfileJob{
+			{Name: "read", Options: map[string]string{
+				"rw": "randread", "bssplit": "4k/50:16k/30:64k/20", "iodepth": "4", "numjobs": "8",
+			}},
+			{Name: "write", Options: map[string]string{
+				"rw": "randwrite", "bs": "4k", "iodepth": "1", "numjobs": "2", "rate_iops": "200",
+			}},
+		},
+	},
+	{
+		Name:        "video-record",
+		Description: "Video recording: 4 streams of 256k sequential writes at 2 MB/s each",
+		Jobs: []ProfileJob{
+			{Name: "streams", Options: map[string]string{
+				"rw": "write", "bs": "256k", "iodepth": "1", "numjobs": "4", "rate": "2m", "offset_increment": "256m",
+			}},
+		},
+	},
+	{
+		Name:        "image-pull",
+		Description: "Container image pull: 8 streams reading 4 layer files of 128m each, one file after the other",
+		Files:       true,
+		Jobs: []ProfileJob{
+			{Name: "layers", Options: map[string]string{
+				"rw": "read", "bs": "1m", "iodepth": "4", "numjobs": "8", "nrfiles": "4", "filesize": "128m",
+				"size": "512m", "file_service_type": "sequential",
+			}},
+		},
+	},
+	// The metadata engines do no IO, every file counts as one read whose
+	// latency is that of the create, stat or unlink
+	{
+		Name:        "meta-create",
+		Description: "Metadata: 4 jobs creating 5000 small files each",
+		Files:       true,
+		Jobs: []ProfileJob{
+			{Name: "create", Options: metaJob("filecreate")},
+		},
+	},
+	{
+		Name:        "meta-stat",
+		Description: "Metadata: 4 jobs calling stat on 5000 small files each",
+		Files:       true,
+		Jobs: []ProfileJob{
+			{Name: "stat", Options: metaJob("filestat")},
+		},
+	},
+	{
+		Name:        "meta-unlink",
+		Description: "Metadata: 4 jobs unlinking 5000 small files each",
+		Files:       true,
+		Jobs: []ProfileJob{
+			{Name: "unlink", Options: metaJob("filedelete")},
+		},
+	},
+}
+
+// metaJob returns the options of a metadata job on the fio engine
+func metaJob(engine string) map[string]string {
+	return map[string]string{
+		"ioengine": engine, "rw": "read", "bs": "4k", "filesize": "4k", "nrfiles": "5000",
+		"openfiles": "1", "numjobs": "4", "iodepth": "1", "time_based": "0", "fallocate": "none",
+	}
+}
+
+// LoadProfiles reads profiles from a JSON file with a list of profiles, or
+// from all *.json files of a directory
+func LoadProfiles(path string) ([]Profile, error) {
+	files := []string{path}
+	if fi, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.json")); err != nil {
+			return nil, err
+		}
+	}
+
+	var out []Profile
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var list []Profile
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("invalid profile file %s: %w", f, err)
+		}
+		for _, p := range list {
+			if err := p.check(); err != nil {
+				return nil, fmt.Errorf("%s: %w", f, err)
+			}
+		}
+		out = append(out, list...)
+	}
+	return out, nil
+}
+
+func (p Profile) check() error {
+	if p.Name == "" || strings.ContainsAny(p.Name, " .[]") {
+		return fmt.Errorf("invalid profile name %q", p.Name)
+	}
+	if len(p.Jobs) == 0 {
+		return fmt.Errorf("profile %s has no jobs", p.Name)
+	}
+	for _, j := range p.Jobs {
+		if j.Name == "" || strings.ContainsAny(j.Name, " .[]") {
+			return fmt.Errorf("profile %s: invalid job name %q", p.Name, j.Name)
+		}
+		if j.Options["rw"] == "" {
+			return fmt.Errorf("profile %s: job %s has no rw", p.Name, j.Name)
+		}
+	}
+	return nil
+}
+
+// AllProfiles returns the builtin profiles with the extra ones added, an
+// extra profile replaces a builtin one of the same name
+func AllProfiles(extra []Profile) []Profile {
+	all := append([]Profile{}, BuiltinProfiles...)
+	for _, e := range extra {
+		replaced := false
+		for i := range all {
+			if all[i].Name == e.Name {
+				all[i], replaced = e, true
+			}
+		}
+		if !replaced {
+			all = append(all, e)
+		}
+	}
+	return all
+}
+
+// FindProfiles selects profiles by name
+func FindProfiles(names []string, extra []Profile) ([]Profile, error) {
+	all := AllProfiles(extra)
+	var out []Profile
+	for _, n := range names {
+		found := false
+		for _, p := range all {
+			if p.Name == n {
+				out, found = append(out, p), true
+				break
+			}
+		}
+		if !found {
+			var valid []string
+			for _, p := range all {
+				valid = append(valid, p.Name)
+			}
+			return nil, fmt.Errorf("Invalid value for profile: %s\n\tUse something from this list: %v\n", n, valid)
+		}
+	}
+	return out, nil
+}
+
+// writeProfile writes the job sections of a profile. The first job opens a
+// new group after the previous profile, the others run alongside it.
+func writeProfile(w io.Writer, p Profile, remoteDirResults string) {
+	for i, j := range p.Jobs {
+		section := fmt.Sprintf("%s%s.%s", ProfilePrefix, p.Name, j.Name)
+		fmt.Fprintf(w, "\n[%s]\n", section)
+		keys := make([]string, 0, len(j.Options))
+		for k := range j.Options {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s=%s\n", k, j.Options[k])
+		}
+		logResName := filepath.Join(remoteDirResults, section)
+		fmt.Fprintf(w, "write_bw_log=%s\nwrite_iops_log=%s\nwrite_lat_log=%s\n", logResName, logResName, logResName)
+		if i == 0 {
+			fmt.Fprintf(w, "stonewall\n")
+		}
+	}
+}
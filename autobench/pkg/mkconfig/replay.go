@@ -0,0 +1,40 @@
+package mkconfig
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// ReplayJob is the section name of the replay job
+const ReplayJob = "replay"
+
+// replayDepth is the queue depth fio may use to keep up with the trace
+const replayDepth = 32
+
+// Replay replaces the generated jobs with a single job that replays a
+// blktrace capture or a fio iolog against the test device
+type Replay struct {
+	Source    string // trace on the host
+	Path      string // trace as fio sees it, set by the runner once uploaded
+	NoStall   bool   // issue IOs as fast as possible, ignoring the timing
+	TimeScale int    // percent of the recorded speed, 100 is as recorded
+}
+
+func writeReplay(w io.Writer, r *Replay, target, remoteDirResults string) {
+	path := r.Path
+	if path == "" {
+		path = r.Source
+	}
+	fmt.Fprintf(w, "\n[%s]\n", ReplayJob)
+	fmt.Fprintf(w, "read_iolog=%s\nreplay_redirect=%s\n", path, target)
+	fmt.Fprintf(w, "iodepth=%d\ntime_based=0\n", replayDepth)
+	if r.NoStall {
+		fmt.Fprintf(w, "replay_no_stall=1\n")
+	}
+	if r.TimeScale != 0 && r.TimeScale != 100 {
+		fmt.Fprintf(w, "replay_time_scale=%d\n", r.TimeScale)
+	}
+	logResName := filepath.Join(remoteDirResults, ReplayJob)
+	fmt.Fprintf(w, "write_bw_log=%s\nwrite_iops_log=%s\nwrite_lat_log=%s\nstonewall\n", logResName, logResName, logResName)
+}
@@ -0,0 +1,123 @@
+// Package netdev manages the host side of guest networking: free TCP
+// ports for user-mode forwards, tap devices on a bridge, guest addresses
+// learned from the bridge neighbour table and vsock connections.
+package netdev
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/tracker"
+)
+
+// KindTap is a tap device created by CreateTap
+const KindTap = "tap"
+
+func init() {
+	tracker.Register(KindTap, func(a []string) error { return DeleteTap(a[0]) })
+}
+
+// PortFree reports whether a TCP port can be listened on at addr
+func PortFree(addr string, port int) bool {
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", addr, port))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// FreePort returns the first port from start on that is free at addr and
+// not in taken
+func FreePort(addr string, start int, taken map[int]bool) (int, error) {
+	for port := start; port < 65536; port++ {
+		if !taken[port] && PortFree(addr, port) {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port from %d on", start)
+}
+
+// BridgeExists reports whether br is a bridge device
+func BridgeExists(br string) bool {
+	_, err := ioutil.ReadDir(filepath.Join("/sys/class/net", br, "bridge"))
+	return err == nil
+}
+
+// CreateTap creates a tap device and enslaves
+// it to the bridge br
+func CreateTap(name, br string) error {
+	cmds := [][]string{
+		{"ip", "tuntap", "add", "dev", name, "mode", "tap", "vnet_hdr"},
+		{"ip", "link", "set", "dev", name, "master", br},
+		{"ip", "link", "set", "dev", name, "up"},
+	}
+	for _, c := range cmds {
+		if output, err := exec.Command(c[0], c[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s failed err:[%w] output:[%s]", strings.Join(c, " "), err, output)
+		}
+	}
+	return nil
+}
+
+// DeleteTap removes a tap device, a tap that does not exist counts as
+// deleted
+func DeleteTap(name string) error {
+	if _, err := os.Stat(filepath.Join("/sys/class/net", name)); os.IsNotExist(err) {
+		return nil
+	}
+	if output, err := exec.Command("ip", "tuntap", "del", "dev", name, "mode", "tap").CombinedOutput(); err != nil {
+		return fmt.Errorf("ip tuntap del %s failed err:[%w] output:[%s]", name, err, output)
+	}
+	return nil
+}
+
+// MAC returns a stable locally administered address for id, in the QEMU
+// 52:54:00 range
+func MAC(id int) string {
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", (id>>16)&0xff, (id>>8)&0xff, id&0xff)
+}
+
+// NeighborIP looks up the IPv4 address of mac in the neighbour table of
+// dev. It is empty until the guest has talked to the host.
+func NeighborIP(dev, mac string) (string, error) {
+	output, err := exec.Command("ip", "-4", "neigh", "show", "dev", dev).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ip neigh show dev %s failed err:[%w] output:[%s]", dev, err, output)
+	}
+	// 192.168.122.15 lladdr 52:54:00:00:1e:d2 REACHABLE
+	for _, line := range strings.Split(string(output), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 || f[1] != "lladdr" || !strings.EqualFold(f[2], mac) {
+			continue
+		}
+		if strings.Contains(line, "FAILED") || strings.Contains(line, "INCOMPLETE") {
+			continue
+		}
+		return f[0], nil
+	}
+	return "", nil
+}
+
+// Scan finds tap devices whose name starts with prefix
+func Scan(prefix string) []tracker.Resource {
+	var found []tracker.Resource
+	links, err := ioutil.ReadDir("/sys/class/net")
+	if err != nil {
+		return nil
+	}
+	for _, l := range links {
+		if !strings.HasPrefix(l.Name(), prefix) {
+			continue
+		}
+		if _, err := ioutil.ReadFile(filepath.Join("/sys/class/net", l.Name(), "tun_flags")); err == nil {
+			found = append(found, tracker.Resource{Kind: KindTap, Args: []string{l.Name()}})
+		}
+	}
+	return found
+}
@@ -0,0 +1,50 @@
+package netdev
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockAddr is the net.Addr of a vsock endpoint
+type vsockAddr struct {
+	cid, port uint32
+}
+
+func (a vsockAddr) Network() string { return "vsock" }
+func (a vsockAddr) String() string  { return fmt.Sprintf("vsock:%d:%d", a.cid, a.port) }
+
+// vsockConn is a connected AF_VSOCK socket. The net package does not know
+// the family, so the socket is driven through a pollable os.File.
+type vsockConn struct {
+	*os.File
+	remote vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr  { return vsockAddr{cid: unix.VMADDR_CID_HOST} }
+func (c *vsockConn) RemoteAddr() net.Addr { return c.remote }
+
+// DialVsock connects to port of the guest with context id cid
+func DialVsock(cid, port uint32, timeout time.Duration) (net.Conn, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("vsock socket: %w", err)
+	}
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
+	unix.SetsockoptTimeval(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_CONNECT_TIMEOUT, &tv)
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("vsock connect %d:%d: %w", cid, port, err)
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &vsockConn{
+		File:   os.NewFile(uintptr(fd), fmt.Sprintf("vsock:%d:%d", cid, port)),
+		remote: vsockAddr{cid: cid, port: port},
+	}, nil
+}
@@ -0,0 +1,87 @@
+package numa
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Thread is one task of a process
+type Thread struct {
+	TID  int
+	Name string
+}
+
+// Threads returns the tasks of a process with their comm names. QEMU
+// started with -name debug-threads=on names them "CPU 0/KVM", "IO <iothread>".
+func Threads(pid int) ([]Thread, error) {
+	dirs, err := filepath.Glob(fmt.Sprintf("/proc/%d/task/*", pid))
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("process %d is gone", pid)
+	}
+	var threads []Thread
+	for _, d := range dirs {
+		tid, err := strconv.Atoi(filepath.Base(d))
+		if err != nil {
+			continue
+		}
+		comm, err := ioutil.ReadFile(filepath.Join(d, "comm"))
+		if err != nil {
+			continue
+		}
+		threads = append(threads, Thread{TID: tid, Name: strings.TrimSpace(string(comm))})
+	}
+	return threads, nil
+}
+
+// VhostWorkers returns the vhost worker threads serving a QEMU process.
+// They are named vhost-<pid>, since Linux 6.4 they are tasks of QEMU
+// itself, before that they are kernel threads.
+func VhostWorkers(pid int) ([]Thread, error) {
+	name := fmt.Sprintf("vhost-%d", pid)
+	threads, err := Threads(pid)
+	if err != nil {
+		return nil, err
+	}
+	var workers []Thread
+	for _, t := range threads {
+		if t.Name == name {
+			workers = append(workers, t)
+		}
+	}
+	if len(workers) != 0 {
+		return workers, nil
+	}
+
+	comms, _ := filepath.Glob("/proc/[0-9]*/comm")
+	for _, c := range comms {
+		data, err := ioutil.ReadFile(c)
+		if err != nil || strings.TrimSpace(string(data)) != name {
+			continue
+		}
+		if tid, err := strconv.Atoi(filepath.Base(filepath.Dir(c))); err == nil {
+			workers = append(workers, Thread{TID: tid, Name: name})
+		}
+	}
+	return workers, nil
+}
+
+// SetAffinity pins a thread to cpus, with all it pins every thread of the
+// process
+func SetAffinity(tid int, cpus []int, all bool) error {
+	args := []string{"-pc", FormatCPUList(cpus), strconv.Itoa(tid)}
+	if all {
+		args = append([]string{"-a"}, args...)
+	}
+	output, err := exec.Command("taskset", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("taskset %v err:[%w] output:[%s]", args, err, output)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package numa
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/tracker"
+)
+
+// KindIRQ is a changed IRQ affinity, args are the irq and the old CPU list
+const KindIRQ = "irq-affinity"
+
+func init() {
+	tracker.Register(KindIRQ, func(a []string) error {
+		irq, err := strconv.Atoi(a[0])
+		if err != nil {
+			return err
+		}
+		_, err = SetIRQAffinity(irq, a[1])
+		return err
+	})
+}
+
+// IRQ is one interrupt line of a device queue
+type IRQ struct {
+	Number int
+	Name   string
+}
+
+// NVMeController returns the controller of an NVMe block device, e.g.
+// nvme0 for /dev/nvme0n1p1, or an empty string for other devices
+func NVMeController(dev string) (string, error) {
+	dir, err := sysBlockDir(dev)
+	if err != nil {
+		return "", err
+	}
+	ctrl, err := filepath.EvalSymlinks(filepath.Join(dir, "device"))
+	if err != nil {
+		return "", nil
+	}
+	if name := filepath.Base(ctrl); strings.HasPrefix(name, "nvme") {
+		return name, nil
+	}
+	return "", nil
+}
+
+// NVMeIRQs returns the queue interrupts of an NVMe controller from
+// /proc/interrupts, the admin queue nvme<N>q0 is left out
+func NVMeIRQs(ctrl string) ([]IRQ, error) {
+	f, err := os.Open("/proc/interrupts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var irqs []IRQ
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		name := fields[len(fields)-1]
+		if !strings.HasPrefix(name, ctrl+"q") || name == ctrl+"q0" {
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimPrefix(name, ctrl+"q")); err != nil {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(fields[0], ":"))
+		if err != nil {
+			continue
+		}
+		irqs = append(irqs, IRQ{Number: n, Name: name})
+	}
+	sort.Slice(irqs, func(i, j int) bool { return irqs[i].Number < irqs[j].Number })
+	return irqs, scanner.Err()
+}
+
+// IRQAffinity returns the CPU list of an IRQ
+func IRQAffinity(irq int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/irq/%d/smp_affinity_list", irq))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SetIRQAffinity sets the CPU list of an IRQ and returns the old one.
+// Kernel managed IRQs, as NVMe queues are on recent kernels, refuse it.
+func SetIRQAffinity(irq int, cpus string) (string, error) {
+	old, err := IRQAffinity(irq)
+	if err != nil {
+		return "", err
+	}
+	path := fmt.Sprintf("/proc/irq/%d/smp_affinity_list", irq)
+	if err := ioutil.WriteFile(path, []byte(cpus), 0644); err != nil {
+		return old, fmt.Errorf("error set %s=%s: %v", path, cpus, err)
+	}
+	return old, nil
+}
@@ -0,0 +1,141 @@
+// Package numa reads the CPU and NUMA layout of the host and places
+// threads and IRQs on host CPUs
+package numa
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const sysNode = "/sys/devices/system/node"
+
+// ParseCPUList parses a kernel CPU list such as "0-3,8,10-11"
+func ParseCPUList(list string) ([]int, error) {
+	var cpus []int
+	seen := map[int]bool{}
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu list %q: %w", list, err)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid cpu list %q: %w", list, err)
+			}
+		}
+		if last < first {
+			return nil, fmt.Errorf("invalid cpu range %q", part)
+		}
+		for c := first; c <= last; c++ {
+			if !seen[c] {
+				seen[c] = true
+				cpus = append(cpus, c)
+			}
+		}
+	}
+	if len(cpus) == 0 {
+		return nil, fmt.Errorf("empty cpu list %q", list)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// FormatCPUList returns the kernel notation of a CPU list
+func FormatCPUList(cpus []int) string {
+	sorted := append([]int(nil), cpus...)
+	sort.Ints(sorted)
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// OnlineCPUs returns the online CPUs of the host
+func OnlineCPUs() ([]int, error) {
+	data, err := ioutil.ReadFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		return nil, err
+	}
+	return ParseCPUList(string(data))
+}
+
+// NodeCPUs returns the CPUs of a NUMA node. A host without NUMA has
+// all CPUs on node 0.
+func NodeCPUs(node int) ([]int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(sysNode, fmt.Sprintf("node%d", node), "cpulist"))
+	if os.IsNotExist(err) && node == 0 {
+		return OnlineCPUs()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cpus of numa node %d: %w", node, err)
+	}
+	return ParseCPUList(string(data))
+}
+
+// CPUNode returns the NUMA node of a CPU
+func CPUNode(cpu int) int {
+	dirs, _ := filepath.Glob(filepath.Join("/sys/devices/system/cpu", fmt.Sprintf("cpu%d", cpu), "node*"))
+	for _, d := range dirs {
+		if n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(d), "node")); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+// sysBlockDir returns the sysfs dir of a block device, partitions resolve
+// to their disk
+func sysBlockDir(dev string) (string, error) {
+	real, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", filepath.Base(real)))
+	if err != nil {
+		return "", fmt.Errorf("%s is not a block device: %w", dev, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+		dir = filepath.Dir(dir)
+	}
+	return dir, nil
+}
+
+// DeviceNode returns the NUMA node of the controller of a block device,
+// found by walking up its sysfs path. Devices without one are on node 0.
+func DeviceNode(dev string) (int, error) {
+	dir, err := sysBlockDir(dev)
+	if err != nil {
+		return 0, err
+	}
+	for ; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "numa_node"))
+		if err != nil {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && n >= 0 {
+			return n, nil
+		}
+		return 0, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,109 @@
+// Package qmp is a minimal client of the QEMU machine protocol, enough to
+// run commands on the monitor socket of a VM.
+package qmp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// dialTimeout bounds connecting and the greeting of QEMU
+const dialTimeout = 10 * time.Second
+
+// Error is an error reply of QEMU
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+// reply is a line QEMU sends, events are skipped
+type reply struct {
+	Return json.RawMessage `json:"return"`
+	Error  *Error          `json:"error"`
+	Event  string          `json:"event"`
+}
+
+// Monitor is a connected QMP socket. Commands are serialized.
+type Monitor struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+// Dial connects to the QMP socket, reads the greeting and leaves
+// capabilities negotiation mode
+func Dial(socket string) (*Monitor, error) {
+	conn, err := net.DialTimeout("unix", socket, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to QMP socket %s: %w", socket, err)
+	}
+	m := &Monitor{conn: conn, scanner: bufio.NewScanner(conn)}
+	m.scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if !m.scanner.Scan() {
+		conn.Close()
+		return nil, fmt.Errorf("no QMP greeting on %s: %v", socket, m.scanner.Err())
+	}
+	conn.SetDeadline(time.Time{})
+	if err := m.Execute("qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// Close closes the socket
+func (m *Monitor) Close() error {
+	return m.conn.Close()
+}
+
+// Execute runs a command with the given arguments, a nil args sends none.
+// The return value is decoded into out unless it is nil.
+func (m *Monitor) Execute(command string, args interface{}, out interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	req := map[string]interface{}{"execute": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err := m.conn.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("could not send %s: %w", command, err)
+	}
+	for m.scanner.Scan() {
+		var r reply
+		if err := json.Unmarshal(m.scanner.Bytes(), &r); err != nil {
+			return fmt.Errorf("invalid QMP reply %q: %w", m.scanner.Text(), err)
+		}
+		if r.Event != "" {
+			continue
+		}
+		if r.Error != nil {
+			return fmt.Errorf("%s failed: %w", command, r.Error)
+		}
+		if out == nil || r.Return == nil {
+			return nil
+		}
+		if err := json.Unmarshal(r.Return, out); err != nil {
+			return fmt.Errorf("could not decode the reply of %s: %w", command, err)
+		}
+		return nil
+	}
+	if err := m.scanner.Err(); err != nil {
+		return fmt.Errorf("no reply to %s: %w", command, err)
+	}
+	return fmt.Errorf("no reply to %s: QMP socket closed", command)
+}
@@ -94,3 +94,18 @@ func GetFileSCP(sshClient *ssh.Client, localPath, remotePath string) error {
 
 	return nil
 }
+
+// GetCommandOutputSSH runs command in the foreground and returns its output
+func GetCommandOutputSSH(sshClient *ssh.Client, command string) (string, error) {
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("could not create new ssh session: %w", err)
+	}
+	defer session.Close()
+
+	output, err := session.CombinedOutput(command)
+	if err != nil {
+		return string(output), fmt.Errorf("could not run command [%s]: %w", command, err)
+	}
+	return string(output), nil
+}
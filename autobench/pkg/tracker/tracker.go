@@ -0,0 +1,186 @@
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Resource is one object created on the host, e.g. a zvol or a vhost wwn.
+// Kind selects the undo function, Args are passed to it.
+type Resource struct {
+	Kind    string    `json:"kind"`
+	Args    []string  `json:"args"`
+	Created time.Time `json:"created"`
+}
+
+func (r Resource) String() string {
+	return fmt.Sprintf("%s%v", r.Kind, r.Args)
+}
+
+func (r Resource) is(kind string, args []string) bool {
+	if r.Kind != kind || len(r.Args) != len(args) {
+		return false
+	}
+	for i := range args {
+		if r.Args[i] != args[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// UndoFunc removes a resource created with the given args
+type UndoFunc func(args []string) error
+
+var (
+	undoMu  sync.Mutex
+	undoers = map[string]UndoFunc{}
+)
+
+// Register sets the undo function for a kind of resource
+func Register(kind string, fn UndoFunc) {
+	undoMu.Lock()
+	defer undoMu.Unlock()
+	undoers[kind] = fn
+}
+
+func undo(r Resource) error {
+	undoMu.Lock()
+	fn, ok := undoers[r.Kind]
+	undoMu.Unlock()
+	if !ok {
+		return fmt.Errorf("no undo function for resource kind %s", r.Kind)
+	}
+	return fn(r.Args)
+}
+
+// Tracker records every created resource in a state file, so that they can
+// be undone in reverse order on failure, on signal, at exit or by a later
+// `autobench cleanup` after a crash
+type Tracker struct {
+	mu        sync.Mutex
+	path      string
+	resources []Resource
+}
+
+// New starts a new state file. It refuses to overwrite a state file that
+// still lists resources of a previous run.
+func New(statePath string) (*Tracker, error) {
+	t, err := Load(statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil && len(t.resources) != 0 {
+		return nil, fmt.Errorf("state file %s lists %d resources of a previous run, run `autobench cleanup` first",
+			statePath, len(t.resources))
+	}
+	t = &Tracker{path: statePath}
+	return t, t.save()
+}
+
+// Load reads an existing state file
+func Load(statePath string) (*Tracker, error) {
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tracker{path: statePath}
+	if err := json.Unmarshal(data, &t.resources); err != nil {
+		return nil, fmt.Errorf("could not parse state file %s: %w", statePath, err)
+	}
+	return t, nil
+}
+
+// save writes the state file through a temporary file, so a crash never
+// leaves a truncated state behind
+func (t *Tracker) save() error {
+	data, err := json.MarshalIndent(t.resources, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return fmt.Errorf("could not create dir for state file: %w", err)
+	}
+	tmp := t.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("could not write state file: %w", err)
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// Path returns the state file path
+func (t *Tracker) Path() string {
+	return t.path
+}
+
+// Resources returns a copy of the tracked resources in creation order
+func (t *Tracker) Resources() []Resource {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Resource(nil), t.resources...)
+}
+
+// Add records a created resource
+func (t *Tracker) Add(kind string, args ...string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resources = append(t.resources, Resource{Kind: kind, Args: args, Created: time.Now()})
+	return t.save()
+}
+
+// Undo removes one resource and drops its record. A resource that is not
+// tracked is left alone.
+func (t *Tracker) Undo(kind string, args ...string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.resources) - 1; i >= 0; i-- {
+		r := t.resources[i]
+		if !r.is(kind, args) {
+			continue
+		}
+		if err := undo(r); err != nil {
+			return fmt.Errorf("undo %s failed: %w", r, err)
+		}
+		t.resources = append(t.resources[:i], t.resources[i+1:]...)
+		return t.save()
+	}
+	return nil
+}
+
+// Rollback undoes all resources in reverse order of creation. It goes on
+// after errors, the resources that could not be removed stay in the state file.
+func (t *Tracker) Rollback() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	failed := UndoAll(t.resources)
+	t.resources = failed
+	if err := t.save(); err != nil {
+		return err
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("%d resources could not be removed, see %s", len(failed), t.path)
+	}
+	return nil
+}
+
+// UndoAll undoes resources in reverse order and returns the ones that
+// could not be removed
+func UndoAll(resources []Resource) []Resource {
+	var failed []Resource
+	for i := len(resources) - 1; i >= 0; i-- {
+		r := resources[i]
+		log.Printf("Removing %s", r)
+		if err := undo(r); err != nil {
+			log.Printf("undo %s failed: %v", r, err)
+			failed = append([]Resource{r}, failed...)
+		}
+	}
+	return failed
+}
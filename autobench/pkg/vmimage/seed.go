@@ -0,0 +1,66 @@
+package vmimage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/qemutmp"
+)
+
+// seedTools are tried in order, each one writes a "cidata" ISO from the
+// user-data and meta-data files of dir
+var seedTools = []struct {
+	name string
+	args func(out string) []string
+}{
+	{"cloud-localds", func(out string) []string { return []string{out, "user-data", "meta-data"} }},
+	{"genisoimage", func(out string) []string {
+		return []string{"-quiet", "-output", out, "-volid", "cidata", "-joliet", "-rock", "user-data", "meta-data"}
+	}},
+	{"mkisofs", func(out string) []string {
+		return []string{"-quiet", "-output", out, "-volid", "cidata", "-joliet", "-rock", "user-data", "meta-data"}
+	}},
+	{"xorriso", func(out string) []string {
+		return []string{"-as", "mkisofs", "-quiet", "-output", out, "-volid", "cidata", "-joliet", "-rock", "user-data", "meta-data"}
+	}},
+}
+
+// BuildSeed renders the cloud-init files of ud and writes a NoCloud seed
+// image to path
+func BuildSeed(path string, ud qemutmp.UserData) error {
+	userData, metaData, err := ud.Render()
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "autobench-seed")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "user-data"), userData, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "meta-data"), metaData, 0644); err != nil {
+		return err
+	}
+
+	out, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for _, tool := range seedTools {
+		if _, err := exec.LookPath(tool.name); err != nil {
+			continue
+		}
+		cmd := exec.Command(tool.name, tool.args(out)...)
+		cmd.Dir = dir
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s err:[%w] output:[%s]", tool.name, err, output)
+		}
+		return nil
+	}
+	return fmt.Errorf("no tool to build the cloud-init seed, install cloud-image-utils, genisoimage or xorriso")
+}
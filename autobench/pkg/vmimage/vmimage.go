@@ -0,0 +1,110 @@
+// Package vmimage prepares the boot images of autobench guests: qcow2
+// overlays on a shared base image and cloud-init NoCloud seeds
+package vmimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/tracker"
+)
+
+// KindImage is a created overlay or seed file, args are the path
+const KindImage = "vm-image"
+
+func init() {
+	tracker.Register(KindImage, func(a []string) error {
+		if err := os.Remove(a[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// ImageInfo is the part of `qemu-img info` autobench needs
+type ImageInfo struct {
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtual-size"`
+	BackingFile string `json:"backing-filename,omitempty"`
+}
+
+// Info runs qemu-img info on an image
+func Info(path string) (ImageInfo, error) {
+	var info ImageInfo
+	output, err := exec.Command("qemu-img", "info", "--output=json", "-U", path).CombinedOutput()
+	if err != nil {
+		return info, fmt.Errorf("qemu-img info %s err:[%w] output:[%s]", path, err, output)
+	}
+	if err := json.Unmarshal(output, &info); err != nil {
+		return info, fmt.Errorf("could not parse qemu-img info of %s: %w", path, err)
+	}
+	return info, nil
+}
+
+// CreateOverlay creates a qcow2 image backed by base, the base stays
+// untouched and can be shared by any number of overlays
+func CreateOverlay(base, baseFormat, path string) error {
+	abs, err := filepath.Abs(base)
+	if err != nil {
+		return err
+	}
+	output, err := exec.Command("qemu-img", "create", "-q", "-f", "qcow2",
+		"-F", baseFormat, "-b", abs, path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img create overlay %s err:[%w] output:[%s]", path, err, output)
+	}
+	return nil
+}
+
+// PartUUID returns the PARTUUID the kernel gives partition n of the disk
+// image, it finds the root fs without an initrd. GPT partitions have the
+// unique GUID of their entry, MBR ones the disk signature and the number.
+func PartUUID(path, format string, n int) (string, error) {
+	tmp, err := ioutil.TempFile("", "autobench-ptable")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	// The MBR, the GPT header and the first 128 partition entries
+	output, err := exec.Command("qemu-img", "dd", "-f", format, "-O", "raw", "bs=512", "count=34",
+		"if="+path, "of="+tmp.Name()).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("qemu-img dd %s err:[%w] output:[%s]", path, err, output)
+	}
+	table, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		return "", err
+	}
+	return partUUID(table, n)
+}
+
+func partUUID(table []byte, n int) (string, error) {
+	if len(table) < 1024 || table[510] != 0x55 || table[511] != 0xaa {
+		return "", fmt.Errorf("no partition table")
+	}
+	if string(table[512:520]) != "EFI PART" {
+		if n < 1 || n > 4 || table[446+16*(n-1)+4] == 0 {
+			return "", fmt.Errorf("no MBR partition %d", n)
+		}
+		return fmt.Sprintf("%08x-%02x", binary.LittleEndian.Uint32(table[440:444]), n), nil
+	}
+	start := binary.LittleEndian.Uint64(table[512+72:])
+	size := binary.LittleEndian.Uint32(table[512+84:])
+	off := int(start)*512 + (n-1)*int(size)
+	if n < 1 || size < 32 || off+int(size) > len(table) {
+		return "", fmt.Errorf("GPT partition %d is out of the read table", n)
+	}
+	g := table[off+16 : off+32]
+	if bytes.Equal(g, make([]byte, 16)) {
+		return "", fmt.Errorf("no GPT partition %d", n)
+	}
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x", binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]), binary.LittleEndian.Uint16(g[6:8]), g[8:10], g[10:16]), nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/numa"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/tracker"
+)
+
+// Placement policies of the qemu target
+const (
+	placementNone     = "none"      // the scheduler decides
+	placementDiskNode = "disk-node" // CPUs and memory of the NUMA node of the disk
+	placementCPUs     = "cpus"      // the CPUs of --pin-cpus
+)
+
+var placementPolicies = []string{placementNone, placementDiskNode, placementCPUs}
+
+// placementPlan is the resolved placement of a test case
+type placementPlan struct {
+	policy  string
+	cpus    []int
+	memNode int      // -1 leaves guest memory to the kernel
+	disks   []string // their NVMe queue IRQs go to the CPUs
+}
+
+// placementRecord is the applied placement, it goes to the run manifest
+type placementRecord struct {
+	Policy  string            `json:"policy"`
+	CPUs    string            `json:"cpus,omitempty"`
+	MemNode *int              `json:"mem_node,omitempty"`
+	Threads map[string]string `json:"threads,omitempty"` // localhost:<port>/<thread> to its CPUs
+	IRQs    map[string]string `json:"irqs,omitempty"`    // queue to its CPU or why it was not moved
+	moved   []tracker.Resource
+}
+
+// parsePlacements parses the --placement list
+func parsePlacements() ([]string, error) {
+	policies := splitList(qemuCmd.CPlacement)
+	for _, p := range policies {
+		if !mkconfig.Contains(placementPolicies, p) {
+			return nil, fmt.Errorf("invalid placement: %s\n\tUse something from this list: %v", p, placementPolicies)
+		}
+	}
+	if mkconfig.Contains(policies, placementCPUs) {
+		if _, err := numa.ParseCPUList(qemuCmd.CPinCPUs); err != nil {
+			return nil, fmt.Errorf("placement cpus needs --pin-cpus: %w", err)
+		}
+	}
+	if mkconfig.Contains(policies, placementDiskNode) && qemuCmd.CTargetDisk == "" && qemuCmd.CTopology == "" {
+		return nil, fmt.Errorf("placement disk-node needs --disktarget or --topology")
+	}
+	return policies, nil
+}
+
+// resolvePlacement returns the CPUs and the memory node of a test case,
+// nil when nothing is pinned
+func resolvePlacement(tc testCase) (*placementPlan, error) {
+	if tc.placement == "" || tc.placement == placementNone {
+		return nil, nil
+	}
+	p := &placementPlan{policy: tc.placement, memNode: -1}
+	if tc.topology != nil {
+		p.disks = tc.topology.Disks()
+	} else if qemuCmd.CTargetDisk != "" {
+		p.disks = []string{qemuCmd.CTargetDisk}
+	}
+
+	switch tc.placement {
+	case placementDiskNode:
+		if len(p.disks) == 0 {
+			return nil, fmt.Errorf("placement disk-node needs --disktarget or --topology")
+		}
+		node, err := numa.DeviceNode(p.disks[0])
+		if err != nil {
+			return nil, fmt.Errorf("numa node of %s: %w", p.disks[0], err)
+		}
+		if p.cpus, err = numa.NodeCPUs(node); err != nil {
+			return nil, err
+		}
+		p.memNode = node
+	case placementCPUs:
+		cpus, err := numa.ParseCPUList(qemuCmd.CPinCPUs)
+		if err != nil {
+			return nil, err
+		}
+		p.cpus = cpus
+		p.memNode = qemuCmd.CMemNode
+		if p.memNode < 0 {
+			p.memNode = numa.CPUNode(cpus[0])
+		}
+	}
+	return p, nil
+}
+
+// readPid reads the -pidfile of QEMU
+func readPid(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// applyPlacement pins the threads of the booted VMs and the NVMe queue IRQs
+// of the disks. Every QEMU thread is confined to the CPUs of the plan, then
+// vCPUs, iothreads and vhost workers get a CPU each, round robin.
+func applyPlacement(vms VMlist, p *placementPlan) (*placementRecord, error) {
+	rec := &placementRecord{
+		Policy:  p.policy,
+		CPUs:    numa.FormatCPUList(p.cpus),
+		Threads: map[string]string{},
+		IRQs:    map[string]string{},
+	}
+	if p.memNode >= 0 {
+		rec.MemNode = &p.memNode
+	}
+
+	next := 0
+	pin := func(key string, tid int) error {
+		cpu := p.cpus[next%len(p.cpus)]
+		next++
+		if err := numa.SetAffinity(tid, []int{cpu}, false); err != nil {
+			return err
+		}
+		rec.Threads[key] = strconv.Itoa(cpu)
+		return nil
+	}
+
+	for _, vm := range vms {
+		pid, err := readPid(filepath.Join(vm.resultPath, "qemu.pid"))
+		if err != nil {
+			return rec, fmt.Errorf("pid of QEMU on port %d: %w", vm.port, err)
+		}
+		if err := numa.SetAffinity(pid, p.cpus, true); err != nil {
+			return rec, err
+		}
+		rec.Threads[fmt.Sprintf("localhost:%d/qemu", vm.port)] = rec.CPUs
+		if vm.storageDaemon != nil && vm.storageDaemon.Process != nil {
+			if err := numa.SetAffinity(vm.storageDaemon.Process.Pid, p.cpus, true); err != nil {
+				return rec, err
+			}
+			rec.Threads[fmt.Sprintf("localhost:%d/qemu-storage-daemon", vm.port)] = rec.CPUs
+		}
+
+		threads, err := numa.Threads(pid)
+		if err != nil {
+			return rec, err
+		}
+		for _, t := range threads {
+			if (strings.HasPrefix(t.Name, "CPU ") && strings.HasSuffix(t.Name, "/KVM")) || strings.HasPrefix(t.Name, "IO ") {
+				if err := pin(fmt.Sprintf("localhost:%d/%s", vm.port, t.Name), t.TID); err != nil {
+					return rec, err
+				}
+			}
+		}
+		workers, err := numa.VhostWorkers(pid)
+		if err != nil {
+			return rec, err
+		}
+		for _, t := range workers {
+			if err := pin(fmt.Sprintf("localhost:%d/%s/%d", vm.port, t.Name, t.TID), t.TID); err != nil {
+				return rec, err
+			}
+		}
+	}
+
+	next = 0
+	for _, disk := range p.disks {
+		ctrl, err := numa.NVMeController(disk)
+		if err != nil {
+			return rec, err
+		}
+		if ctrl == "" {
+			log.Printf("placement: %s is not an NVMe device, its IRQs are left alone", disk)
+			continue
+		}
+		irqs, err := numa.NVMeIRQs(ctrl)
+		if err != nil {
+			return rec, err
+		}
+		for _, irq := range irqs {
+			cpu := strconv.Itoa(p.cpus[next%len(p.cpus)])
+			next++
+			old, err := numa.SetIRQAffinity(irq.Number, cpu)
+			if err != nil {
+				rec.IRQs[irq.Name] = "not moved: " + err.Error()
+				continue
+			}
+			r := tracker.Resource{Kind: numa.KindIRQ, Args: []string{strconv.Itoa(irq.Number), old}}
+			if err := res.Add(r.Kind, r.Args...); err != nil {
+				return rec, err
+			}
+			rec.moved = append(rec.moved, r)
+			rec.IRQs[irq.Name] = cpu
+		}
+	}
+	return rec, nil
+}
+
+// restore puts the IRQs back, so the next case starts from the host defaults
+func (rec *placementRecord) restore() {
+	for _, r := range rec.moved {
+		if err := res.Undo(r.Kind, r.Args...); err != nil {
+			log.Printf("Attention! Could not restore %s: %v", r, err)
+		}
+	}
+	rec.moved = nil
+}
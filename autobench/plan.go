@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Plan describes the matrix of a qemu target run in a file. Every list is a
+// matrix dimension, values given on the command line take precedence.
+//
+//	{
+//	  "image":      "bionic-i386",
+//	  "backends":   ["zvol", "lvm"],
+//	  "frontends":  ["virtio-blk", "vhost-scsi"],
+//	  "topologies": ["mirror:sdb,sdc", "raidz1:sdb,sdc,sdd+log:nvme0n1"],
+//	  "zfs_props":  {"volblocksize": ["8k", "64k"]},
+//	  "lio_attribs": {"emulate_write_cache": ["0", "1"]},
+//	  "image_opts": {"cluster_size": ["64k", "1M"]},
+//	  "drive_opts": {"cache": ["none", "writeback"], "aio": ["threads", "io_uring"]},
+//	  "placements": ["none", "disk-node"],
+//	  "kernels":    [{"name": "nvme", "image": "../linux"}]
+//	}
+type Plan struct {
+	Image      string              `json:"image"` // name in the image catalog
+	Backends   []string            `json:"backends"`
+	Frontends  []string            `json:"frontends"`
+	Topologies []string            `json:"topologies"`
+	ZfsProps   map[string][]string `json:"zfs_props"`
+	LioAttribs map[string][]string `json:"lio_attribs"`
+	ImageOpts  map[string][]string `json:"image_opts"`
+	DriveOpts  map[string][]string `json:"drive_opts"`
+	Placements []string            `json:"placements"`
+	Kernels    []*kernelCase       `json:"kernels"`
+}
+
+// loadPlan reads a plan file and fills the matrix options that are not set
+func loadPlan(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read plan: %w", err)
+	}
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return fmt.Errorf("could not parse plan %s: %w", path, err)
+	}
+
+	if qemuCmd.CImageName == "" {
+		qemuCmd.CImageName = plan.Image
+	}
+	if qemuCmd.CBackend == "" {
+		qemuCmd.CBackend = strings.Join(plan.Backends, ",")
+	}
+	if qemuCmd.CFrontend == "" {
+		qemuCmd.CFrontend = strings.Join(plan.Frontends, ",")
+	}
+	if qemuCmd.CTopology == "" {
+		qemuCmd.CTopology = strings.Join(plan.Topologies, ";")
+	}
+	if qemuCmd.CPlacement == "" {
+		qemuCmd.CPlacement = strings.Join(plan.Placements, ",")
+	}
+	if len(qemuCmd.CKernel) == 0 {
+		planKernels = plan.Kernels
+	}
+	if len(qemuCmd.CZfsProp) == 0 {
+		qemuCmd.CZfsProp = sweepOptions(plan.ZfsProps)
+	}
+	if len(qemuCmd.CLioAttrib) == 0 {
+		qemuCmd.CLioAttrib = sweepOptions(plan.LioAttribs)
+	}
+	if len(qemuCmd.CImageOpt) == 0 {
+		qemuCmd.CImageOpt = sweepOptions(plan.ImageOpts)
+	}
+	if len(qemuCmd.CDriveOpt) == 0 {
+		qemuCmd.CDriveOpt = sweepOptions(plan.DriveOpts)
+	}
+	return nil
+}
+
+// sweepOptions turns a plan map into name=value1,value2 options
+func sweepOptions(sweeps map[string][]string) []string {
+	var names []string
+	for name := range sweeps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var res []string
+	for _, name := range names {
+		res = append(res, fmt.Sprintf("%s=%s", name, strings.Join(sweeps[name], ",")))
+	}
+	return res
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
+)
+
+type ProfilesCommand struct {
+	File string `short:"f" long:"file" description:"JSON file, or directory of them, with more profiles"`
+	Jobs bool   `short:"v" long:"verbose" description:"Also print the fio options of every job"`
+}
+
+var profilesCmd ProfilesCommand
+
+func (x *ProfilesCommand) Execute(args []string) error {
+	var extra []mkconfig.Profile
+	if profilesCmd.File != "" {
+		var err error
+		if extra, err = mkconfig.LoadProfiles(profilesCmd.File); err != nil {
+			return fmt.Errorf("could not load profiles: %w", err)
+		}
+	}
+	for _, p := range mkconfig.AllProfiles(extra) {
+		desc := p.Description
+		if p.Files {
+			desc += " (needs --fs)"
+		}
+		fmt.Printf("%-14s %s\n", p.Name, desc)
+		if !profilesCmd.Jobs {
+			continue
+		}
+		for _, j := range p.Jobs {
+			var keys []string
+			for k := range j.Options {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			var kv []string
+			for _, k := range keys {
+				kv = append(kv, k+"="+j.Options[k])
+			}
+			fmt.Printf("%-14s   %s: %s\n", "", j.Name, strings.Join(kv, " "))
+		}
+	}
+	return nil
+}
+
+func init() {
+	parser.AddCommand(
+		"profiles",
+		"List the workload profiles",
+		"This command lists the builtin application-like workload profiles and those of a profile file",
+		&profilesCmd,
+	)
+}
@@ -1,103 +1,182 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 
 	"log"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
-	"text/template"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/backend"
 	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/fiotests"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/fsprep"
 	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
-	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/vhost"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/tracker"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/lio"
 	"github.com/zededa-yuri/nextgen-storage/autobench/qemutmp"
 	"golang.org/x/crypto/ssh"
 )
 
 type QemuCommand struct {
 	CQemuConfigDir string `short:"c" long:"config" description:"The option takes the path to the QEMU configuration file"`
-	CFileLocation  string `short:"i" long:"image" description:"The option takes the path to the .img file" default:"bionic-server-cloudimg-i386.img"`
+	CFileLocation  string `short:"i" long:"image" description:"Base image of the guests, every VM boots from a qcow2 overlay on it" default:"bionic-server-cloudimg-i386.img"`
 	CSizeDiskGb	   int    `short:"s" long:"size" description:"The total size for logical volume in Gb" default:"60"`
-	CFormat        string `short:"f" long:"format" description:"Format options " default:"raw"`
+	CFormat        string `short:"f" long:"format" description:"Format of the base image (raw, qcow2), detected by qemu-img when empty"`
+	CImageName     string `long:"image-name" description:"Base image from the image catalog, used instead of --image"`
+	CCacheDir      string `long:"cache-dir" description:"Image cache dir of --image-name (default: ~/.cache/autobench)"`
+	CPackages      string `long:"packages" description:"Comma separated packages cloud-init installs in the guests" default:"fio,sysstat"`
+	CSSHKey        string `long:"ssh-key" description:"Public key file authorized for the guest user"`
+	CSeed          string `long:"seed" description:"Prebuilt cloud-init seed image used instead of the generated one"`
+	CImageDir      string `long:"image-dir" description:"Directory for the overlays and seeds of the VMs (default: next to the binary)"`
 	CVCpus         string `short:"v" long:"vcpu" description:"VCpu and core counts" default:"2"`
 	CUser          string `short:"u" long:"user" description:"A user name for VM connections" default:"ubuntu"`
 	CMemory        string `short:"m" long:"memory" description:"RAM memory value" default:"512"`
 	CPassword      string `short:"x" long:"password" description:"Format options " default:"asdfqwer"`
-	CPort          int    `short:"p" long:"port" description:"Port for connect to VM" default:"7890"`
+	CPort          int    `short:"p" long:"port" description:"First port of the VMs, VM i is named after port+i and forwards SSH from it, or from the next free port when it is busy" default:"7890"`
 	CCountVM       int    `short:"n" long:"vmcount" description:"Count create VM" default:"1"`
-	CLvm           bool   `short:"l" long:"lvm" description:"Create lvm volume and share to vm via VHost"`
-	CZfs           bool   `short:"z" long:"zfs" description:"Create zvol and share to vm via VHost"`
+	CLvm           bool   `short:"l" long:"lvm" description:"Create lvm volume and share to vm via VHost, same as --backend=lvm"`
+	CZfs           bool   `short:"z" long:"zfs" description:"Create zvol and share to vm via VHost, same as --backend=zvol"`
 	CBsZfs         string `short:"b" long:"blocksize" description:"Blocksize properties for zvol" default:"16k"`
 	CZipZFS		   string `short:"a" long:"compression" description:"Compression properties for zvol." default:"on"`
 	CPRcacheZFS	   string `short:"o" long:"primarycache" description:"Primarycache properties for zvol." default:"metadata"`
 	CLogbiasZFS	   string `short:"w" long:"logbias" description:"Logbias properties for zvol." default:"throughput"`
 	CRdMetadataZFS string `short:"r" long:"metadata" description:"Redundant_metadata properties for zvol." default:"most"`
-	CTargetDisk    string `short:"d" long:"disktarget" description:"Path to device for create zpool or lvm"`
+	CTargetDisk    string `short:"d" long:"disktarget" description:"Path to device for create zpool, volume group, filesystem or dm-linear volumes"`
+	CZfsProp       []string `long:"zfs-prop" description:"ZFS property to sweep as name=value1,value2; zvol properties (volblocksize, sync, dedup, checksum, ...), pool properties (ashift, ...), log/special/cache devices (a device or none) and zfs module parameters (zfs_arc_max, ...). Can be repeated"`
+	CImageOpt      []string `long:"image-opt" description:"Option of the file and qcow2 test images to sweep as name=value1,value2: create options (cluster_size, preallocation, lazy_refcounts, ...), qcow2 driver options (l2-cache-size, refcount-cache-size, cache-clean-interval, ...) and compression (off, zlib, zstd). Raw images only take preallocation. Can be repeated"`
+	CDriveOpt      []string `long:"drive-opt" description:"QEMU block layer option of the test drive to sweep as name=value1,value2: cache (none, writeback, writethrough, directsync, unsafe), aio (threads, native, io_uring), discard (ignore, unmap) and detect-zeroes (off, on, unmap). Applies to the virtio-blk, virtio-scsi, nvme and vhost-user-blk frontends. Can be repeated"`
+	CLioAttrib     []string `long:"lio-attrib" description:"Attribute of the vhost-scsi backstores to sweep as name=value1,value2 (emulate_write_cache, queue_depth, block_size, emulate_tpu, max_unmap_lba_count, optimal_sectors, ...). Can be repeated"`
+	CKernel        []string `long:"kernel" description:"Guest kernel to boot directly as [name=]path to a bzImage or a linux build tree, each one is a separate test case. Can be repeated"`
+	CInitrd        string `long:"initrd" description:"Initrd of the --kernel guests"`
+	CAppend        string `long:"append" description:"Command line of the --kernel guests (default: root=PARTUUID=<partition 1 of the base image> rw console=ttyS0)"`
+	CNet           string `long:"net" description:"Guest network: user (SSH through a free forwarded port), bridge (tap on --bridge), vsock (SSH over vhost-vsock)" default:"user"`
+	CBridge        string `long:"bridge" description:"Host bridge of --net=bridge, the guests get their address by DHCP on it" default:"virbr0"`
+	CDensity       bool    `long:"density" description:"Density mode: add VMs step by step, all running the same background workload, until the p99 SLO, the host CPU or memory runs out or --vmcount is reached"`
+	CDensityStep   int     `long:"density-step" description:"VMs added per density step" default:"1"`
+	CDensitySLO    float64 `long:"slo-p99" description:"p99 completion latency SLO of every VM in ms, 0 runs up to --vmcount"`
+	CDensityMaxCPU float64 `long:"density-max-cpu" description:"Stop density mode once a step keeps the host CPUs busy above this percentage" default:"90"`
+	CDensityRW     string  `long:"density-rw" description:"Operation of the density workload" default:"randrw"`
+	CDensityBS     string  `long:"density-bs" description:"Block size of the density workload" default:"4k"`
+	CDensityDepth  int     `long:"density-iodepth" description:"IO depth of the density workload" default:"8"`
+	CDiscard       bool    `long:"discard" description:"Discard mode: fill a region of every test volume, trim it from the guest and measure the host space given back and the trim latency"`
+	CDiscardSize   int     `long:"discard-size" description:"Size of the region filled and trimmed in discard mode in Gb" default:"4"`
+	CDiscardBS     string  `long:"discard-bs" description:"Comma separated trim sizes of discard mode, each one is a fill and trim round" default:"4k,64k,1m"`
+	CDiscardRW     string  `long:"discard-rw" description:"Order of the trims in discard mode" choice:"trim" choice:"randtrim" default:"trim"`
+	CDiscardJobs   int     `long:"discard-jobs" description:"Trims in flight in discard mode, each job trims its own part of the region" default:"4"`
+	CSnapshots     int     `long:"snapshots" description:"Snapshot mode: fill every test volume, run the snapshot workload, then take a snapshot and run it again, up to this many snapshots"`
+	CSnapshotKind  string  `long:"snapshot-kind" description:"What snapshot mode takes: snapshot (zfs snapshot, lvcreate -s) or qcow2 (an external overlay taken over QMP, file backend)" choice:"snapshot" choice:"qcow2" default:"snapshot"`
+	CSnapshotSize  int     `long:"snapshot-size" description:"COW space of thick lvm snapshots in Gb, 0 for the size of the volume"`
+	CSnapshotRW    string  `long:"snapshot-rw" description:"Operation of the snapshot workload" default:"randwrite"`
+	CSnapshotBS    string  `long:"snapshot-bs" description:"Block size of the snapshot workload" default:"4k"`
+	CSnapshotDepth int     `long:"snapshot-iodepth" description:"IO depth of the snapshot workload" default:"8"`
+	CShare         string `long:"share" description:"Share the result dir of every VM with the guest, fio job files, logs and results then bypass SFTP: none, 9p or virtiofs" default:"none"`
+	CPlacement     string `long:"placement" description:"Comma separated list of placement policies, each one is a separate test case: none, disk-node (CPUs, memory and NVMe IRQs on the NUMA node of the disk), cpus (the CPUs of --pin-cpus)"`
+	CPinCPUs       string `long:"pin-cpus" description:"Host CPU list for the cpus placement, e.g. 4-11"`
+	CMemNode       int    `long:"mem-node" description:"NUMA node of guest memory for the cpus placement (default: the node of the first CPU)" default:"-1"`
+	CTopology      string `short:"T" long:"topology" description:"Semicolon separated list of multi-disk pool layouts used instead of --disktarget, e.g. \"mirror:sdb,sdc+log:nvme0n1;raidz1:sdb,sdc,sdd\" for zvol or \"raid1:sdb,sdc\" for lvm"`
+	CPlan          string `short:"P" long:"plan" description:"JSON file with the backends, frontends, topologies, zfs properties and backstore attributes of the test matrix"`
+	CBackend       string `short:"B" long:"backend" description:"Comma separated list of volume backends, each one is a separate test case: zvol, lvm, lvm-thin, file (raw images), qcow2, loop, dm-linear"`
+	CState         string `long:"state" description:"State file that records created resources for cleanup (default: autobench-state.json next to the binary)"`
+	CLuns          int    `long:"luns" description:"Number of test volumes per VM, vhost-scsi exports them as LUNs of one target" default:"1"`
+	CFrontend      string `short:"F" long:"frontend" description:"Comma separated list of frontends for the test volume, each one is a separate test case: virtio-blk, virtio-blk-iothread, virtio-scsi, vhost-scsi, vhost-user-blk, nvme, vhost-kernel-nvme"`
 }
 
 var qemuCmd QemuCommand
 var testFailed = make(chan bool)
 
 type VmConfig struct {
-	FileLocation string // default "bionic-server-cloudimg-i386.img"
-	Format       string // default "raw"
-	VCpus        string // default "2"
-	Memory       string // default "512"
-	Kernel       string // default ""
-	Password     string // default "asdfqwer"
-	VhostWWPN    string // no set by default
+	VCpus      string // default "2"
+	Memory     string // default "512"
+	BootImage  string
+	BootFormat string // default "raw"
+	Disks      []qemutmp.Disk
+	MemNode    int // host NUMA node of guest memory, -1 for any
+	Kernel     *kernelCase
+	Shares     []qemutmp.Share
+	Console    qemutmp.Console
 }
 
 type VirtM struct {
-	ctx          context.Context
-	cancel       context.CancelFunc
-	sshClient    *ssh.Client
-	timeOut      time.Duration
-	port         int
-	isRunning    bool
-	imgPath      string
-	userImg      string
-	resultPath   string
-	shareVolName string
-	iblockId     string
-	zfsDevice    string
-	lvmDevice    string
-	wwnAdress	 string
+	ctx           context.Context
+	cancel        context.CancelFunc
+	sshClient     *ssh.Client
+	timeOut       time.Duration
+	port          int
+	isRunning     bool
+	imgPath       string
+	userImg       string
+	resultPath    string
+	volumes       []string
+	backstores    []lio.Backstore
+	attribs       map[string]map[string]string
+	wwnAdress     string
+	nvmetPort     int
+	testDevices   []string
+	serials       []string
+	targetDevice  string
+	storageDaemon *exec.Cmd
+	share         qemutmp.ShareType
+	shareDaemon   *exec.Cmd
+	sshPort       int
+	tap           string
+	cid           uint32
+	bootStages    map[string]bool // logged so far
+	qmpSocket     string
+	daemonQMP     string // QMP socket of qemu-storage-daemon
+	drive         *driveRecord
+	filesystem    *fsprep.Config
+	backend       backend.Backend
+	qemuDone      chan struct{}
 }
 
 type VMlist []*VirtM
 
-func writeMainConfig(path string, template_args VmConfig, zfsType bool) error {
-	var curentTmp = qemutmp.QemuConfTemplate
-	if zfsType {
-		curentTmp = qemutmp.QemuConfVhostTemplate
-	}
+func writeMainConfig(path string, vmConfig VmConfig) error {
+	cfg := qemutmp.NewConfig(vmConfig.VCpus, vmConfig.Memory)
+	cfg.SetConsole(vmConfig.Console)
 
-	t, err := template.New("qemu").Parse(curentTmp)
-	if err != nil {
-		fmt.Printf("failed parse template%v\n", err)
-		return err
+	boot := qemutmp.Disk{
+		ID:       "hd",
+		Frontend: qemutmp.VirtioSCSI,
+		File:     vmConfig.BootImage,
+		Format:   vmConfig.BootFormat,
+		Bus:      "pcie.0",
+		Addr:     "0x7",
 	}
-
-	configFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-
-	if err != nil {
-		fmt.Printf("failed to open file %s: %v\n", path, err)
-		return err
+	if err := cfg.AttachDisk(boot); err != nil {
+		return fmt.Errorf("attach boot disk failed: %w", err)
 	}
-	defer configFile.Close()
 
-	if err = t.Execute(configFile, template_args); err != nil {
-		fmt.Println("cant parse template")
-		return err
+	for _, disk := range vmConfig.Disks {
+		if err := cfg.AttachDisk(disk); err != nil {
+			return fmt.Errorf("attach disk %s failed: %w", disk.ID, err)
+		}
+	}
+	for _, sh := range vmConfig.Shares {
+		if err := cfg.AttachShare(sh); err != nil {
+			return err
+		}
+	}
+	if vmConfig.MemNode >= 0 {
+		cfg.BindMemory(vmConfig.MemNode)
+	}
+	if k := vmConfig.Kernel; k != nil {
+		cfg.Machine.Kernel = k.info.Image
+		cfg.Machine.Initrd = k.Initrd
+		cfg.Machine.Append = k.Cmdline
 	}
 
-	return nil
+	return cfg.WriteFile(path)
 }
 
 func getSelfPath() string {
@@ -108,47 +187,19 @@ func getSelfPath() string {
 	return filepath.Dir(ex)
 }
 
-func getVMImage(index int, filename string) (string, error) {
-	if _, err := os.Stat(filepath.Join(getSelfPath(), filename)); err != nil {
-		if os.IsNotExist(err) {
-			return "", err
-		}
-	}
-
-	defPathImg := filepath.Join(getSelfPath(), filename)
-	if qemuCmd.CCountVM <= 1 {
-		return defPathImg, nil
-	}
-
-	fPath := filepath.Join(getSelfPath(), fmt.Sprintf("%d-%s", index, filename))
-	_, err := exec.Command("cp", defPathImg, fPath).CombinedOutput()
-	if err != nil {
-		fmt.Printf("Run command cp %s -> %s  failed: err %v", defPathImg, fPath, err)
-		return "", err
-	}
-
-	userDPathDef := filepath.Join(getSelfPath(), "user-data.img")
-	userDPath := filepath.Join(getSelfPath(), fmt.Sprintf("%d-%s", index, "user-data.img"))
-	_, err = exec.Command("cp", userDPathDef, userDPath).CombinedOutput()
-	if err != nil {
-		fmt.Printf("Run command cp %s -> %s  failed: err %v", userDPathDef, userDPath, err)
-		return "", err
-	}
-
-	return fPath, nil
-}
-
 // qemuVmRun go-routine function with running VM
 func qemuVmRun(ctx context.Context, vm VirtM, qemuConfigDir string) {
-	cmd := exec.CommandContext(ctx,
-		"qemu-system-x86_64",
+	args := []string{
+		"-name", fmt.Sprintf("vm%d,debug-threads=on", vm.port),
+		"-pidfile", filepath.Join(vm.resultPath, "qemu.pid"),
 		"-cpu", "host",
 		"-readconfig", qemuConfigDir,
-		"-drive", fmt.Sprintf("file=%s,format=raw,if=none,id=hd", vm.imgPath),
 		"-display", "none",
 		"-cdrom", vm.userImg,
-		"-device", "e1000,netdev=net0", "-netdev", fmt.Sprintf("user,id=net0,hostfwd=tcp::%d-:22", vm.port),
-		"-serial", "chardev:ch0")
+	}
+	args = append(args, vm.netArgs()...)
+	args = append(args, "-serial", "chardev:ch0")
+	cmd := exec.CommandContext(ctx, "qemu-system-x86_64", args...)
 
 	cmdStr := cmd.String()
 	qemuCmdFile, err := os.OpenFile(filepath.Join(vm.resultPath, "qemu-cmd.ini"),
@@ -162,106 +213,315 @@ func qemuVmRun(ctx context.Context, vm VirtM, qemuConfigDir string) {
 		fmt.Printf("failed write to file %s: %v\n", filepath.Join(vm.resultPath, "qemu-cmd.ini"), err)
 	}
 
-	var outbuf, errbuf bytes.Buffer
-	cmd.Stdout = &outbuf
-	cmd.Stderr = &errbuf
+	qemuLogPath := filepath.Join(vm.resultPath, "qemu.log")
+	qemuLog, err := os.Create(qemuLogPath)
+	if err != nil {
+		fmt.Printf("failed to open file %s: %v\n", qemuLogPath, err)
+	} else {
+		defer qemuLog.Close()
+		cmd.Stdout = qemuLog
+		cmd.Stderr = qemuLog
+	}
 
 	err = cmd.Run() // This command will never ends
 	if err != nil {
 		fmt.Printf("QEMU VM message: %v; description=%v\n", err, ctx.Err())
-		if outbuf.String() != "" {
-			fmt.Println("Output:", outbuf.String(), errbuf.String())
+		if output, rerr := ioutil.ReadFile(qemuLogPath); rerr == nil && len(output) != 0 {
+			fmt.Println("Output:", string(output))
 		}
 	}
 	vm.cancel()
+	close(vm.qemuDone)
 }
 
-func (t *VMlist) AllocateVM(ctx context.Context, totalTime time.Duration) error {
-	curentDate := time.Now().Format("2006-01-02-15:04:05")
-	mainResultsDirForCurentTest := filepath.Join(getSelfPath(), "FIO-results-QEMU-Target"+curentDate)
-	err := os.Mkdir(mainResultsDirForCurentTest, 0755)
-	if err != nil {
-		return fmt.Errorf("could not create local dir for result: %w", err)
+// vhostUserBlkSerial is the id qemu-storage-daemon reports for
+// vhost-user-blk exports, the guest sees it as virtio-vhost_user_blk
+const vhostUserBlkSerial = "vhost_user_blk"
+
+// startVhostUserBlk exports the test volume with qemu-storage-daemon and
+// returns the vhost-user socket path. The daemon lives as long as the VM.
+func (vm *VirtM) startVhostUserBlk(opts map[string]string) (string, error) {
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("autobench-vub-%d.sock", vm.port))
+	os.Remove(socket)
+	vm.daemonQMP = filepath.Join(os.TempDir(), fmt.Sprintf("autobench-vub-%d.qmp.sock", vm.port))
+	os.Remove(vm.daemonQMP)
+
+	driver := "file"
+	if fi, err := os.Stat(vm.testDevices[0]); err == nil && fi.Mode()&os.ModeDevice != 0 {
+		driver = "host_device"
+	}
+	cache, aio := daemonDrive(opts)
+	flags := cacheModes[cache]
+
+	// The export takes the top node, images stack their format driver and
+	// the compress filter on the file
+	blockdevs := []string{fmt.Sprintf("driver=%s,filename=%s,node-name=test,aio=%s", driver, vm.testDevices[0], aio)}
+	if format, props, compress := imageDrive(vm.backend); format != "" {
+		blockdevs[0] = strings.Replace(blockdevs[0], "node-name=test", "node-name=proto", 1)
+		img := fmt.Sprintf("driver=%s,file=proto,node-name=test", format)
+		for _, o := range props {
+			img += fmt.Sprintf(",%s=%s", o.Key, o.Value)
+		}
+		blockdevs = append(blockdevs, img)
+		if compress {
+			blockdevs[1] = strings.Replace(blockdevs[1], "node-name=test", "node-name=img", 1)
+			blockdevs = append(blockdevs, "driver=compress,file=img,node-name=test")
+		}
+	}
+	var args []string
+	for i, b := range blockdevs {
+		b += fmt.Sprintf(",cache.direct=%s,cache.no-flush=%s", onOff(flags[1]), onOff(flags[2]))
+		if discard := driveDiscard(opts); discard != "" {
+			b += ",discard=" + discard
+		}
+		if zeroes := opts["detect-zeroes"]; zeroes != "" && i == len(blockdevs)-1 {
+			b += ",detect-zeroes=" + zeroes
+		}
+		args = append(args, "--blockdev", b)
+	}
+	// Without a write cache the export flushes every write
+	export := fmt.Sprintf("type=vhost-user-blk,id=exp-test,node-name=test,addr.type=unix,addr.path=%s,writable=on", socket)
+	if !flags[0] {
+		export += ",writethrough=on"
+	}
+	args = append(args, "--export", export,
+		"--chardev", fmt.Sprintf("socket,id=qmp,path=%s,server=on,wait=off", vm.daemonQMP),
+		"--monitor", "chardev=qmp")
+	vm.storageDaemon = exec.CommandContext(vm.ctx, "qemu-storage-daemon", args...)
+	if err := vm.storageDaemon.Start(); err != nil {
+		vm.storageDaemon = nil
+		return "", fmt.Errorf("start qemu-storage-daemon failed: %w", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			return socket, nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return "", fmt.Errorf("vhost-user-blk socket %s did not appear", socket)
+}
+
+// imageDrive returns the format, the format driver options and the
+// compress filter of the volumes of image backends, an empty format for raw
+func imageDrive(be backend.Backend) (string, []qemutmp.Opt, bool) {
+	iv, ok := be.(backend.ImageVolumes)
+	if !ok {
+		return "", nil, false
+	}
+	opts, compress := iv.DriveOptions()
+	var keys []string
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var props []qemutmp.Opt
+	for _, k := range keys {
+		props = append(props, qemutmp.Opt{Key: k, Value: opts[k]})
+	}
+	return iv.Format(), props, compress
+}
+
+// attachTestDisk creates the test volume of the VM and returns the disk
+// attachment for the frontend of the test case
+func (vm *VirtM) attachTestDisk(tc testCase, be backend.Backend) ([]qemutmp.Disk, error) {
+	if tc.frontend.frontend == "" {
+		return nil, nil
+	}
+
+	FioOptions.SizeGb = (qemuCmd.CSizeDiskGb - 1) * qemuCmd.CLuns
+	vm.backend = be
+	for i := 0; i < qemuCmd.CLuns; i++ {
+		name := fmt.Sprintf("vm%d", vm.port)
+		info := "volume.json"
+		if i > 0 {
+			name = fmt.Sprintf("vm%d-lun%d", vm.port, i)
+			info = fmt.Sprintf("volume-lun%d.json", i)
+		}
+		if err := be.CreateVolume(name, qemuCmd.CSizeDiskGb); err != nil {
+			return nil, fmt.Errorf("create %s volume:[%s] failed: %w", be.Name(), name, err)
+		}
+		vm.volumes = append(vm.volumes, name)
+		vm.testDevices = append(vm.testDevices, be.DevicePath(name))
+		if err := writeVolumeInfo(filepath.Join(vm.resultPath, info), be, name); err != nil {
+			log.Printf("Attention! Could not describe volume %s: %v", name, err)
+		}
 	}
 
-	log.Printf("Creating %d virtual machines\n", qemuCmd.CCountVM)
+	switch tc.frontend.frontend {
+	case qemutmp.VhostSCSI:
+		// All volumes are LUNs of one vhost target
+		if err := vm.setupVhostTarget(tc.lioAttribs); err != nil {
+			return nil, fmt.Errorf("create VHOST for VM localhost:%d failed: %w", vm.port, err)
+		}
+		return []qemutmp.Disk{{
+			ID:       "test",
+			Frontend: qemutmp.VhostSCSI,
+			WWPN:     vm.wwnAdress,
+			Bus:      "pcie.0",
+			Addr:     "0x08",
+		}}, nil
+	case qemutmp.VhostUserBlk:
+		socket, err := vm.startVhostUserBlk(tc.driveOpts)
+		if err != nil {
+			return nil, err
+		}
+		vm.serials = []string{vhostUserBlkSerial}
+		return []qemutmp.Disk{{
+			ID:       "test",
+			Frontend: qemutmp.VhostUserBlk,
+			Socket:   socket,
+			Serial:   vhostUserBlkSerial,
+		}}, nil
+	}
 
-	for i := 0; i < qemuCmd.CCountVM; i++ {
+	var disks []qemutmp.Disk
+	format, props, compress := imageDrive(be)
+	for i, dev := range vm.testDevices {
+		disk := qemutmp.Disk{
+			ID:       "test",
+			Frontend: tc.frontend.frontend,
+			File:     dev,
+			Format:   format,
+			Props:    props,
+			Compress: compress,
+			Cache:    tc.driveOpts["cache"],
+			AIO:      tc.driveOpts["aio"],
+			Discard:  driveDiscard(tc.driveOpts),
+			Zeroes:   tc.driveOpts["detect-zeroes"],
+			Serial:   fmt.Sprintf("fiotest%d", vm.port),
+			IOThread: tc.frontend.iothread,
+		}
+		if i > 0 {
+			disk.ID = fmt.Sprintf("test%d", i)
+			disk.Serial = fmt.Sprintf("fiotest%d-%d", vm.port, i)
+		}
+		vm.serials = append(vm.serials, disk.Serial)
+		disks = append(disks, disk)
+	}
+
+	// The vhost-kernel-nvme device talks to the nvmet vhost port, set up
+	// the way configs/vhost.json does it
+	if tc.frontend.frontend == qemutmp.VhostKernelNVMe {
+		nqn := fmt.Sprintf("nqn.2014-08.org.nvmexpress:%s%d", namePrefix, vm.port)
+		cfg := lio.NvmetVhostConfig(nqn, vm.serials[0], vm.testDevices[0], vm.port)
+		if err := res.Add(lio.KindNvmetSubsystem, nqn); err != nil {
+			return nil, err
+		}
+		if err := res.Add(lio.KindNvmetPort, strconv.Itoa(vm.port)); err != nil {
+			return nil, err
+		}
+		if err := lio.ApplyNvmet(cfg); err != nil {
+			return nil, fmt.Errorf("create nvmet target for VM localhost:%d failed: %w", vm.port, err)
+		}
+		vm.nvmetPort = vm.port
+	}
+	return disks, nil
+}
+
+// setupVhostTarget exports every test volume of the VM through an iblock
+// backstore as a LUN of one vhost-scsi target. The attributes are set
+// before the export and read back for the run manifest.
+func (vm *VirtM) setupVhostTarget(attribs map[string]string) error {
+	vm.attribs = map[string]map[string]string{}
+	for i, dev := range vm.testDevices {
+		b := lio.Backstore{Plugin: lio.IBlock, Name: fmt.Sprintf("%s%d_lun%d", namePrefix, vm.port, i)}
+		// CreateBackstore may leave the backstore behind when it fails
+		if err := res.Add(lio.KindBackstore, b.String()); err != nil {
+			return err
+		}
+		serial, err := lio.CreateBackstore(b, lio.BackstoreConfig{Dev: dev})
+		if err != nil {
+			return err
+		}
+		vm.backstores = append(vm.backstores, b)
+		vm.serials = append(vm.serials, serial)
+		if err := lio.SetAttribs(b, attribs); err != nil {
+			return err
+		}
+		effective, err := lio.ReadAttribs(b)
+		if err != nil {
+			return err
+		}
+		vm.attribs[b.String()] = effective
+	}
+
+	vm.wwnAdress = "naa." + lio.GenerateNaaSerial()
+	if err := res.Add(lio.KindTarget, string(lio.Vhost), vm.wwnAdress); err != nil {
+		return err
+	}
+	if err := lio.CreateTPG(lio.Vhost, vm.wwnAdress, 1); err != nil {
+		return err
+	}
+	for i, b := range vm.backstores {
+		if err := lio.AddLUN(lio.Vhost, vm.wwnAdress, 1, i, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllocateVM boots count more VMs, numbered after the ones already in t
+func (t *VMlist) AllocateVM(ctx context.Context, totalTime time.Duration, resultsDir string, tc testCase, be backend.Backend, place *placementPlan, count int) error {
+	log.Printf("Creating %d virtual machines\n", count)
+
+	// QEMU takes its forwarded port only once it runs
+	taken := map[int]bool{}
+	for _, vm := range *t {
+		taken[vm.sshPort] = true
+	}
+	first := len(*t)
+	for i := first; i < first+count; i++ {
+		var err error
 		var vm VirtM
 		vm.ctx, vm.cancel = context.WithTimeout(ctx, totalTime)
 		vm.port = qemuCmd.CPort + i
 		vm.timeOut = totalTime
-		vm.shareVolName = fmt.Sprintf("vm%d", vm.port)
-		vm.zfsDevice = filepath.Join("/dev/zvol/", "fiotest/", vm.shareVolName) // /dev/zvol/tank/test-zvol
-		vm.lvmDevice = filepath.Join("/dev/", "fiotest/", vm.shareVolName)
-		vm.iblockId = fmt.Sprintf("fiotest%d_iblock", vm.port)
-		vm.userImg = filepath.Join(getSelfPath(), "user-data.img")
-		vm.imgPath, err = getVMImage(i, qemuCmd.CFileLocation)
-
+		vm.imgPath, vm.userImg, err = prepareGuestImages(vm.port)
 		if err != nil {
 			return fmt.Errorf("create VM with adress localhost:%d failed! err:\n%v", vm.port, err)
 		}
-
-		if qemuCmd.CCountVM > 1 {
-			vm.userImg = filepath.Join(getSelfPath(), fmt.Sprintf("%d-%s", i, "user-data.img"))
+		if err := vm.setupNet(taken); err != nil {
+			return fmt.Errorf("network of VM localhost:%d failed: %w", vm.port, err)
 		}
+		taken[vm.sshPort] = true
 
-		vm.resultPath = filepath.Join(mainResultsDirForCurentTest, fmt.Sprintf("vm-port-%d", vm.port))
+		vm.resultPath = filepath.Join(resultsDir, fmt.Sprintf("vm-port-%d", vm.port))
 		err = os.Mkdir(vm.resultPath, 0755)
 		if err != nil {
 			return fmt.Errorf("could not create local dir:[%s] for result: %w", vm.resultPath, err)
 		}
 
-		if qemuCmd.CZfs || qemuCmd.CLvm {
-			FioOptions.SizeGb = qemuCmd.CSizeDiskGb - 1
-			if qemuCmd.CZfs {
-				if err := vhost.CreateZvol("fiotest", vm.shareVolName,
-											qemuCmd.CBsZfs, qemuCmd.CZipZFS,
-											qemuCmd.CPRcacheZFS, qemuCmd.CLogbiasZFS,
-											qemuCmd.CRdMetadataZFS, qemuCmd.CSizeDiskGb); err != nil {
-					return fmt.Errorf("create zvol:[%s] for VM with adress localhost:%d failed! err:\n%v",
-						vm.shareVolName, vm.port, err)
-				}
-				vm.wwnAdress, err = vhost.SetupVhost(vm.zfsDevice, vm.iblockId)
-			} else {
-				if err := vhost.LVcreate(vm.shareVolName, "fiotest", qemuCmd.CSizeDiskGb); err != nil {
-					return fmt.Errorf("create lvmVol:[%s] for VM with adress localhost:%d failed! err:\n%v",
-						vm.shareVolName, vm.port, err)
-				}
-				vm.wwnAdress, err = vhost.SetupVhost(vm.lvmDevice, vm.iblockId)
-			}
-			if err != nil {
-				return fmt.Errorf("create VHOST for vol:[%s] for VM with adress localhost:%d failed! err:\n%v",
-					vm.shareVolName, vm.port, err)
-			}
+		disks, err := vm.attachTestDisk(tc, be)
+		if err != nil {
+			vm.stop()
+			return fmt.Errorf("create test disk for VM with adress localhost:%d failed! err:\n%v", vm.port, err)
+		}
 
-			templateArgs := VmConfig{
-				FileLocation: qemuCmd.CFileLocation,
-				Format:       qemuCmd.CFormat,
-				VCpus:        qemuCmd.CVCpus,
-				Memory:       qemuCmd.CMemory,
-				Password:     qemuCmd.CPassword,
-				VhostWWPN:    vm.wwnAdress,
-			}
-			if err := writeMainConfig(filepath.Join(vm.resultPath, "qemu.cfg"),
-									  templateArgs, true); err != nil {
-				// FIX ME del vhost and zvol or lv
-				return fmt.Errorf("copy qemu vhost config to:[%s] failed! err:%v", vm.resultPath, err)
-			}
-		} else {
-			templateArgs := VmConfig{
-				FileLocation: qemuCmd.CFileLocation,
-				Format:       qemuCmd.CFormat,
-				VCpus:        qemuCmd.CVCpus,
-				Memory:       qemuCmd.CMemory,
-				Password:     qemuCmd.CPassword,
-			}
-			if err := writeMainConfig(filepath.Join(vm.resultPath, "qemu.cfg"),
-									  templateArgs, false); err != nil {
-				return fmt.Errorf("copy qemu config to:[%s] failed! err:%v", vm.resultPath, err)
-			}
+		vmConfig := VmConfig{
+			VCpus:      qemuCmd.CVCpus,
+			Memory:     qemuCmd.CMemory,
+			BootImage:  vm.imgPath,
+			BootFormat: "qcow2",
+			Disks:      disks,
+			MemNode:    -1,
+			Kernel:     tc.kernel,
+			Console:    vm.console(),
+		}
+		vm.qmpSocket = vmConfig.Console.QMPSocket
+		if vmConfig.Shares, err = vm.startShare(); err != nil {
+			vm.stop()
+			return fmt.Errorf("share for VM localhost:%d failed: %w", vm.port, err)
+		}
+		if place != nil {
+			vmConfig.MemNode = place.memNode
+		}
+		if err := writeMainConfig(filepath.Join(vm.resultPath, "qemu.cfg"), vmConfig); err != nil {
+			vm.stop()
+			return fmt.Errorf("write qemu config to:[%s] failed! err:%v", vm.resultPath, err)
 		}
 
+		vm.qemuDone = make(chan struct{})
 		go qemuVmRun(vm.ctx, vm, filepath.Join(vm.resultPath, "qemu.cfg"))
 
 		config := &ssh.ClientConfig{
@@ -274,7 +534,8 @@ func (t *VMlist) AllocateVM(ctx context.Context, totalTime time.Duration) error
 
 		const tryTimes = 30
 		for i := 0; i < tryTimes; i++ {
-			vm.sshClient, err = ssh.Dial("tcp", fmt.Sprintf("localhost:%d", vm.port), config)
+			vm.sshClient, err = vm.dialSSH(config)
+			vm.logBootStages()
 			if err != nil {
 				vm.isRunning = false
 			} else {
@@ -283,8 +544,9 @@ func (t *VMlist) AllocateVM(ctx context.Context, totalTime time.Duration) error
 				break
 			}
 			if vm.ctx.Err() == context.Canceled || vm.ctx.Err() == context.DeadlineExceeded {
-				return fmt.Errorf("create VM with adress localhost:%d failed! err:\n%v",
-					vm.port, vm.ctx.Err())
+				vm.stop()
+				return vm.bootError(fmt.Errorf("create VM with adress localhost:%d failed! err:\n%w",
+					vm.port, vm.ctx.Err()))
 			}
 			time.Sleep(3 * time.Second)
 		}
@@ -294,49 +556,80 @@ func (t *VMlist) AllocateVM(ctx context.Context, totalTime time.Duration) error
 		}
 
 		if err != nil {
-			vm.cancel()
-			for _, vmo := range *t {
-				vmo.cancel()
-			}
-			// FIX ME del vhost and zvol or lv
-			return fmt.Errorf("create VM with adress localhost:%d failed! err:%v", vm.port, err)
+			vm.stop()
+			return vm.bootError(fmt.Errorf("create VM with adress localhost:%d failed! err:%w", vm.port, err))
 		}
 
 		*t = append(*t, &vm)
+		if err := vm.checkDrive(tc); err != nil {
+			return fmt.Errorf("VM localhost:%d: %w", vm.port, err)
+		}
+		if tc.kernel != nil {
+			if err := vm.checkGuestKernel(tc.kernel); err != nil {
+				return fmt.Errorf("VM localhost:%d: %w", vm.port, err)
+			}
+		}
+		if err := vm.waitGuestReady(); err != nil {
+			return vm.bootError(fmt.Errorf("VM localhost:%d is not ready: %w", vm.port, err))
+		}
+		if vm.share != "" {
+			if err := vm.mountShare(); err != nil {
+				return fmt.Errorf("VM localhost:%d: %w", vm.port, err)
+			}
+		}
 	}
 
 	return nil
 }
 
+// stop kills QEMU and the storage daemon of the VM and waits for them,
+// the test volume stays busy until they are gone
+func (vm *VirtM) stop() {
+	vm.cancel()
+	if vm.qemuDone != nil {
+		select {
+		case <-vm.qemuDone:
+		case <-time.After(30 * time.Second):
+			log.Printf("QEMU on port %d did not exit in time", vm.port)
+		}
+	}
+	if vm.storageDaemon != nil {
+		vm.storageDaemon.Wait()
+	}
+	if vm.shareDaemon != nil {
+		vm.shareDaemon.Wait()
+	}
+}
+
+// FreeVM stops the VMs and removes their volumes and targets
 func (t VMlist) FreeVM() {
 	for _, vm := range t {
 		vm.sshClient.Close()
-		vm.cancel()
-		//If we have only one VM we shouldn't delete img`s
-		if qemuCmd.CCountVM > 1 {
-			if err := os.Remove(vm.imgPath); err != nil {
-				log.Printf("Remove %s failed! err:%v", vm.imgPath, err)
+		vm.stop()
+
+		if vm.nvmetPort != 0 {
+			if err := res.Undo(lio.KindNvmetPort, strconv.Itoa(vm.nvmetPort)); err != nil {
+				log.Printf("Remove nvmet port: %d failed! err:%v", vm.nvmetPort, err)
 			}
-			if err := os.Remove(vm.userImg); err != nil {
-				log.Printf("Remove %s failed! err:%v", vm.imgPath, err)
+			nqn := fmt.Sprintf("nqn.2014-08.org.nvmexpress:%s%d", namePrefix, vm.port)
+			if err := res.Undo(lio.KindNvmetSubsystem, nqn); err != nil {
+				log.Printf("Remove nvmet subsystem: %s failed! err:%v", nqn, err)
 			}
 		}
-
-		if qemuCmd.CZfs || qemuCmd.CLvm {
-			if err := vhost.VHostDeleteIBlock(vm.wwnAdress); err != nil {
+		if vm.wwnAdress != "" {
+			if err := res.Undo(lio.KindTarget, string(lio.Vhost), vm.wwnAdress); err != nil {
 				log.Printf("Remove VHOST wwn: %s failed! err:%v", vm.wwnAdress, err)
 			}
-			if err := vhost.TargetDeleteIBlock(vm.iblockId); err != nil {
-				log.Printf("Remove Target: %s failed! err:%v", vm.iblockId, err)
+		}
+		for _, b := range vm.backstores {
+			if err := res.Undo(lio.KindBackstore, b.String()); err != nil {
+				log.Printf("Remove backstore: %s failed! err:%v", b, err)
 			}
-			if qemuCmd.CZfs {
-				if err := vhost.DestroyZvol("fiotest", vm.shareVolName); err != nil {
-					log.Printf("Remove zvol: %s failed! err:%v", vm.shareVolName, err)
-				}
-			} else {
-				if err := vhost.LVremove(vm.shareVolName, "fiotest"); err != nil {
-					log.Printf("LVremove %s failed err:%v", vm.shareVolName, err)
-				}
+		}
+
+		for _, name := range vm.volumes {
+			if err := vm.backend.DestroyVolume(name); err != nil {
+				log.Printf("Remove volume: %s failed! err:%v", name, err)
 			}
 		}
 	}
@@ -347,106 +640,389 @@ func (t VMlist) FreeVM() {
 func fio(virt *VirtM, localResultsFolder,
 	targetDevice string, fioOptions mkconfig.FioOptions,
 	fioTestTime time.Duration) {
-	// FIX ME change target device if we have zfs option
-	if err := fiotests.RunFIOTest(virt.sshClient, qemuCmd.CUser, localResultsFolder,
-		virt.resultPath, targetDevice, fioOptions,
-		fioTestTime); err != nil {
+	if err := virt.runFIO("", localResultsFolder, targetDevice, fioOptions, fioTestTime); err != nil {
 		log.Printf("FIO tests failed on VM [%s]: error: %v",
 			fmt.Sprintf("localhost:%d", virt.port), err)
-		testFailed <- true
+		select {
+		case testFailed <- true:
+		default:
+		}
 	}
 	log.Printf("Test on a VM with port: %d finished! Wait for VM to complete.", virt.port)
 }
 
-// RunCommand - Starts the testing process for qemu target
-func RunCommand(ctx context.Context, virtM VMlist) error {
-	if err := InitFioOptions(); err != nil {
-		return fmt.Errorf("error get fio params: %w", err)
+// runFIO runs fio on the VM with the results in the sub dir of its result dir
+func (virt *VirtM) runFIO(sub, localResultsFolder, targetDevice string, fioOptions mkconfig.FioOptions, fioTestTime time.Duration) error {
+	localDir := filepath.Join(virt.resultPath, sub)
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return fmt.Errorf("could not create local dir:[%s] for result: %w", localDir, err)
 	}
-
-	var countTests = mkconfig.CountTests(FioOptions)
-	const bufferTime = 6 * time.Minute
-	var totalTime = time.Duration(int64(countTests)*int64(time.Duration(opts.TimeOneTest) * time.Second) + int64(bufferTime))
-
-	if qemuCmd.CZfs && qemuCmd.CTargetDisk != "" {
-		if err := vhost.CheckZfsOnSystem(); err != nil {
-			return fmt.Errorf("ZFS not found: %v", err)
-		}
-		if err := vhost.CreateZpool("fiotest", qemuCmd.CTargetDisk); err != nil {
-			return fmt.Errorf("create zpool failed: %v", err)
+	if virt.filesystem != nil {
+		run := fsprep.SSH(virt.sshClient)
+		var err error
+		if fioOptions, err = prepareFilesystem(run, virt.filesystem, targetDevice, localDir, fioOptions); err != nil {
+			return err
 		}
+		defer func() {
+			if err := fsprep.Release(run, fsMountPoint); err != nil {
+				log.Printf("VM localhost:%d: %v", virt.port, err)
+			}
+		}()
+		targetDevice = ""
+	}
+	if virt.share != "" {
+		return fiotests.RunFIOTestShared(virt.sshClient, qemuCmd.CUser,
+			localDir, path.Join(guestShareDir, sub), targetDevice, fioOptions, fioTestTime)
 	}
+	return fiotests.RunFIOTest(virt.sshClient, qemuCmd.CUser, localResultsFolder,
+		localDir, targetDevice, fioOptions, fioTestTime)
+}
 
-	if qemuCmd.CLvm && qemuCmd.CTargetDisk != "" {
-		if err := vhost.CheckLvmOnSystem(); err != nil {
-			return fmt.Errorf("lvm not found: %v", err)
+// findTestDevices finds the test volumes of the VMs in the guests
+func (t VMlist) findTestDevices(tc testCase) error {
+	// fio must hit the attached volume, not a file on the boot disk,
+	// so refuse to run if the volume cannot be found in the guest
+	for _, vm := range t {
+		vm.targetDevice = opts.TargetFIODevice
+		vm.filesystem = tc.filesystem
+		if len(vm.serials) == 0 {
+			continue
 		}
-		if err := vhost.PVcreate(qemuCmd.CTargetDisk); err != nil {
-			return fmt.Errorf("pvcreate failed: %v", err)
+		// fio takes several devices as a colon separated filename
+		var devices []string
+		for _, serial := range vm.serials {
+			dev, err := findGuestDevice(vm.sshClient, tc.frontend.frontend, serial)
+			if err != nil {
+				return fmt.Errorf("test volume of VM localhost:%d not found: %w", vm.port, err)
+			}
+			devices = append(devices, dev)
 		}
-		if err := vhost.VGcreate(qemuCmd.CTargetDisk, "fiotest"); err != nil {
-			return fmt.Errorf("vgcreate failed: %v", err)
+		vm.targetDevice = strings.Join(devices, ":")
+		if opts.TargetFIODevice != "" && opts.TargetFIODevice != vm.targetDevice {
+			log.Printf("VM localhost:%d: --targetdev %s ignored, the test volume is attached as %s",
+				vm.port, opts.TargetFIODevice, vm.targetDevice)
+		}
+		log.Printf("VM localhost:%d: %s test volume is %s", vm.port, tc.frontend.name, vm.targetDevice)
+	}
+	return nil
+}
+
+// recordBackstores adds the backstore attributes of the VMs to the manifest
+func (t VMlist) recordBackstores(mc *manifestCase) {
+	for _, vm := range t {
+		for b, attribs := range vm.attribs {
+			mc.Backstores[fmt.Sprintf("localhost:%d/%s", vm.port, b)] = attribs
 		}
 	}
+}
+
+// runTestCase boots the VMs of one matrix cell, runs fio on all of them and
+// tears the VMs down again
+func runTestCase(ctx context.Context, tc testCase, be backend.Backend, resultsDir string, totalTime time.Duration, mc *manifestCase) error {
+	var virtM = make(VMlist, 0)
 
 	ctxVMs, cancelVMS := context.WithTimeout(ctx, totalTime)
-	err := virtM.AllocateVM(ctxVMs, totalTime)
+	defer cancelVMS()
+	// VMs that came up before a failure are freed as well
+	defer func() { virtM.FreeVM() }()
+	place, err := resolvePlacement(tc)
+	if err != nil {
+		return fmt.Errorf("placement %s failed: %w", tc.placement, err)
+	}
+	err = virtM.AllocateVM(ctxVMs, totalTime, resultsDir, tc, be, place, qemuCmd.CCountVM)
 	if err != nil {
-		cancelVMS()
 		return fmt.Errorf("vm create in QEMU failed err:%v", err)
 	}
+	virtM.recordBackstores(mc)
+	virtM.recordDrives(mc)
+	if err := virtM.findTestDevices(tc); err != nil {
+		return err
+	}
+
+	// Threads and IRQs are pinned once the guest drivers have started the
+	// vhost workers
+	if place != nil {
+		rec, err := applyPlacement(virtM, place)
+		if rec != nil {
+			mc.Placement = rec
+			defer rec.restore()
+		}
+		if err != nil {
+			return fmt.Errorf("placement %s failed: %w", tc.placement, err)
+		}
+		log.Printf("Placement %s: CPUs %s, memory node %d", place.policy, rec.CPUs, place.memNode)
+	}
 
+	// Backend statistics are taken around the fio runs of the case
+	if sc, ok := be.(backend.StatsCollector); ok {
+		if err := sc.CollectStats(resultsDir, "start"); err != nil {
+			log.Printf("Attention! Could not collect %s stats: %v", be.Name(), err)
+		}
+		defer func() {
+			if err := sc.CollectStats(resultsDir, "end"); err != nil {
+				log.Printf("Attention! Could not collect %s stats: %v", be.Name(), err)
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
 	for _, vm := range virtM {
 		time.Sleep(5 * time.Second) // For create new folder for new test with other name
-		go fio(
-			vm,
-			opts.LocalFolderResults,
-			opts.TargetFIODevice,
-			FioOptions,
-			time.Duration(opts.TimeOneTest) * time.Second,
-		)
+		wg.Add(1)
+		go func(vm *VirtM) {
+			defer wg.Done()
+			fio(
+				vm,
+				opts.LocalFolderResults,
+				vm.targetDevice,
+				FioOptions,
+				time.Duration(opts.TimeOneTest) * time.Second,
+			)
+		}(vm)
 	}
+	allDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(allDone)
+	}()
 
 	// Heartbeat
-	fmt.Println("Total generated tests:", countTests)
-	fmt.Println("Total waiting time before the end of the test:", totalTime)
 	timerTomeOut := time.After(totalTime)
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
 
 there:
 	for {
 		select {
 		case <-timerTomeOut:
-			ticker.Stop()
 			break there
 		case <-testFailed:
-			ticker.Stop()
 			break there
+		case <-allDone:
+			break there
+		case <-ctx.Done():
+			return fmt.Errorf("test case %s interrupted: %w", tc.name, ctx.Err())
+		}
+	}
+
+	fmt.Printf("All FIO tests of %s finished!\n", tc.name)
+	return nil
+}
+
+// provisionBackend checks the tools of the backend of a test case and
+// prepares its pool on the target disk
+func provisionBackend(tc testCase, resultsDir string) (backend.Backend, error) {
+	cfg := backend.Config{
+		Pool: namePrefix,
+		Disk: qemuCmd.CTargetDisk,
+		Dir:  resultsDir,
+
+		SnapshotGb: qemuCmd.CSnapshotSize,
+	}
+	if tc.topology != nil {
+		cfg.Disk = ""
+		cfg.Topology = tc.topology
+	}
+	if tc.backend == "zvol" {
+		cfg.Props = map[string]string{
+			"volblocksize":       qemuCmd.CBsZfs,
+			"compression":        qemuCmd.CZipZFS,
+			"primarycache":       qemuCmd.CPRcacheZFS,
+			"logbias":            qemuCmd.CLogbiasZFS,
+			"redundant_metadata": qemuCmd.CRdMetadataZFS,
+		}
+		for k, v := range tc.zfsProps {
+			cfg.Props[k] = v
+		}
+	}
+	if len(tc.imageOpts) != 0 {
+		cfg.Props = tc.imageOpts
+	}
+
+	be, err := backend.New(tc.backend, cfg, res)
+	if err != nil {
+		return nil, err
+	}
+	if err := be.Check(); err != nil {
+		return nil, fmt.Errorf("%s backend is not usable: %w", be.Name(), err)
+	}
+	if err := be.Provision(); err != nil {
+		return nil, fmt.Errorf("provision %s backend failed: %w", be.Name(), err)
+	}
+	return be, nil
+}
 
+// writeVolumeInfo records the backend and the effective properties of a volume
+func writeVolumeInfo(path string, be backend.Backend, name string) error {
+	props, err := be.Describe(name)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(struct {
+		Backend    string            `json:"backend"`
+		Device     string            `json:"device"`
+		Properties map[string]string `json:"properties"`
+	}{be.Name(), be.DevicePath(name), props}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// RunCommand - Starts the testing process for qemu target
+func RunCommand(ctx context.Context) error {
+	if err := InitFioOptions(); err != nil {
+		return fmt.Errorf("error get fio params: %w", err)
+	}
+
+	if qemuCmd.CPlan != "" {
+		if err := loadPlan(qemuCmd.CPlan); err != nil {
+			return err
+		}
+	}
+
+	cases, err := buildTestCases()
+	if err != nil {
+		return fmt.Errorf("error get test matrix: %w", err)
+	}
+	if err := checkShare(); err != nil {
+		return err
+	}
+	if err := checkNet(); err != nil {
+		return err
+	}
+	for _, tc := range cases {
+		switch tc.frontend.frontend {
+		case qemutmp.VhostSCSI:
+			if err := lio.CheckFabric(lio.Vhost); err != nil {
+				return fmt.Errorf("vhost-scsi is not usable: %w", err)
+			}
+		case qemutmp.VhostKernelNVMe:
+			if err := lio.CheckNvmet(); err != nil {
+				return fmt.Errorf("vhost-kernel-nvme is not usable: %w", err)
+			}
 		}
 	}
 
-	fmt.Println("All FIO tests finished!")
-	virtM.FreeVM()
-	cancelVMS()
-	if qemuCmd.CZfs {
-		if err := vhost.DestroyZpool("fiotest"); err != nil {
-			fmt.Println("Destroy zpool failed", err)
+	var countTests = mkconfig.CountTests(FioOptions)
+	const bufferTime = 6 * time.Minute
+	var totalTime = time.Duration(int64(countTests)*int64(time.Duration(opts.TimeOneTest) * time.Second) + int64(bufferTime))
+	runCase := runTestCase
+	if qemuCmd.CDensity {
+		if err := checkDensity(); err != nil {
+			return err
 		}
+		countTests = 1
+		totalTime = densityTotalTime()
+		runCase = runDensityCase
 	}
-	if qemuCmd.CLvm {
-		if err := vhost.DestroyLvm(qemuCmd.CTargetDisk, "fiotest"); err != nil {
-			fmt.Println("Destroy zpool failed", err)
+	if qemuCmd.CDiscard {
+		if err := checkDiscard(cases); err != nil {
+			return err
 		}
+		countTests = 2 * len(splitList(qemuCmd.CDiscardBS))
+		totalTime = discardTotalTime()
+		runCase = runDiscardCase
 	}
-	return nil
+	if qemuCmd.CSnapshots > 0 {
+		if err := checkSnapshot(cases); err != nil {
+			return err
+		}
+		countTests = qemuCmd.CSnapshots + 2
+		totalTime = snapshotTotalTime()
+		runCase = runSnapshotCase
+	}
+
+	statePath := qemuCmd.CState
+	if statePath == "" {
+		statePath = defaultStatePath()
+	}
+	res, err = tracker.New(statePath)
+	if err != nil {
+		return fmt.Errorf("could not start state file: %w", err)
+	}
+	log.Printf("Created resources are recorded in %s", res.Path())
+	// Everything still tracked is undone at exit, after failures and on
+	// panics of the main goroutine
+	defer func() {
+		if err := res.Rollback(); err != nil {
+			fmt.Println("Attention! Cleanup failed, run `autobench cleanup`:", err)
+		}
+	}()
+
+	curentDate := time.Now().Format("2006-01-02-15:04:05")
+	mainResultsDirForCurentTest := filepath.Join(getSelfPath(), "FIO-results-QEMU-Target"+curentDate)
+	if err := os.Mkdir(mainResultsDirForCurentTest, 0755); err != nil {
+		return fmt.Errorf("could not create local dir for result: %w", err)
+	}
+
+	manifest := newRunManifest(mainResultsDirForCurentTest)
+	manifest.Network = qemuCmd.CNet
+	if manifest.Image, err = describeBaseImage(); err != nil {
+		return err
+	}
+
+	fmt.Println("Total test cases:", len(cases))
+	fmt.Println("Total generated tests per case:", countTests)
+	fmt.Println("Total waiting time before the end of the test:", time.Duration(len(cases)) * totalTime)
+
+	// Cases are ordered by backend setup, so each pool is provisioned once
+	// and destroyed before the next backend or zfs combination takes the disk
+	var be backend.Backend
+	var backendKey string
+	for _, tc := range cases {
+		if tc.frontend.frontend != "" && (be == nil || backendKey != tc.backendKey()) {
+			if be != nil {
+				if err = be.Destroy(); err != nil {
+					err = fmt.Errorf("destroy %s backend failed: %w", be.Name(), err)
+					break
+				}
+			}
+			if be, err = provisionBackend(tc, mainResultsDirForCurentTest); err != nil {
+				break
+			}
+			backendKey = tc.backendKey()
+		}
+
+		caseDir := filepath.Join(mainResultsDirForCurentTest, tc.name)
+		if err = os.Mkdir(caseDir, 0755); err != nil {
+			err = fmt.Errorf("could not create local dir for %s: %w", tc.name, err)
+			break
+		}
+		err = runCase(ctx, tc, be, caseDir, totalTime, manifest.addCase(tc))
+		if werr := manifest.write(); werr != nil {
+			fmt.Println("Attention!", werr)
+		}
+		if err != nil {
+			err = fmt.Errorf("test case %s failed: %w", tc.name, err)
+			break
+		}
+	}
+
+	if err == nil && qemuCmd.CSnapshots > 0 {
+		if err := writeSnapshotComparison(mainResultsDirForCurentTest, cases, manifest); err != nil {
+			fmt.Println("Attention! Could not create snapshot comparison:", err)
+		}
+	} else if err == nil && qemuCmd.CDiscard {
+		if err := writeDiscardComparison(mainResultsDirForCurentTest, cases, manifest); err != nil {
+			fmt.Println("Attention! Could not create discard comparison:", err)
+		}
+	} else if err == nil && qemuCmd.CDensity {
+		if err := writeDensityComparison(mainResultsDirForCurentTest, cases, manifest); err != nil {
+			fmt.Println("Attention! Could not create density comparison:", err)
+		}
+	} else if err == nil {
+		if err := writeComparisonReport(mainResultsDirForCurentTest, cases); err != nil {
+			fmt.Println("Attention! Could not create comparison report:", err)
+		}
+	}
+	return err
 }
 
 func (x *QemuCommand) Execute(args []string) error {
-	ctx := context.Background()
-	var virtM = make(VMlist, 0)
-	err := RunCommand(ctx, virtM)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(cancel)
+
+	err := RunCommand(ctx)
 	if err != nil {
 		return fmt.Errorf("qemu test failed: %v", err)
 	}
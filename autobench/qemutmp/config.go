@@ -0,0 +1,363 @@
+package qemutmp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Opt is a single `key = "value"` line of a -readconfig section
+type Opt struct {
+	Key   string
+	Value string
+}
+
+// Section is one `[type "name"]` group of a QEMU -readconfig file
+type Section struct {
+	Type string
+	Name string
+	Opts []Opt
+}
+
+// Set replaces the value of key or appends it if the key is not present
+func (s *Section) Set(key, value string) *Section {
+	for i := range s.Opts {
+		if s.Opts[i].Key == key {
+			s.Opts[i].Value = value
+			return s
+		}
+	}
+	s.Opts = append(s.Opts, Opt{Key: key, Value: value})
+	return s
+}
+
+// setIf sets key only when value is not empty
+func (s *Section) setIf(key, value string) *Section {
+	if value != "" {
+		s.Set(key, value)
+	}
+	return s
+}
+
+func (s Section) writeTo(w io.Writer) error {
+	header := fmt.Sprintf("[%s]\n", s.Type)
+	if s.Name != "" {
+		header = fmt.Sprintf("[%s %q]\n", s.Type, s.Name)
+	}
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	for _, o := range s.Opts {
+		if _, err := fmt.Fprintf(w, "  %s = %q\n", o.Key, o.Value); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// Machine describes the [machine] section
+type Machine struct {
+	Type          string
+	Accel         string
+	KernelIrqchip string
+	MemoryBackend string
+	Kernel        string // direct boot, the boot disk only holds the root fs
+	Initrd        string
+	Append        string
+	Props         []Opt
+}
+
+func (m Machine) section() Section {
+	s := Section{Type: "machine"}
+	s.setIf("type", m.Type)
+	s.Set("dump-guest-core", "off")
+	s.setIf("accel", m.Accel)
+	s.Set("vmport", "off")
+	s.setIf("kernel-irqchip", m.KernelIrqchip)
+	s.Set("graphics", "off")
+	s.setIf("memory-backend", m.MemoryBackend)
+	s.setIf("kernel", m.Kernel)
+	s.setIf("initrd", m.Initrd)
+	s.setIf("append", m.Append)
+	for _, o := range m.Props {
+		s.Set(o.Key, o.Value)
+	}
+	return s
+}
+
+// SMP describes the [smp-opts] section
+type SMP struct {
+	CPUs    string
+	Sockets string
+	Cores   string
+	Threads string
+}
+
+func (p SMP) section() Section {
+	s := Section{Type: "smp-opts"}
+	s.setIf("cpus", p.CPUs)
+	s.setIf("sockets", p.Sockets)
+	s.setIf("cores", p.Cores)
+	s.setIf("threads", p.Threads)
+	return s
+}
+
+// Memory describes the [memory] section, Size is in megabytes
+type Memory struct {
+	Size string
+}
+
+func (m Memory) section() Section {
+	s := Section{Type: "memory"}
+	s.setIf("size", m.Size)
+	return s
+}
+
+// Drive describes a [drive "id"] section
+type Drive struct {
+	ID     string
+	File   string
+	Format string
+	If     string
+	Props  []Opt
+}
+
+func (d Drive) section() Section {
+	s := Section{Type: "drive", Name: d.ID}
+	s.setIf("file", d.File)
+	s.setIf("format", d.Format)
+	s.setIf("if", d.If)
+	for _, o := range d.Props {
+		s.Set(o.Key, o.Value)
+	}
+	return s
+}
+
+// Device describes a [device "id"] section, the ID may be empty
+type Device struct {
+	ID     string
+	Driver string
+	Props  []Opt
+}
+
+func (d Device) section() Section {
+	s := Section{Type: "device", Name: d.ID}
+	s.Set("driver", d.Driver)
+	for _, o := range d.Props {
+		s.Set(o.Key, o.Value)
+	}
+	return s
+}
+
+// Chardev describes a [chardev "id"] section
+type Chardev struct {
+	ID      string
+	Backend string
+	Path    string
+	Server  bool
+	Logfile string
+}
+
+func (c Chardev) section() Section {
+	s := Section{Type: "chardev", Name: c.ID}
+	s.setIf("backend", c.Backend)
+	s.setIf("path", c.Path)
+	if c.Server {
+		s.Set("server", "on")
+		s.Set("wait", "off")
+	}
+	s.setIf("logfile", c.Logfile)
+	return s
+}
+
+// Object describes an [object "id"] section
+type Object struct {
+	ID      string
+	QomType string
+	Props   []Opt
+}
+
+func (o Object) section() Section {
+	s := Section{Type: "object", Name: o.ID}
+	s.Set("qom-type", o.QomType)
+	for _, p := range o.Props {
+		s.Set(p.Key, p.Value)
+	}
+	return s
+}
+
+// Config is a typed model of a QEMU -readconfig file.
+// Sections with no dedicated type (rtc, global, mon...) go to Extra.
+type Config struct {
+	Machine   Machine
+	SMP       SMP
+	Memory    Memory
+	IOThreads []string
+	Objects   []Object
+	Chardevs  []Chardev
+	Fsdevs    []Fsdev
+	Drives    []Drive
+	Devices   []Device
+	Extra     []Section
+}
+
+// NewConfig returns the base configuration used for all autobench VMs:
+// q35 machine with KVM, iommu, serial console chardev, a human monitor
+// and a QMP monitor.
+func NewConfig(vcpus, memory string) *Config {
+	c := &Config{
+		Machine: Machine{
+			Type:          "pc-q35-3.1",
+			Accel:         "kvm",
+			KernelIrqchip: "on",
+		},
+		SMP: SMP{
+			CPUs:    vcpus,
+			Sockets: "1",
+			Cores:   vcpus,
+			Threads: "1",
+		},
+		Memory: Memory{Size: memory},
+		Chardevs: []Chardev{
+			{ID: "ch0", Backend: "socket", Path: "qemu.serial.socket", Server: true, Logfile: "guest.log"},
+			{ID: "charmonitor", Backend: "socket", Path: "qemu.monitor.socket", Server: true},
+			{ID: "charqmp", Backend: "socket", Path: "qemu.qmp.socket", Server: true},
+		},
+		Devices: []Device{
+			{Driver: "intel-iommu", Props: []Opt{{"caching-mode", "on"}}},
+		},
+	}
+
+	c.Extra = []Section{
+		{Type: "rtc", Opts: []Opt{{"base", "localtime"}, {"driftfix", "slew"}}},
+		{Type: "global", Opts: []Opt{{"driver", "kvm-pit"}, {"property", "lost_tick_policy"}, {"value", "delay"}}},
+		{Type: "global", Opts: []Opt{{"driver", "ICH9-LPC"}, {"property", "disable_s3"}, {"value", "1"}}},
+		{Type: "global", Opts: []Opt{{"driver", "ICH9-LPC"}, {"property", "disable_s4"}, {"value", "1"}}},
+		{Type: "realtime", Opts: []Opt{{"mlock", "off"}}},
+		{Type: "msg", Opts: []Opt{{"timestamp", "on"}}},
+		{Type: "mon", Name: "charmonitor", Opts: []Opt{{"mode", "readline"}, {"chardev", "charmonitor"}}},
+		{Type: "mon", Name: "charqmp", Opts: []Opt{{"mode", "control"}, {"chardev", "charqmp"}}},
+	}
+	return c
+}
+
+// AddIOThread adds an iothread object and returns its id
+func (c *Config) AddIOThread(id string) string {
+	for _, t := range c.IOThreads {
+		if t == id {
+			return id
+		}
+	}
+	c.IOThreads = append(c.IOThreads, id)
+	return id
+}
+
+// Console holds the per-VM paths of the serial console and the monitors
+type Console struct {
+	SerialSocket  string
+	MonitorSocket string
+	QMPSocket     string
+	Log           string
+}
+
+// SetConsole moves the serial and monitor sockets and the console log of
+// NewConfig, which are relative to the cwd of QEMU, to per-VM paths
+func (c *Config) SetConsole(con Console) {
+	for i := range c.Chardevs {
+		switch c.Chardevs[i].ID {
+		case "ch0":
+			c.Chardevs[i].Path = con.SerialSocket
+			c.Chardevs[i].Logfile = con.Log
+		case "charmonitor":
+			c.Chardevs[i].Path = con.MonitorSocket
+		case "charqmp":
+			c.Chardevs[i].Path = con.QMPSocket
+		}
+	}
+}
+
+// ShareMemory backs guest RAM with a shared memfd object. This is required
+// by vhost-user devices, which map guest memory in another process.
+func (c *Config) ShareMemory() {
+	if c.Machine.MemoryBackend != "" {
+		return
+	}
+	c.Objects = append(c.Objects, Object{
+		ID:      "mem",
+		QomType: "memory-backend-memfd",
+		Props:   []Opt{{"size", c.Memory.Size + "M"}, {"share", "on"}},
+	})
+	c.Machine.MemoryBackend = "mem"
+}
+
+// BindMemory places guest RAM on a host NUMA node. Call it after the
+// disks are attached, so a shared backend of vhost-user is bound as well.
+func (c *Config) BindMemory(node int) {
+	if c.Machine.MemoryBackend == "" {
+		c.Objects = append(c.Objects, Object{
+			ID:      "mem",
+			QomType: "memory-backend-ram",
+			Props:   []Opt{{"size", c.Memory.Size + "M"}},
+		})
+		c.Machine.MemoryBackend = "mem"
+	}
+	for i := range c.Objects {
+		if c.Objects[i].ID == c.Machine.MemoryBackend {
+			c.Objects[i].Props = append(c.Objects[i].Props,
+				Opt{"host-nodes", strconv.Itoa(node)}, Opt{"policy", "bind"})
+		}
+	}
+}
+
+// Sections returns all sections in the order they are written
+func (c *Config) Sections() []Section {
+	var out []Section
+	out = append(out, c.Machine.section(), c.Memory.section(), c.SMP.section())
+	for _, id := range c.IOThreads {
+		out = append(out, Object{ID: id, QomType: "iothread"}.section())
+	}
+	for _, o := range c.Objects {
+		out = append(out, o.section())
+	}
+	for _, ch := range c.Chardevs {
+		out = append(out, ch.section())
+	}
+	for _, f := range c.Fsdevs {
+		out = append(out, f.section())
+	}
+	for _, d := range c.Drives {
+		out = append(out, d.section())
+	}
+	for _, d := range c.Devices {
+		out = append(out, d.section())
+	}
+	return append(out, c.Extra...)
+}
+
+// Encode writes the configuration in -readconfig format
+func (c *Config) Encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, s := range c.Sections() {
+		if err := s.writeTo(bw); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteFile writes the configuration to path, file will be overwritten
+func (c *Config) WriteFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if err := c.Encode(f); err != nil {
+		return fmt.Errorf("failed to write qemu config %s: %w", path, err)
+	}
+	return nil
+}
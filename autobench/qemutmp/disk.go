@@ -0,0 +1,172 @@
+package qemutmp
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Frontend is the way a disk is presented to the guest
+type Frontend string
+
+const (
+	VirtioBlk       Frontend = "virtio-blk"
+	VirtioSCSI      Frontend = "virtio-scsi"
+	VhostSCSI       Frontend = "vhost-scsi"
+	VhostUserBlk    Frontend = "vhost-user-blk"
+	NVMe            Frontend = "nvme"
+	VhostKernelNVMe Frontend = "vhost-kernel-nvme"
+)
+
+// Frontends lists all supported disk frontends
+var Frontends = []Frontend{VirtioBlk, VirtioSCSI, VhostSCSI, VhostUserBlk, NVMe, VhostKernelNVMe}
+
+// Disk describes a disk attachment. Depending on the frontend the disk is
+// backed by a host file or block device (File), a vhost-scsi target (WWPN)
+// or a vhost-user-blk server socket (Socket).
+type Disk struct {
+	ID       string
+	Frontend Frontend
+	File     string
+	Format   string // default "raw"
+	Serial   string
+	WWPN     string
+	Socket   string
+	IOThread bool   // run the device in a dedicated iothread
+	Queues   int    // 0 leaves the QEMU default
+	Discard  string // unmap passes guest discards to File, empty leaves the QEMU default (ignore)
+	Cache    string // cache mode of the drive, empty leaves the QEMU default (writeback)
+	AIO      string // threads, native or io_uring, empty leaves the QEMU default
+	Zeroes   string // detect-zeroes of the drive, empty leaves the QEMU default (off)
+	Props    []Opt  // runtime options of the format driver, e.g. l2-cache-size of qcow2
+	Compress bool   // writes go through the compress filter, the image needs a compression type
+	Bus      string
+	Addr     string
+}
+
+func (d Disk) drive() Drive {
+	format := d.Format
+	if format == "" {
+		format = "raw"
+	}
+	drive := Drive{ID: d.ID, File: d.File, Format: format, If: "none"}
+	if d.Compress {
+		// The filter is the top node, the image its child
+		drive = Drive{ID: d.ID, Format: "compress", If: "none",
+			Props: []Opt{{"file.driver", format}, {"file.file.filename", d.File}}}
+		for _, o := range d.Props {
+			drive.Props = append(drive.Props, Opt{"file." + o.Key, o.Value})
+		}
+	} else {
+		drive.Props = append(drive.Props, d.Props...)
+	}
+	if d.Cache != "" {
+		drive.Props = append(drive.Props, Opt{"cache", d.Cache})
+	}
+	if d.AIO != "" {
+		drive.Props = append(drive.Props, Opt{"aio", d.AIO})
+	}
+	if d.Discard != "" {
+		drive.Props = append(drive.Props, Opt{"discard", d.Discard})
+	}
+	if d.Zeroes != "" {
+		drive.Props = append(drive.Props, Opt{"detect-zeroes", d.Zeroes})
+	}
+	return drive
+}
+
+func (d Disk) pciProps() []Opt {
+	var props []Opt
+	if d.Bus != "" {
+		props = append(props, Opt{"bus", d.Bus})
+	}
+	if d.Addr != "" {
+		props = append(props, Opt{"addr", d.Addr})
+	}
+	return props
+}
+
+// AttachDisk composes the drive, device, iothread, chardev and object
+// sections needed to present d to the guest
+func (c *Config) AttachDisk(d Disk) error {
+	if d.ID == "" {
+		return fmt.Errorf("disk id is required")
+	}
+	props := d.pciProps()
+	if d.IOThread {
+		switch d.Frontend {
+		case VirtioBlk, VirtioSCSI:
+			props = append(props, Opt{"iothread", c.AddIOThread("iothread-" + d.ID)})
+		default:
+			return fmt.Errorf("frontend %s does not support iothreads", d.Frontend)
+		}
+	}
+
+	switch d.Frontend {
+	case VirtioBlk:
+		if d.Queues > 0 {
+			props = append(props, Opt{"num-queues", strconv.Itoa(d.Queues)})
+		}
+		c.Drives = append(c.Drives, d.drive())
+		props = append(props, Opt{"drive", d.ID})
+		if d.Serial != "" {
+			props = append(props, Opt{"serial", d.Serial})
+		}
+		c.Devices = append(c.Devices, Device{ID: "dev-" + d.ID, Driver: "virtio-blk-pci", Props: props})
+	case VirtioSCSI:
+		if d.Queues > 0 {
+			props = append(props, Opt{"num_queues", strconv.Itoa(d.Queues)})
+		}
+		ctrl := "vscsi-" + d.ID
+		c.Drives = append(c.Drives, d.drive())
+		c.Devices = append(c.Devices, Device{ID: ctrl, Driver: "virtio-scsi-pci", Props: props})
+		hd := []Opt{{"bus", ctrl + ".0"}, {"drive", d.ID}}
+		if d.Serial != "" {
+			hd = append(hd, Opt{"serial", d.Serial})
+		}
+		c.Devices = append(c.Devices, Device{ID: "dev-" + d.ID, Driver: "scsi-hd", Props: hd})
+	case VhostSCSI:
+		if d.WWPN == "" {
+			return fmt.Errorf("vhost-scsi disk %s needs a wwpn", d.ID)
+		}
+		props = append(props, Opt{"wwpn", d.WWPN})
+		if d.Queues > 0 {
+			props = append(props, Opt{"num_queues", strconv.Itoa(d.Queues)})
+		}
+		c.Devices = append(c.Devices, Device{ID: "dev-" + d.ID, Driver: "vhost-scsi-pci", Props: props})
+	case VhostUserBlk:
+		if d.Socket == "" {
+			return fmt.Errorf("vhost-user-blk disk %s needs a socket", d.ID)
+		}
+		c.ShareMemory()
+		chr := "chr-" + d.ID
+		c.Chardevs = append(c.Chardevs, Chardev{ID: chr, Backend: "socket", Path: d.Socket})
+		props = append(props, Opt{"chardev", chr})
+		if d.Queues > 0 {
+			props = append(props, Opt{"num-queues", strconv.Itoa(d.Queues)})
+		}
+		c.Devices = append(c.Devices, Device{ID: "dev-" + d.ID, Driver: "vhost-user-blk-pci", Props: props})
+	case NVMe:
+		c.Drives = append(c.Drives, d.drive())
+		props = append(props, Opt{"drive", d.ID}, Opt{"serial", nvmeSerial(d)})
+		if d.Queues > 0 {
+			props = append(props, Opt{"max_ioqpairs", strconv.Itoa(d.Queues)})
+		}
+		c.Devices = append(c.Devices, Device{ID: "dev-" + d.ID, Driver: "nvme", Props: props})
+	case VhostKernelNVMe:
+		// Same layout as configs/nvme-vhost.cfg
+		c.Drives = append(c.Drives, d.drive())
+		props = append(props, Opt{"serial", nvmeSerial(d)}, Opt{"drive", d.ID})
+		c.Devices = append(c.Devices, Device{ID: "dev-" + d.ID, Driver: "vhost-kernel-nvme", Props: props})
+	default:
+		return fmt.Errorf("unknown disk frontend: %s", d.Frontend)
+	}
+	return nil
+}
+
+// nvme devices refuse to start without a serial
+func nvmeSerial(d Disk) string {
+	if d.Serial != "" {
+		return d.Serial
+	}
+	return d.ID
+}
@@ -1,162 +1,89 @@
 package qemutmp
 
-const QemuConfTemplate = `
-[device]
-  driver = "intel-iommu"
-  caching-mode = "on"
-
-[device "scsi"]
-  driver = "virtio-scsi-pci"
-  bus = "pcie.0"
-  addr = "0x7"
-
-[device]
-  driver = "scsi-hd"
-  drive = "hd"
-
-[rtc]
-  base = "localtime"
-  driftfix = "slew"
-
-[global]
-  driver = "kvm-pit"
-  property = "lost_tick_policy"
-  value = "delay"
-
-[global]
-  driver = "ICH9-LPC"
-  property = "disable_s3"
-  value = "1"
-
-[global]
-  driver = "ICH9-LPC"
-  property = "disable_s4"
-  value = "1"
-
-[machine]
-  type = "pc-q35-3.1"
-  dump-guest-core = "off"
-  accel = "kvm"
-  vmport = "off"
-  kernel-irqchip = "on"
-  graphics = "off"
-
-[memory]
-  size = "{{.Memory}}"
-
-[smp-opts]
-  cpus = "{{.VCpus}}"
-  sockets = "1"
-  cores = "{{.VCpus}}"
-  threads = "1"
-
-[realtime]
-  mlock = "off"
-
-[msg]
-  timestamp = "on"
-
-[chardev "ch0"]
-  backend = "socket"
-  path = "qemu.serial.socket"
-  server = "on"
-  wait = "off"
-  logfile = "guest.log"
-
-[chardev "charmonitor"]
-  backend = "socket"
-  path = "qemu.monitor.socket"
-  server = "on"
-  wait = "off"
-
-[mon "charmonitor"]
-  mode = "readline"
-  chardev = "charmonitor"
-`
-
-const QemuConfVhostTemplate = `
-[device]
-  driver = "intel-iommu"
-  caching-mode = "on"
-
-[device "scsi"]
-  driver = "virtio-scsi-pci"
-  bus = "pcie.0"
-  addr = "0x7"
-
-[device]
-  driver = "scsi-hd"
-  drive = "hd"
-
-[device]
-  driver = "vhost-scsi-pci"
-  wwpn = "{{.VhostWWPN}}"
-  bus = "pcie.0"
-  addr = "0x08"
-
-[rtc]
-  base = "localtime"
-  driftfix = "slew"
-
-[global]
-  driver = "kvm-pit"
-  property = "lost_tick_policy"
-  value = "delay"
-
-[global]
-  driver = "ICH9-LPC"
-  property = "disable_s3"
-  value = "1"
-
-[global]
-  driver = "ICH9-LPC"
-  property = "disable_s4"
-  value = "1"
-
-[machine]
-  type = "pc-q35-3.1"
-  dump-guest-core = "off"
-  accel = "kvm"
-  vmport = "off"
-  kernel-irqchip = "on"
-  graphics = "off"
-
-[memory]
-  size = "{{.Memory}}"
-
-
-[smp-opts]
-  cpus = "{{.VCpus}}"
-  sockets = "1"
-  cores = "{{.VCpus}}"
-  threads = "1"
-
-[realtime]
-  mlock = "off"
-
-[msg]
-  timestamp = "on"
-
-[chardev "ch0"]
-  backend = "socket"
-  path = "qemu.serial.socket"
-  server = "on"
-  wait = "off"
-  logfile = "guest.log"
-
-[chardev "charmonitor"]
-  backend = "socket"
-  path = "qemu.monitor.socket"
-  server = "on"
-  wait = "off"
-
-[mon "charmonitor"]
-  mode = "readline"
-  chardev = "charmonitor"
-`
-
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+)
+
+// QemuUserData is the cloud-config of autobench guests, rendered from UserData
 const QemuUserData = `#cloud-config
-password: "{{.Password}}"
+hostname: {{.Hostname}}
+password: {{quote .Password}}
 chpasswd: { expire: False }
 ssh_pwauth: True
+{{- if .SSHKeys}}
+ssh_authorized_keys:
+{{- range .SSHKeys}}
+  - {{quote .}}
+{{- end}}
+{{- end}}
+{{- if .Packages}}
+package_update: true
+packages:
+{{- range .Packages}}
+  - {{.}}
+{{- end}}
+{{- end}}
+{{- if .VsockSSH}}
+bootcmd:
+  - |
+    cat > /etc/systemd/system/autobench-vsock.socket <<EOF
+    [Socket]
+    ListenStream=vsock::22
+    Accept=yes
+    EOF
+    cat > /etc/systemd/system/autobench-vsock@.service <<EOF
+    [Service]
+    ExecStart=-/usr/sbin/sshd -i
+    StandardInput=socket
+    EOF
+    systemctl daemon-reload
+    systemctl start --no-block autobench-vsock.socket
+{{- end}}
+`
+
+// QemuMetaData is the NoCloud meta-data, the instance id keeps cloud-init
+// from running again when a VM boots from the same overlay
+const QemuMetaData = `instance-id: {{.Hostname}}
+local-hostname: {{.Hostname}}
 `
+
+// UserData holds the values of the cloud-init seed of a guest
+type UserData struct {
+	Hostname string
+	Password string
+	SSHKeys  []string
+	Packages []string
+	VsockSSH bool // serve sshd on vsock port 22, started early in every boot
+}
+
+// quote writes s as a YAML double quoted scalar, JSON strings are one
+func quote(s string) (string, error) {
+	b, err := json.Marshal(s)
+	return string(b), err
+}
+
+func render(name, text string, data interface{}) ([]byte, error) {
+	t, err := template.New(name).Funcs(template.FuncMap{"quote": quote}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s template: %w", name, err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("render %s: %w", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Render returns the user-data and meta-data files of the seed
+func (u UserData) Render() (userData, metaData []byte, err error) {
+	if userData, err = render("user-data", QemuUserData, u); err != nil {
+		return nil, nil, err
+	}
+	if metaData, err = render("meta-data", QemuMetaData, u); err != nil {
+		return nil, nil, err
+	}
+	return userData, metaData, nil
+}
@@ -0,0 +1,63 @@
+package qemutmp
+
+import "fmt"
+
+// ShareType is the transport of a host directory shared with the guest
+type ShareType string
+
+const (
+	Share9p       ShareType = "9p"       // virtio-9p, served by QEMU itself
+	ShareVirtiofs ShareType = "virtiofs" // vhost-user-fs, served by virtiofsd
+)
+
+// ShareTypes lists the supported share transports
+var ShareTypes = []ShareType{Share9p, ShareVirtiofs}
+
+// Share is a host directory the guest mounts by Tag
+type Share struct {
+	Type   ShareType
+	Tag    string
+	Path   string // host dir, 9p only
+	Socket string // virtiofsd socket, virtiofs only
+}
+
+// Fsdev describes an [fsdev "id"] section
+type Fsdev struct {
+	ID            string
+	Driver        string
+	Path          string
+	SecurityModel string
+}
+
+func (f Fsdev) section() Section {
+	s := Section{Type: "fsdev", Name: f.ID}
+	s.setIf("fsdriver", f.Driver)
+	s.setIf("path", f.Path)
+	s.setIf("security_model", f.SecurityModel)
+	return s
+}
+
+// AttachShare composes the fsdev or chardev and the device of a share.
+// virtiofs maps guest memory in virtiofsd, so it needs shared memory.
+func (c *Config) AttachShare(sh Share) error {
+	id := "fs-" + sh.Tag
+	switch sh.Type {
+	case Share9p:
+		// files are created with the ids of QEMU, the guest writes as root
+		c.Fsdevs = append(c.Fsdevs, Fsdev{ID: id, Driver: "local", Path: sh.Path, SecurityModel: "none"})
+		c.Devices = append(c.Devices, Device{
+			Driver: "virtio-9p-pci",
+			Props:  []Opt{{"fsdev", id}, {"mount_tag", sh.Tag}},
+		})
+	case ShareVirtiofs:
+		c.Chardevs = append(c.Chardevs, Chardev{ID: id, Backend: "socket", Path: sh.Socket})
+		c.Devices = append(c.Devices, Device{
+			Driver: "vhost-user-fs-pci",
+			Props:  []Opt{{"chardev", id}, {"tag", sh.Tag}},
+		})
+		c.ShareMemory()
+	default:
+		return fmt.Errorf("unknown share type %s", sh.Type)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/backend"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/lio"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/netdev"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/tracker"
+)
+
+// namePrefix is carried by every pool, volume and target autobench creates
+const namePrefix = "fiotest"
+
+// res tracks the host resources of the current run
+var res *tracker.Tracker
+
+func defaultStatePath() string {
+	return filepath.Join(getSelfPath(), "autobench-state.json")
+}
+
+// handleSignals cancels the run on the first SIGINT/SIGTERM, so the VMs go
+// down and the resources are undone by the normal error path. A second
+// signal undoes the resources right away and exits.
+func handleSignals(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Got %v, stopping VMs and removing created resources", sig)
+		cancel()
+		sig = <-sigs
+		log.Printf("Got %v again, removing created resources now", sig)
+		if res != nil {
+			if err := res.Rollback(); err != nil {
+				log.Printf("cleanup failed: %v", err)
+			}
+		}
+		os.Exit(1)
+	}()
+}
+
+// scanResources finds autobench objects on the host by their name prefix.
+// The resources are returned in creation order.
+func scanResources() []tracker.Resource {
+	// Backstores go after the volumes they sit on and targets after the
+	// backstores, so the reverse undo order takes them down first
+	found := backend.Scan(namePrefix)
+	found = append(found, lio.Scan(namePrefix)...)
+	found = append(found, netdev.Scan(namePrefix)...)
+	return found
+}
+
+type CleanupCommand struct {
+	State string `short:"s" long:"state" description:"State file of the run to clean up (default: autobench-state.json next to the binary)"`
+	Scan  bool   `short:"a" long:"scan" description:"Also search the host for fiotest* pools, volume groups, mounts, loop and dm devices, LIO and nvmet targets, tap devices"`
+}
+
+var cleanupCmd CleanupCommand
+
+func (x *CleanupCommand) Execute(args []string) error {
+	statePath := cleanupCmd.State
+	if statePath == "" {
+		statePath = defaultStatePath()
+	}
+
+	var failed bool
+	state, err := tracker.Load(statePath)
+	switch {
+	case err == nil:
+		log.Printf("Removing %d resources listed in %s", len(state.Resources()), statePath)
+		if err := state.Rollback(); err != nil {
+			log.Printf("cleanup from state file failed: %v", err)
+			failed = true
+		}
+	case os.IsNotExist(err):
+		log.Printf("State file %s not found, scanning the host", statePath)
+		cleanupCmd.Scan = true
+	default:
+		return fmt.Errorf("could not read state file: %w", err)
+	}
+
+	if cleanupCmd.Scan {
+		found := scanResources()
+		log.Printf("Found %d leftover resources", len(found))
+		if left := tracker.UndoAll(found); len(left) != 0 {
+			log.Printf("%d found resources could not be removed", len(left))
+			failed = true
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("some resources could not be removed")
+	}
+	return nil
+}
+
+func init() {
+	parser.AddCommand(
+		"cleanup",
+		"Remove resources left by a crashed run",
+		"This command removes zpools, volume groups, volumes and LIO targets listed in the state file of a run or found by the fiotest name prefix",
+		&cleanupCmd,
+	)
+}
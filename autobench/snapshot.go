@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/backend"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/fioconv"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/mkconfig"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/qmp"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/vmimage"
+	"github.com/zededa-yuri/nextgen-storage/autobench/qemutmp"
+)
+
+// Kinds of snapshot mode
+const (
+	snapKindSnapshot = "snapshot" // zfs snapshot, lvcreate -s
+	snapKindQcow2    = "qcow2"    // external qcow2 overlay taken over QMP
+)
+
+// snapshotFillTime caps the write of the whole volume before the baseline
+const snapshotFillTime = 30 * time.Minute
+
+// snapshotRunBuffer covers taking a snapshot and collecting the results
+const snapshotRunBuffer = 3 * time.Minute
+
+// snapshotVM is what one depth did on one VM
+type snapshotVM struct {
+	VM         string            `json:"vm"`
+	Snapshot   string            `json:"snapshot,omitempty"` // taken before the run
+	TakeMs     float64           `json:"take_ms,omitempty"`
+	MBps       float64           `json:"mbps"`
+	IOPS       float64           `json:"iops"`
+	MeanMs     float64           `json:"clat_mean_ms"`
+	P99Ms      float64           `json:"clat_p99_ms"`
+	SpaceBytes int64             `json:"space_bytes"` // volume and snapshots after the run
+	Space      map[string]string `json:"space,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// snapshotDepth is the run of the workload with Depth snapshots taken
+type snapshotDepth struct {
+	Depth int           `json:"depth"`
+	VMs   []*snapshotVM `json:"vms"`
+}
+
+// snapshotRecord is the snapshot result of a test case
+type snapshotRecord struct {
+	Kind      string           `json:"kind"`
+	Workload  string           `json:"workload"`
+	Snapshots int              `json:"snapshots"`
+	Depths    []*snapshotDepth `json:"depths"`
+}
+
+// snapshotChain is the snapshot chain of the test volume of one VM
+type snapshotChain struct {
+	vm       *VirtM
+	sn       backend.Snapshotter
+	mon      *qmp.Monitor
+	snaps    []string // backend snapshot names
+	overlays []string
+	failed   bool
+}
+
+// snapshotWorkload returns the fio options of the workload run at every
+// snapshot depth
+func snapshotWorkload() (mkconfig.FioOptions, error) {
+	w := mkconfig.FioOptions{
+		Direct:    "1",
+		CheckSumm: FioOptions.CheckSumm,
+		SizeGb:    FioOptions.SizeGb,
+	}
+	if err := w.Operations.Set(qemuCmd.CSnapshotRW); err != nil {
+		return w, err
+	}
+	if err := w.BlockSize.Set(qemuCmd.CSnapshotBS); err != nil {
+		return w, err
+	}
+	if err := w.Iodepth.Set(strconv.Itoa(qemuCmd.CSnapshotDepth)); err != nil {
+		return w, err
+	}
+	if err := w.Jobs.Set("1"); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+// snapshotFill writes the whole test volume once, so the baseline
+// overwrites allocated blocks the way the runs after a snapshot do
+func snapshotFill() mkconfig.FioOptions {
+	return mkconfig.FioOptions{Direct: "1", SizeGb: FioOptions.SizeGb, Profiles: []mkconfig.Profile{{
+		Name: "snapshot-fill",
+		Jobs: []mkconfig.ProfileJob{{Name: "fill", Options: map[string]string{
+			"rw": "write", "bs": "1m", "iodepth": "16", "numjobs": "1",
+			"size": fmt.Sprintf("%dg", FioOptions.SizeGb), "time_based": "0",
+		}}},
+	}}}
+}
+
+// checkSnapshot validates the snapshot flags against the test matrix
+func checkSnapshot(cases []testCase) error {
+	if qemuCmd.CDensity || qemuCmd.CDiscard {
+		return fmt.Errorf("--snapshots does not combine with --density or --discard")
+	}
+	if qemuCmd.CLuns > 1 {
+		return fmt.Errorf("snapshot mode takes one test volume per VM, drop --luns")
+	}
+	if _, err := snapshotWorkload(); err != nil {
+		return err
+	}
+	for _, tc := range cases {
+		if tc.frontend.frontend == "" {
+			return fmt.Errorf("snapshot mode needs a test volume, use --backend")
+		}
+		if tc.filesystem != nil {
+			return fmt.Errorf("snapshot mode writes the raw test volume, it does not go with --fs")
+		}
+		be, err := backend.New(tc.backend, backend.Config{}, nil)
+		if err != nil {
+			return err
+		}
+		if qemuCmd.CSnapshotKind == snapKindQcow2 {
+			if be.BlockDevice() {
+				return fmt.Errorf("qcow2 overlays are files next to the volume, the %s backend has block devices", tc.backend)
+			}
+			switch tc.frontend.frontend {
+			case qemutmp.VirtioBlk, qemutmp.VirtioSCSI, qemutmp.NVMe:
+			default:
+				return fmt.Errorf("qcow2 overlays are taken in the QEMU block layer, %s bypasses it", tc.frontend.name)
+			}
+			continue
+		}
+		if _, ok := be.(backend.Snapshotter); !ok {
+			return fmt.Errorf("the %s backend can not take snapshots, use --snapshot-kind=qcow2", tc.backend)
+		}
+	}
+	return nil
+}
+
+// snapshotTotalTime bounds the lifetime of the VMs of a snapshot case
+func snapshotTotalTime() time.Duration {
+	runs := time.Duration(qemuCmd.CSnapshots + 1)
+	return snapshotFillTime + runs*(time.Duration(opts.TimeOneTest)*time.Second+snapshotRunBuffer) + 10*time.Minute
+}
+
+// take adds a snapshot to the chain and returns its name
+func (c *snapshotChain) take(depth int) (string, error) {
+	vol := c.vm.volumes[0]
+	name := fmt.Sprintf("snap%d", depth)
+	switch qemuCmd.CSnapshotKind {
+	case snapKindQcow2:
+		overlay := filepath.Join(filepath.Dir(c.vm.testDevices[0]), fmt.Sprintf("%s-%s.qcow2", vol, name))
+		args := map[string]string{"device": "test", "snapshot-file": overlay, "format": "qcow2"}
+		if err := c.mon.Execute("blockdev-snapshot-sync", args, nil); err != nil {
+			return "", err
+		}
+		c.overlays = append(c.overlays, overlay)
+		return filepath.Base(overlay), res.Add(vmimage.KindImage, overlay)
+	}
+	if err := c.sn.Snapshot(vol, name); err != nil {
+		return "", err
+	}
+	c.snaps = append(c.snaps, name)
+	return name, nil
+}
+
+// space returns the host space of the volume and its snapshots
+func (c *snapshotChain) space() (int64, map[string]string, error) {
+	vol := c.vm.volumes[0]
+	if c.sn != nil {
+		return c.sn.SnapshotSpace(vol)
+	}
+	raw := map[string]string{}
+	var total int64
+	if sr, ok := c.vm.backend.(backend.SpaceReporter); ok {
+		base, _, err := sr.Allocated(vol)
+		if err != nil {
+			return 0, nil, err
+		}
+		raw["base"] = strconv.FormatInt(base, 10)
+		total = base
+	}
+	for _, overlay := range c.overlays {
+		fi, err := os.Stat(overlay)
+		if err != nil {
+			return 0, raw, err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return 0, raw, fmt.Errorf("no block count of %s", overlay)
+		}
+		raw[filepath.Base(overlay)] = strconv.FormatInt(st.Blocks*512, 10)
+		total += st.Blocks * 512
+	}
+	return total, raw, nil
+}
+
+// destroySnapshots removes the snapshots, the volume can not be destroyed
+// before them
+func (c *snapshotChain) destroySnapshots() {
+	for i := len(c.snaps) - 1; i >= 0; i-- {
+		if err := c.sn.DestroySnapshot(c.vm.volumes[0], c.snaps[i]); err != nil {
+			log.Printf("Remove snapshot: %s failed! err:%v", c.snaps[i], err)
+		}
+	}
+	c.snaps = nil
+}
+
+// removeOverlays removes the qcow2 overlays once QEMU is gone
+func (c *snapshotChain) removeOverlays() {
+	if c.mon != nil {
+		c.mon.Close()
+	}
+	for i := len(c.overlays) - 1; i >= 0; i-- {
+		if err := res.Undo(vmimage.KindImage, c.overlays[i]); err != nil {
+			log.Printf("Remove overlay: %s failed! err:%v", c.overlays[i], err)
+		}
+	}
+	c.overlays = nil
+}
+
+// runSnapshotDepth takes the snapshot of a depth on one VM, runs the
+// workload and measures the space
+func runSnapshotDepth(ctx context.Context, c *snapshotChain, depth int, workload mkconfig.FioOptions) *snapshotVM {
+	vm := c.vm
+	r := &snapshotVM{VM: filepath.Base(vm.resultPath)}
+	fail := func(err error) *snapshotVM {
+		c.failed = true
+		r.Error = err.Error()
+		log.Printf("snapshot: VM localhost:%d, depth %d: %v", vm.port, depth, err)
+		return r
+	}
+	if c.failed {
+		r.Error = "an earlier depth failed"
+		return r
+	}
+	if depth > 0 {
+		start := time.Now()
+		name, err := c.take(depth)
+		if err != nil {
+			return fail(fmt.Errorf("could not take a %s: %w", qemuCmd.CSnapshotKind, err))
+		}
+		r.Snapshot = name
+		r.TakeMs = float64(time.Since(start).Microseconds()) / 1000
+	}
+
+	sub := fmt.Sprintf("snapshot-%02d", depth)
+	if err := vm.runFIO(sub, opts.LocalFolderResults, vm.targetDevice, workload, time.Duration(opts.TimeOneTest)*time.Second); err != nil {
+		return fail(fmt.Errorf("fio failed: %w", err))
+	}
+	jobs, err := fioconv.Summarize(filepath.Join(vm.resultPath, sub, "result.json"))
+	if err != nil || len(jobs) == 0 {
+		return fail(fmt.Errorf("no result: %v", err))
+	}
+	for _, j := range jobs {
+		r.MBps += float64(j.BWKiBs) / 1024
+		r.IOPS += j.IOPS
+		if j.MeanMs > r.MeanMs {
+			r.MeanMs = j.MeanMs
+		}
+		if j.P99Ms > r.P99Ms {
+			r.P99Ms = j.P99Ms
+		}
+	}
+	if r.SpaceBytes, r.Space, err = settledSpace(ctx, c.space); err != nil {
+		return fail(fmt.Errorf("could not read the space: %w", err))
+	}
+	return r
+}
+
+// runSnapshotCase boots the VMs of a case, fills their volumes and runs
+// the workload once without snapshots and once after every snapshot
+func runSnapshotCase(ctx context.Context, tc testCase, be backend.Backend, resultsDir string, totalTime time.Duration, mc *manifestCase) error {
+	var sn backend.Snapshotter
+	if qemuCmd.CSnapshotKind != snapKindQcow2 {
+		var ok bool
+		if sn, ok = be.(backend.Snapshotter); !ok {
+			return fmt.Errorf("the %s backend can not take snapshots", be.Name())
+		}
+	}
+
+	var virtM = make(VMlist, 0)
+	var chains []*snapshotChain
+	ctxVMs, cancelVMS := context.WithTimeout(ctx, totalTime)
+	defer cancelVMS()
+	// Overlays stay open until QEMU is gone, backend snapshots have to go
+	// before their volumes
+	defer func() {
+		for _, c := range chains {
+			c.removeOverlays()
+		}
+	}()
+	defer func() { virtM.FreeVM() }()
+	defer func() {
+		for _, c := range chains {
+			c.destroySnapshots()
+		}
+	}()
+	place, err := resolvePlacement(tc)
+	if err != nil {
+		return fmt.Errorf("placement %s failed: %w", tc.placement, err)
+	}
+	if err := virtM.AllocateVM(ctxVMs, totalTime, resultsDir, tc, be, place, qemuCmd.CCountVM); err != nil {
+		return fmt.Errorf("vm create in QEMU failed err:%v", err)
+	}
+	virtM.recordBackstores(mc)
+	virtM.recordDrives(mc)
+	if err := virtM.findTestDevices(tc); err != nil {
+		return err
+	}
+	if place != nil {
+		prec, err := applyPlacement(virtM, place)
+		if prec != nil {
+			mc.Placement = prec
+			defer prec.restore()
+		}
+		if err != nil {
+			return fmt.Errorf("placement %s failed: %w", tc.placement, err)
+		}
+	}
+
+	workload, err := snapshotWorkload()
+	if err != nil {
+		return err
+	}
+	rec := &snapshotRecord{
+		Kind:      qemuCmd.CSnapshotKind,
+		Workload:  fmt.Sprintf("%s %s iodepth %d", qemuCmd.CSnapshotRW, qemuCmd.CSnapshotBS, qemuCmd.CSnapshotDepth),
+		Snapshots: qemuCmd.CSnapshots,
+	}
+	mc.Snapshot = rec
+	for _, vm := range virtM {
+		c := &snapshotChain{vm: vm, sn: sn}
+		if qemuCmd.CSnapshotKind == snapKindQcow2 {
+			if c.mon, err = qmp.Dial(vm.qmpSocket); err != nil {
+				return fmt.Errorf("VM localhost:%d: %w", vm.port, err)
+			}
+		}
+		chains = append(chains, c)
+	}
+
+	log.Printf("snapshot: filling %d Gb of the test volume of %d VMs", FioOptions.SizeGb, len(virtM))
+	errs := make([]error, len(virtM))
+	var wg sync.WaitGroup
+	for i, vm := range virtM {
+		wg.Add(1)
+		go func(i int, vm *VirtM) {
+			defer wg.Done()
+			errs[i] = vm.runFIO("snapshot-fill", opts.LocalFolderResults, vm.targetDevice, snapshotFill(), snapshotFillTime)
+		}(i, vm)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("fill of VM localhost:%d failed: %w", virtM[i].port, err)
+		}
+	}
+
+	for depth := 0; depth <= qemuCmd.CSnapshots; depth++ {
+		d := &snapshotDepth{Depth: depth, VMs: make([]*snapshotVM, len(chains))}
+		for i, c := range chains {
+			wg.Add(1)
+			go func(i int, c *snapshotChain) {
+				defer wg.Done()
+				d.VMs[i] = runSnapshotDepth(ctx, c, depth, workload)
+			}(i, c)
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			return fmt.Errorf("test case %s interrupted: %w", tc.name, ctx.Err())
+		}
+		rec.Depths = append(rec.Depths, d)
+		for i, r := range d.VMs {
+			if r.Error == "" {
+				base := rec.Depths[0].VMs[i]
+				log.Printf("snapshot: %s depth %d: %.1f MB/s (%.0f%% of baseline), p99 %.2f ms, %d MiB on the host",
+					r.VM, depth, r.MBps, percentOf(r.MBps, base.MBps), r.P99Ms, r.SpaceBytes>>20)
+			}
+		}
+		if err := writeSnapshotReport(resultsDir, rec); err != nil {
+			log.Printf("Attention! %v", err)
+		}
+	}
+	return nil
+}
+
+// percentOf returns v as a percentage of base, 0 without a base
+func percentOf(v, base float64) float64 {
+	if base == 0 {
+		return 0
+	}
+	return v / base * 100
+}
+
+// writeSnapshotReport writes snapshot.csv and snapshot.json of a case
+func writeSnapshotReport(resultsDir string, rec *snapshotRecord) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(resultsDir, "snapshot.json"), data, 0644); err != nil {
+		return fmt.Errorf("could not write snapshot.json: %w", err)
+	}
+
+	fd, err := os.Create(filepath.Join(resultsDir, "snapshot.csv"))
+	if err != nil {
+		return fmt.Errorf("could not create snapshot.csv: %w", err)
+	}
+	defer fd.Close()
+	w := csv.NewWriter(fd)
+	w.Write([]string{
+		"Depth", "VM", "Snapshot", "Take (ms)", "MB/s", "IOPS", "Mean (ms)", "p99 (ms)",
+		"MB/s of baseline (%)", "p99 of baseline (%)", "Space (MiB)", "Error",
+	})
+	for _, d := range rec.Depths {
+		for i, r := range d.VMs {
+			base := rec.Depths[0].VMs[i]
+			w.Write([]string{
+				strconv.Itoa(d.Depth),
+				r.VM,
+				r.Snapshot,
+				fmt.Sprintf("%.1f", r.TakeMs),
+				fmt.Sprintf("%.2f", r.MBps),
+				fmt.Sprintf("%.0f", r.IOPS),
+				fmt.Sprintf("%.2f", r.MeanMs),
+				fmt.Sprintf("%.2f", r.P99Ms),
+				fmt.Sprintf("%.1f", percentOf(r.MBps, base.MBps)),
+				fmt.Sprintf("%.1f", percentOf(r.P99Ms, base.P99Ms)),
+				strconv.FormatInt(r.SpaceBytes>>20, 10),
+				r.Error,
+			})
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// writeSnapshotComparison lists the throughput, the worst p99 and the
+// space of every depth of every case in snapshot.csv of the run
+func writeSnapshotComparison(resultsDir string, cases []testCase, m *runManifest) error {
+	if len(cases) < 2 {
+		return nil
+	}
+	fd, err := os.Create(filepath.Join(resultsDir, "snapshot.csv"))
+	if err != nil {
+		return fmt.Errorf("could not create snapshot.csv: %w", err)
+	}
+	defer fd.Close()
+	w := csv.NewWriter(fd)
+
+	var header []string
+	for _, l := range cases[0].labels {
+		header = append(header, l.dim)
+	}
+	w.Write(append(header, "Depth", "VMs", "MB/s", "MB/s of baseline (%)", "p99 max (ms)",
+		"p99 of baseline (%)", "Space (MiB)", "Failed VMs"))
+	for i, tc := range cases {
+		if i >= len(m.Cases) || m.Cases[i].Snapshot == nil {
+			continue
+		}
+		var labels []string
+		for _, l := range tc.labels {
+			labels = append(labels, l.value)
+		}
+		var baseMBps, baseP99 float64
+		for _, d := range m.Cases[i].Snapshot.Depths {
+			var mbps, p99 float64
+			var space int64
+			var ok, failed int
+			for _, r := range d.VMs {
+				if r.Error != "" {
+					failed++
+					continue
+				}
+				ok++
+				mbps += r.MBps
+				// lvm-thin reports its whole pool on every VM
+				if r.Space["scope"] == "pool" {
+					if r.SpaceBytes > space {
+						space = r.SpaceBytes
+					}
+				} else {
+					space += r.SpaceBytes
+				}
+				if r.P99Ms > p99 {
+					p99 = r.P99Ms
+				}
+			}
+			if d.Depth == 0 {
+				baseMBps, baseP99 = mbps, p99
+			}
+			w.Write(append(append([]string{}, labels...),
+				strconv.Itoa(d.Depth),
+				strconv.Itoa(ok),
+				fmt.Sprintf("%.2f", mbps),
+				fmt.Sprintf("%.1f", percentOf(mbps, baseMBps)),
+				fmt.Sprintf("%.2f", p99),
+				fmt.Sprintf("%.1f", percentOf(p99, baseP99)),
+				strconv.FormatInt(space>>20, 10),
+				strconv.Itoa(failed),
+			))
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/fiotests"
+	"github.com/zededa-yuri/nextgen-storage/autobench/pkg/fsprep"
 	"golang.org/x/crypto/ssh"
 	kh "golang.org/x/crypto/ssh/knownhosts"
 )
@@ -94,8 +95,25 @@ func (x *SSHCommand) Execute(args []string) error {
 	}
 	defer sshClient.Close()
 
+	fs, err := singleFilesystem()
+	if err != nil {
+		return err
+	}
+	fioOptions, targetDevice, resultsDir := FioOptions, opts.TargetFIODevice, opts.LocalDirResults
+	if fs != nil {
+		if resultsDir, err = fiotests.ResultsDir(opts.LocalFolderResults, resultsDir); err != nil {
+			return err
+		}
+		run := fsprep.SSH(sshClient)
+		if fioOptions, err = prepareFilesystem(run, fs, targetDevice, resultsDir, fioOptions); err != nil {
+			return err
+		}
+		defer fsprep.Release(run, fsMountPoint)
+		targetDevice = ""
+	}
+
 	fmt.Println("FIO Tests start...")
-	err = fiotests.RunFIOTest(sshClient, sshCmd.SSHUser, opts.LocalFolderResults, opts.LocalDirResults, opts.TargetFIODevice, FioOptions, time.Duration(opts.TimeOneTest) * time.Second);
+	err = fiotests.RunFIOTest(sshClient, sshCmd.SSHUser, opts.LocalFolderResults, resultsDir, targetDevice, fioOptions, time.Duration(opts.TimeOneTest) * time.Second);
 	if err != nil {
 		return fmt.Errorf("FIO tests failed error: %v", err)
 	}